@@ -0,0 +1,136 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SQLite full-text index of news. It's a derived data, so it isn't created by migrations:
+// it's built when database is opened by a binary with FTS5 support (build tag sqlite_fts5)
+// and is kept in sync with news by triggers. Binaries without FTS5 search by scanning news
+
+// newsBodyExpr extracts text fields of the news payload like payloadText does
+const newsBodyExpr = `CASE WHEN json_valid(%[1]s.PayloadJSON)
+	THEN COALESCE((SELECT group_concat(value, ' ') FROM json_tree(%[1]s.PayloadJSON) WHERE type = 'text'), '')
+	ELSE COALESCE(%[1]s.PayloadJSON, '') END`
+
+var searchIndexTriggers = []string{"news_fts_insert", "news_fts_update", "news_fts_delete"}
+
+// fts5Available checks whether SQLite is compiled with FTS5
+func fts5Available(db *sql.DB) (bool, error) {
+	var used bool
+	err := db.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&used)
+
+	return used, err
+}
+
+// syncSearchIndex creates full-text index of news if SQLite supports FTS5 and returns
+// whether the index is used. Otherwise it drops triggers of the index created by another binary,
+// because they would fail every change of news
+func syncSearchIndex(db *sql.DB) (bool, error) {
+	available, err := fts5Available(db)
+	if err != nil {
+		return false, err
+	}
+
+	var triggers int
+	err = db.QueryRow(`
+	SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name IN (?, ?, ?)
+	`, searchIndexTriggers[0], searchIndexTriggers[1], searchIndexTriggers[2]).Scan(&triggers)
+	if err != nil {
+		return false, err
+	}
+
+	if !available {
+		for _, t := range searchIndexTriggers {
+			if _, err = db.Exec(`DROP TRIGGER IF EXISTS ` + t); err != nil {
+				return false, err
+			}
+		}
+
+		return false, nil
+	}
+
+	if triggers == len(searchIndexTriggers) {
+		return true, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// the index is rebuilt because news might be changed while triggers were missing
+	query := `
+	CREATE VIRTUAL TABLE IF NOT EXISTS news_fts USING fts5(Title, Body, tokenize = 'unicode61');
+	DELETE FROM news_fts;
+	INSERT INTO news_fts(rowid, Title, Body)
+	SELECT ID, COALESCE(Title, ''), ` + fmt.Sprintf(newsBodyExpr, "news") + ` FROM news;
+
+	CREATE TRIGGER IF NOT EXISTS news_fts_insert AFTER INSERT ON news BEGIN
+		INSERT INTO news_fts(rowid, Title, Body)
+		VALUES (new.ID, COALESCE(new.Title, ''), ` + fmt.Sprintf(newsBodyExpr, "new") + `);
+	END;
+	CREATE TRIGGER IF NOT EXISTS news_fts_update AFTER UPDATE OF Title, PayloadJSON ON news BEGIN
+		DELETE FROM news_fts WHERE rowid = old.ID;
+		INSERT INTO news_fts(rowid, Title, Body)
+		VALUES (new.ID, COALESCE(new.Title, ''), ` + fmt.Sprintf(newsBodyExpr, "new") + `);
+	END;
+	CREATE TRIGGER IF NOT EXISTS news_fts_delete AFTER DELETE ON news BEGIN
+		DELETE FROM news_fts WHERE rowid = old.ID;
+	END;
+	`
+	if _, err = tx.Exec(query); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func searchNewsIndex(db *sql.DB, q *searchQuery, limit, offset int) ([]*SearchResult, error) {
+	defer observeQuery(db, "search_news", time.Now())
+
+	// match in title is more relevant, bm25 is negative and lower is better
+	query := `
+	SELECT t1.ID, t1.Title, t2.URL,
+		snippet(news_fts, -1, ?, ?, ?, ?),
+		-bm25(news_fts, ?, 1.0)
+	FROM news_fts
+	JOIN news t1 ON t1.ID = news_fts.rowid
+	LEFT JOIN sources t2 ON t1.SourceID = t2.ID
+	WHERE news_fts MATCH ?
+	ORDER BY bm25(news_fts, ?, 1.0), t1.ID
+	LIMIT ? OFFSET ?
+	`
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(HighlightStart, HighlightEnd, snippetEllipsis, snippetTokens,
+		float64(titleWeight), q.fts5(), float64(titleWeight), limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*SearchResult
+
+	for rows.Next() {
+		var item SearchResult
+		var title, source sql.NullString
+		err = rows.Scan(&item.ID, &title, &source, &item.Snippet, &item.Rank)
+		if err != nil {
+			return nil, err
+		}
+
+		item.Title, item.Source = title.String, source.String
+		result = append(result, &item)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,701 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/feeder"
+)
+
+// MemoryDatabase keeps news and feed sources in memory. It has the same semantics
+// as SQL databases and is used by tests and runs which don't need to keep news.
+// Zero value is an empty database ready to use
+type MemoryDatabase struct {
+	mut sync.RWMutex
+	// news and sources are indexed by ID, deleted ones are nil, so IDs aren't reused
+	news    []*memoryNews
+	sources []*memorySource
+	// webhooks are indexed by ID too, deliveries are kept in order of attempts
+	webhooks   []*Webhook
+	deliveries []*WebhookDelivery
+	// lastDeliveryID isn't reused when deliveries of deleted webhook are removed
+	lastDeliveryID int
+}
+
+type memoryNews struct {
+	id        int
+	sourceID  int
+	guid      string
+	title     string
+	payload   string
+	hash      string
+	addedAt   time.Time
+	updatedAt time.Time
+	published time.Time
+	revisions []*NewsRevision
+}
+
+type memorySource struct {
+	id           int
+	url          string
+	rule         string
+	filter       string
+	interval     time.Duration
+	paused       bool
+	etag         string
+	lastModified string
+	health       feeder.FeedSourceHealth
+}
+
+// GetNews returns specific news count from database
+func (m *MemoryDatabase) GetNews(offset int, count int) ([]*News, error) {
+	return m.QueryNews(&NewsQuery{Offset: offset, Count: count})
+}
+
+// GetNewsWithTitle returns specific news count from database
+func (m *MemoryDatabase) GetNewsWithTitle(title string, offset int, count int) ([]*News, error) {
+	return m.QueryNews(&NewsQuery{Title: title, Offset: offset, Count: count})
+}
+
+// QueryNews returns news selected by the query
+func (m *MemoryDatabase) QueryNews(q *NewsQuery) ([]*News, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	search, err := q.searchQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	title := strings.ToLower(q.Title)
+	ids, sources := make(map[int]bool), make(map[int]bool)
+	for _, id := range q.IDs {
+		ids[id] = true
+	}
+	for _, id := range q.SourceIDs {
+		sources[id] = true
+	}
+
+	var found []*memoryNews
+	for _, n := range m.news {
+		if n != nil && strings.Contains(strings.ToLower(n.title), title) &&
+			(len(ids) == 0 || ids[n.id]) &&
+			(len(sources) == 0 || sources[n.sourceID]) &&
+			inRange(n.addedAt, q.AddedFrom, q.AddedTo) &&
+			inRange(n.published, q.PublishedFrom, q.PublishedTo) &&
+			matchFields(n.payload, q.Fields) &&
+			(search == nil || search.matches(n.title, n.payload)) &&
+			(q.Cursor == nil || q.Cursor.Before && q.Cursor.precedes(n.addedAt, n.id, q.Desc) ||
+				!q.Cursor.Before && q.Cursor.follows(n.addedAt, n.id, q.Desc)) {
+			found = append(found, n)
+		}
+	}
+
+	// news are added in order of IDs, news without publication time go last
+	sort.SliceStable(found, func(i, j int) bool {
+		a, b := found[i], found[j]
+		if q.SortBy == SortByPublished && !a.published.Equal(b.published) {
+			switch {
+			case a.published.IsZero():
+				return false
+			case b.published.IsZero():
+				return true
+			case q.Desc:
+				return a.published.After(b.published)
+			default:
+				return a.published.Before(b.published)
+			}
+		}
+
+		if q.Desc {
+			return a.id > b.id
+		}
+		return a.id < b.id
+	})
+
+	if q.Cursor != nil && q.Cursor.Before && len(found) > q.Count {
+		// the nearest news before the cursor are selected
+		found = found[len(found)-q.Count:]
+	}
+
+	result := m.page(found, q.Offset, q.Count)
+	if q.WithPayload {
+		for i, n := range result {
+			n.PayloadJSON = found[q.Offset+i].payload
+		}
+	}
+
+	return result, nil
+}
+
+// SearchNews returns news matching full-text search query from the most relevant
+func (m *MemoryDatabase) SearchNews(query string, offset int, count int) ([]*SearchResult, error) {
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	var result []*SearchResult
+	for _, n := range m.news {
+		if n == nil {
+			continue
+		}
+
+		if item := q.result(n.id, n.title, n.payload, m.sourceURL(n.sourceID)); item != nil {
+			result = append(result, item)
+		}
+	}
+
+	return sortSearchResults(result, count, offset), nil
+}
+
+// GetNewsDetail returns detail for news
+func (m *MemoryDatabase) GetNewsDetail(id int) (*NewsDetail, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	n := m.findNews(id)
+	if n == nil {
+		return nil, ErrNotFound
+	}
+
+	return &NewsDetail{Title: n.title, PayloadJSON: n.payload, Source: m.sourceURL(n.sourceID)}, nil
+}
+
+// CreateNews insert news to database or updates it if the source already has news with the GUID
+// and different content. Returns ID of news and whether it was updated.
+// Returns ErrAlreadyExists if the source already has the same news
+func (m *MemoryDatabase) CreateNews(sourceID int, guid, title string, payloadJSON []byte, published time.Time) (int, bool, error) {
+	if guid == "" || (title == "" && len(payloadJSON) == 0) {
+		return 0, false, ErrIncorrectArgs
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	hash := newsHash(title, payloadJSON)
+	now := time.Now().UTC()
+
+	for _, n := range m.news {
+		if n == nil || n.sourceID != sourceID || n.guid != guid {
+			continue
+		}
+
+		if n.hash == hash {
+			return n.id, false, ErrAlreadyExists
+		}
+
+		n.revisions = append(n.revisions, &NewsRevision{
+			Revision:    len(n.revisions) + 1,
+			Title:       n.title,
+			PayloadJSON: n.payload,
+			AddedAt:     n.changedAt(),
+		})
+		n.title, n.payload, n.hash, n.updatedAt = title, string(payloadJSON), hash, now
+		n.published = nullTime(published).Time
+
+		return n.id, true, nil
+	}
+
+	n := &memoryNews{
+		id:        len(m.news) + 1,
+		sourceID:  sourceID,
+		guid:      guid,
+		title:     title,
+		payload:   string(payloadJSON),
+		hash:      hash,
+		addedAt:   now,
+		published: nullTime(published).Time,
+	}
+	m.news = append(m.news, n)
+
+	return n.id, false, nil
+}
+
+// GetNewsRevisions returns all versions of news from the oldest to the current one
+func (m *MemoryDatabase) GetNewsRevisions(id int) ([]*NewsRevision, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	n := m.findNews(id)
+	if n == nil {
+		return nil, ErrNotFound
+	}
+
+	result := make([]*NewsRevision, 0, len(n.revisions)+1)
+	for _, r := range n.revisions {
+		item := *r
+		result = append(result, &item)
+	}
+
+	return append(result, &NewsRevision{
+		Revision:    len(n.revisions) + 1,
+		Title:       n.title,
+		PayloadJSON: n.payload,
+		AddedAt:     n.changedAt(),
+		Current:     true,
+	}), nil
+}
+
+// GetFeedSources returns all feed sources
+func (m *MemoryDatabase) GetFeedSources() ([]*feeder.FeedSource, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	var result []*feeder.FeedSource
+
+	for _, s := range m.sources {
+		if s == nil || s.health.Disabled || s.paused {
+			continue
+		}
+
+		item := feeder.FeedSource{
+			ID:           s.id,
+			URL:          s.url,
+			Interval:     s.interval,
+			ETag:         s.etag,
+			LastModified: s.lastModified,
+			Health:       s.health,
+		}
+
+		if !implementSource(&item, s.rule, s.filter) {
+			continue
+		}
+
+		result = append(result, &item)
+	}
+
+	return result, nil
+}
+
+// UpdateFeedSourceCache saves HTTP cache validators of the last feed response
+func (m *MemoryDatabase) UpdateFeedSourceCache(sourceID int, etag, lastModified string) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	s := m.findSource(sourceID)
+	if s == nil {
+		return ErrNotFound
+	}
+
+	s.etag, s.lastModified = etag, lastModified
+
+	return nil
+}
+
+// RecordFeedSourceReading applies outcome of the reading to the stored health of the source
+// and returns the resulting health
+func (m *MemoryDatabase) RecordFeedSourceReading(r *feeder.FeedSourceReading) (*feeder.FeedSourceHealth, error) {
+	if r == nil {
+		return nil, ErrIncorrectArgs
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	s := m.findSource(r.SourceID)
+	if s == nil {
+		return nil, ErrNotFound
+	}
+
+	reading := *r
+	reading.At = nullTime(r.At).Time
+	s.health.Apply(&reading)
+
+	h := s.health
+	return &h, nil
+}
+
+// GetFeedSourceHealth returns state of feed source readings
+func (m *MemoryDatabase) GetFeedSourceHealth(sourceID int) (*feeder.FeedSourceHealth, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	s := m.findSource(sourceID)
+	if s == nil {
+		return nil, ErrNotFound
+	}
+
+	result := s.health
+
+	return &result, nil
+}
+
+// GetFeedSourcesHealth returns states of all feed sources readings including disabled sources
+func (m *MemoryDatabase) GetFeedSourcesHealth() ([]*feeder.FeedSourceHealth, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	var result []*feeder.FeedSourceHealth
+
+	for _, s := range m.sources {
+		if s == nil {
+			continue
+		}
+
+		item := s.health
+		result = append(result, &item)
+	}
+
+	return result, nil
+}
+
+// CreateFeedSource saves feed source with its rule, filter, interval and paused state and returns its ID.
+// Zero interval means the source is read with the feed's own hint or the default period
+func (m *MemoryDatabase) CreateFeedSource(src *Source) (int, error) {
+	if src == nil {
+		return 0, ErrIncorrectArgs
+	}
+
+	if err := src.Validate(); err != nil {
+		return 0, err
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if m.findSourceByURL(src.URL) != nil {
+		return 0, ErrAlreadyExists
+	}
+
+	id := len(m.sources) + 1
+	m.sources = append(m.sources, &memorySource{
+		id:       id,
+		url:      src.URL,
+		rule:     src.Rule,
+		filter:   src.Filter,
+		interval: src.Interval / time.Second * time.Second,
+		paused:   src.Paused,
+		health:   feeder.FeedSourceHealth{SourceID: id},
+	})
+
+	return id, nil
+}
+
+// ListFeedSources returns all feed sources including paused and disabled ones
+func (m *MemoryDatabase) ListFeedSources() ([]*Source, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	var result []*Source
+
+	for _, s := range m.sources {
+		if s != nil {
+			result = append(result, s.source())
+		}
+	}
+
+	return result, nil
+}
+
+// GetFeedSource returns feed source by ID
+func (m *MemoryDatabase) GetFeedSource(id int) (*Source, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	s := m.findSource(id)
+	if s == nil {
+		return nil, ErrNotFound
+	}
+
+	return s.source(), nil
+}
+
+// UpdateFeedSource changes settings of feed source
+func (m *MemoryDatabase) UpdateFeedSource(id int, u *SourceUpdate) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	s := m.findSource(id)
+	if s == nil {
+		return ErrNotFound
+	}
+
+	item := s.source()
+	outdated, err := item.apply(u)
+	if err != nil {
+		return err
+	}
+
+	if other := m.findSourceByURL(item.URL); other != nil && other != s {
+		return ErrAlreadyExists
+	}
+
+	s.url, s.rule, s.filter, s.interval, s.paused, s.health = item.URL, item.Rule, item.Filter, item.Interval,
+		item.Paused, item.Health
+	if outdated {
+		s.etag, s.lastModified = "", ""
+	}
+
+	return nil
+}
+
+// DeleteFeedSource deletes feed source. News of the source are deleted if withNews is set
+func (m *MemoryDatabase) DeleteFeedSource(id int, withNews bool) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if m.findSource(id) == nil {
+		return ErrNotFound
+	}
+
+	m.sources[id-1] = nil
+
+	if withNews {
+		for i, n := range m.news {
+			if n != nil && n.sourceID == id {
+				m.news[i] = nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// CreateWebhook saves webhook and returns its ID
+func (m *MemoryDatabase) CreateWebhook(w *Webhook) (int, error) {
+	if err := validateWebhook(w); err != nil {
+		return 0, err
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	item := copyWebhook(w)
+	item.ID = len(m.webhooks) + 1
+	item.CreatedAt = time.Now().UTC()
+	m.webhooks = append(m.webhooks, item)
+
+	return item.ID, nil
+}
+
+// ListWebhooks returns all webhooks
+func (m *MemoryDatabase) ListWebhooks() ([]*Webhook, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	var result []*Webhook
+
+	for _, w := range m.webhooks {
+		if w != nil {
+			result = append(result, copyWebhook(w))
+		}
+	}
+
+	return result, nil
+}
+
+// GetWebhook returns webhook by ID
+func (m *MemoryDatabase) GetWebhook(id int) (*Webhook, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	w := m.findWebhook(id)
+	if w == nil {
+		return nil, ErrNotFound
+	}
+
+	return copyWebhook(w), nil
+}
+
+// DeleteWebhook deletes webhook with its delivery log
+func (m *MemoryDatabase) DeleteWebhook(id int) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if m.findWebhook(id) == nil {
+		return ErrNotFound
+	}
+
+	m.webhooks[id-1] = nil
+
+	deliveries := m.deliveries[:0]
+	for _, d := range m.deliveries {
+		if d.WebhookID != id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	m.deliveries = deliveries
+
+	return nil
+}
+
+// AddWebhookDelivery saves attempt to deliver news to webhook
+func (m *MemoryDatabase) AddWebhookDelivery(d *WebhookDelivery) error {
+	if d == nil || d.Attempt < 1 {
+		return ErrIncorrectArgs
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	if m.findWebhook(d.WebhookID) == nil {
+		return ErrNotFound
+	}
+
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+
+	m.lastDeliveryID++
+	d.ID = m.lastDeliveryID
+
+	item := *d
+	item.CreatedAt = item.CreatedAt.UTC()
+	m.deliveries = append(m.deliveries, &item)
+
+	return nil
+}
+
+// GetWebhookDeliveries returns delivery log of webhook, the latest attempts go first
+func (m *MemoryDatabase) GetWebhookDeliveries(webhookID int, offset, count int) ([]*WebhookDelivery, error) {
+	if offset < 0 || count < 0 {
+		return nil, ErrIncorrectArgs
+	}
+
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+
+	if m.findWebhook(webhookID) == nil {
+		return nil, ErrNotFound
+	}
+
+	var result []*WebhookDelivery
+
+	for i := len(m.deliveries) - 1; i >= 0 && len(result) < count; i-- {
+		if m.deliveries[i].WebhookID != webhookID {
+			continue
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		item := *m.deliveries[i]
+		result = append(result, &item)
+	}
+
+	return result, nil
+}
+
+// Migrate does nothing because memory database has no schema
+func (m *MemoryDatabase) Migrate() ([]int, error) {
+	return nil, nil
+}
+
+// Close does nothing, news are kept until the database is garbage collected
+func (m *MemoryDatabase) Close() error {
+	return nil
+}
+
+// page returns news from offset like LIMIT and OFFSET clauses do. Must be called under lock
+func (m *MemoryDatabase) page(news []*memoryNews, offset, count int) []*News {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset >= len(news) || count <= 0 {
+		return nil
+	}
+
+	end := offset + count
+	if end > len(news) {
+		end = len(news)
+	}
+
+	var result []*News
+	for _, n := range news[offset:end] {
+		item := &News{ID: n.id, Title: n.title, Source: m.sourceURL(n.sourceID), AddedAt: n.addedAt}
+		if !n.published.IsZero() {
+			published := n.published
+			item.PublishedAt = &published
+		}
+
+		result = append(result, item)
+	}
+
+	return result
+}
+
+// findNews returns news by ID or nil. IDs are 1-based indexes of news
+func (m *MemoryDatabase) findNews(id int) *memoryNews {
+	if id < 1 || id > len(m.news) {
+		return nil
+	}
+
+	return m.news[id-1]
+}
+
+// findSource returns feed source by ID or nil. IDs are 1-based indexes of sources
+func (m *MemoryDatabase) findSource(id int) *memorySource {
+	if id < 1 || id > len(m.sources) {
+		return nil
+	}
+
+	return m.sources[id-1]
+}
+
+func (m *MemoryDatabase) findSourceByURL(u string) *memorySource {
+	for _, s := range m.sources {
+		if s != nil && s.url == u {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryDatabase) sourceURL(id int) string {
+	if s := m.findSource(id); s != nil {
+		return s.url
+	}
+
+	return ""
+}
+
+func (s *memorySource) source() *Source {
+	return &Source{
+		ID:       s.id,
+		URL:      s.url,
+		Rule:     s.rule,
+		Filter:   s.filter,
+		Interval: s.interval,
+		Paused:   s.paused,
+		Health:   s.health,
+	}
+}
+
+// changedAt returns time of the last change of news
+func (n *memoryNews) changedAt() time.Time {
+	if !n.updatedAt.IsZero() {
+		return n.updatedAt
+	}
+
+	return n.addedAt
+}
+
+// findWebhook returns webhook by ID or nil. IDs are 1-based indexes of webhooks
+func (m *MemoryDatabase) findWebhook(id int) *Webhook {
+	if id < 1 || id > len(m.webhooks) {
+		return nil
+	}
+
+	return m.webhooks[id-1]
+}
+
+func copyWebhook(w *Webhook) *Webhook {
+	item := *w
+	item.SourceIDs = append([]int(nil), w.SourceIDs...)
+
+	return &item
+}
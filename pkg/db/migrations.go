@@ -0,0 +1,290 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migration is a numbered change of database schema. Migrations are applied in order
+// of versions and each of them only once. Migrations must tolerate databases
+// created before the migrations subsystem, which may already have some of the changes
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "create news and sources", createTables},
+	{2, "add feed source interval", addColumns("sources", []column{
+		{"Interval", "INTEGER NOT NULL DEFAULT 0"},
+	})},
+	{3, "add feed source cache validators", addColumns("sources", []column{
+		{"ETag", "TEXT NOT NULL DEFAULT ''"},
+		{"LastModified", "TEXT NOT NULL DEFAULT ''"},
+	})},
+	{4, "add feed source health", addColumns("sources", []column{
+		{"LastAttempt", "DATETIME"},
+		{"LastSuccess", "DATETIME"},
+		{"Failures", "INTEGER NOT NULL DEFAULT 0"},
+		{"LastError", "TEXT NOT NULL DEFAULT ''"},
+		{"LastStatus", "INTEGER NOT NULL DEFAULT 0"},
+		{"Disabled", "INTEGER NOT NULL DEFAULT 0"},
+	})},
+	{5, "identify news by guid within source", migrateNewsIdentity},
+	{6, "add news revisions", createNewsRevisions},
+	{7, "add news publication time", addNewsPublished},
+	{8, "add feed source pause", addColumns("sources", []column{
+		{"Paused", "INTEGER NOT NULL DEFAULT 0"},
+	})},
+	{9, "add webhooks", createWebhooks},
+	{10, "add feed source filter", addColumns("sources", []column{
+		{"Filter", "TEXT NOT NULL DEFAULT ''"},
+		{"Filtered", "INTEGER NOT NULL DEFAULT 0"},
+	})},
+}
+
+// migrate applies pending migrations and returns versions of applied ones.
+// Every migration is applied in its own transaction, so failed migration is rolled back
+// and the following ones aren't applied. bind converts '?' placeholders of the runner's
+// own queries to the database syntax, nil keeps them as is
+func migrate(db *sql.DB, list []migration, bind func(string) string) ([]int, error) {
+	if bind == nil {
+		bind = func(query string) string { return query }
+	}
+
+	query := `
+	CREATE TABLE IF NOT EXISTS schema_migrations(
+		Version INTEGER NOT NULL PRIMARY KEY,
+		Name TEXT NOT NULL,
+		AppliedAt TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	if _, err := db.Exec(query); err != nil {
+		return nil, err
+	}
+
+	current, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []int
+
+	for _, m := range list {
+		if m.version <= current {
+			continue
+		}
+
+		if err = applyMigration(db, m, bind); err != nil {
+			return applied, fmt.Errorf("Migration %d '%s' failed: %w", m.version, m.name, err)
+		}
+
+		applied = append(applied, m.version)
+	}
+
+	return applied, nil
+}
+
+func applyMigration(db *sql.DB, m migration, bind func(string) string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = m.up(tx); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(bind(`INSERT INTO schema_migrations(Version, Name) values(?, ?);`), m.version, m.name)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// schemaVersion returns version of the last applied migration or 0
+func schemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow(`SELECT COALESCE(MAX(Version), 0) FROM schema_migrations`).Scan(&version)
+
+	return version, err
+}
+
+// createTables creates needed tables if its not exist
+func createTables(tx *sql.Tx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS news(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		Title TEXT UNIQUE,
+		PayloadJSON TEXT,
+		SourceID INTEGER NOT NULL,
+		AddedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS sources(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		URL TEXT NOT NULL UNIQUE,
+		Rule TEXT NOT NULL
+	);
+	`
+	_, err := tx.Exec(query)
+
+	return err
+}
+
+// migrateNewsIdentity rebuilds news table, which had globally unique Title,
+// to identify news by GUID within a source. Title becomes GUID of existing news
+func migrateNewsIdentity(tx *sql.Tx) error {
+	exist, err := hasColumn(tx, "news", "GUID")
+	if err != nil || exist {
+		return err
+	}
+
+	query := `
+	CREATE TABLE news_new(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		GUID TEXT NOT NULL,
+		Title TEXT,
+		PayloadJSON TEXT,
+		SourceID INTEGER NOT NULL,
+		AddedAt DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(SourceID, GUID)
+	);
+	INSERT INTO news_new(ID, GUID, Title, PayloadJSON, SourceID, AddedAt)
+	SELECT ID, COALESCE(Title, CAST(ID AS TEXT)), Title, PayloadJSON, SourceID, AddedAt FROM news;
+	DROP TABLE news;
+	ALTER TABLE news_new RENAME TO news;
+	`
+	_, err = tx.Exec(query)
+
+	return err
+}
+
+func createNewsRevisions(tx *sql.Tx) error {
+	err := addColumns("news", []column{
+		{"Hash", "TEXT NOT NULL DEFAULT ''"},
+		{"UpdatedAt", "DATETIME"},
+	})(tx)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	CREATE TABLE IF NOT EXISTS news_revisions(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		NewsID INTEGER NOT NULL,
+		Revision INTEGER NOT NULL,
+		Title TEXT,
+		PayloadJSON TEXT,
+		Hash TEXT NOT NULL,
+		AddedAt DATETIME,
+		UNIQUE(NewsID, Revision)
+	);
+	`
+	_, err = tx.Exec(query)
+
+	return err
+}
+
+// addNewsPublished adds publication time of news and indexes which are used to filter and sort news
+func addNewsPublished(tx *sql.Tx) error {
+	err := addColumns("news", []column{
+		{"PublishedAt", "DATETIME"},
+	})(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(newsIndexes)
+
+	return err
+}
+
+func createWebhooks(tx *sql.Tx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS webhooks(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		URL TEXT NOT NULL,
+		SourceIDs TEXT NOT NULL DEFAULT '',
+		Keyword TEXT NOT NULL DEFAULT '',
+		Secret TEXT NOT NULL,
+		CreatedAt DATETIME NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		WebhookID INTEGER NOT NULL,
+		NewsID INTEGER NOT NULL,
+		Attempt INTEGER NOT NULL,
+		Status INTEGER NOT NULL DEFAULT 0,
+		Error TEXT NOT NULL DEFAULT '',
+		Delivered INTEGER NOT NULL DEFAULT 0,
+		CreatedAt DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries(WebhookID);
+	`
+	_, err := tx.Exec(query)
+
+	return err
+}
+
+// newsIndexes are the same for SQLite and PostgreSQL
+const newsIndexes = `
+	CREATE INDEX IF NOT EXISTS news_added ON news(AddedAt);
+	CREATE INDEX IF NOT EXISTS news_published ON news(PublishedAt);
+	CREATE INDEX IF NOT EXISTS news_source ON news(SourceID);
+	`
+
+type column struct {
+	name, definition string
+}
+
+// addColumns returns migration which adds columns to the table if they aren't exist yet
+func addColumns(table string, columns []column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range columns {
+			exist, err := hasColumn(tx, table, c.name)
+			if err != nil {
+				return err
+			}
+
+			if exist {
+				continue
+			}
+
+			if _, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + c.name + " " + c.definition); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// hasColumn checks whether the table has the column
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	exist := false
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+
+		if name == column {
+			exist = true
+		}
+	}
+
+	return exist, rows.Err()
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SortField is a time which news are sorted by
+type SortField int
+
+const (
+	SortByAdded SortField = iota
+	// SortByPublished sorts news by publication time. News without it go last
+	SortByPublished
+)
+
+// FieldFilter matches news which payload has the field. If Value is set, the field must be equal to it.
+// Fields which aren't strings are compared as JSON text, e.g. "1" or `{"name":"a"}`
+type FieldFilter struct {
+	Name  string
+	Value *string
+}
+
+// NewsQuery selects a page of news. Zero value filters don't restrict news.
+// Time ranges include From and exclude To
+type NewsQuery struct {
+	// Title is a substring of news title, case is ignored
+	Title string
+	// IDs restricts news to the listed ones
+	IDs []int
+	// Search is a full-text query which news must match, see SearchNews for its syntax
+	Search        string
+	SourceIDs     []int
+	AddedFrom     time.Time
+	AddedTo       time.Time
+	PublishedFrom time.Time
+	PublishedTo   time.Time
+	Fields        []FieldFilter
+	SortBy        SortField
+	Desc          bool
+	// Cursor selects news following or preceding it instead of Offset.
+	// It's supported by sorting by adding time only
+	Cursor *NewsCursor
+	Offset int
+	Count  int
+	// WithPayload fills payloads of the selected news
+	WithPayload bool
+}
+
+// NewsCursor is a position in news list sorted by adding time. News following
+// the position in the sort order are selected, or preceding it if Before is set
+type NewsCursor struct {
+	AddedAt time.Time
+	ID      int
+	Before  bool
+}
+
+type cursorToken struct {
+	AddedAt string `json:"a"`
+	ID      int    `json:"i"`
+	Before  bool   `json:"b,omitempty"`
+}
+
+// String returns opaque token of the cursor
+func (c *NewsCursor) String() string {
+	b, _ := json.Marshal(cursorToken{AddedAt: c.AddedAt.UTC().Format(time.RFC3339Nano), ID: c.ID, Before: c.Before})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseNewsCursor parses token returned by NewsCursor.String
+func ParseNewsCursor(token string) (*NewsCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: incorrect cursor", ErrIncorrectArgs)
+	}
+
+	var t cursorToken
+	if err = json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("%w: incorrect cursor", ErrIncorrectArgs)
+	}
+
+	addedAt, err := time.Parse(time.RFC3339Nano, t.AddedAt)
+	if err != nil {
+		return nil, fmt.Errorf("%w: incorrect cursor", ErrIncorrectArgs)
+	}
+
+	return &NewsCursor{AddedAt: addedAt, ID: t.ID, Before: t.Before}, nil
+}
+
+// follows checks whether news is after the cursor in the sort order
+func (c *NewsCursor) follows(addedAt time.Time, id int, desc bool) bool {
+	after := addedAt.After(c.AddedAt) || (addedAt.Equal(c.AddedAt) && id > c.ID)
+	if desc {
+		after = addedAt.Before(c.AddedAt) || (addedAt.Equal(c.AddedAt) && id < c.ID)
+	}
+
+	return after
+}
+
+// precedes checks whether news is before the cursor in the sort order
+func (c *NewsCursor) precedes(addedAt time.Time, id int, desc bool) bool {
+	return !(addedAt.Equal(c.AddedAt) && id == c.ID) && !c.follows(addedAt, id, desc)
+}
+
+func (q *NewsQuery) validate() error {
+	if q.Offset < 0 || q.Count < 0 {
+		return fmt.Errorf("%w: negative offset or count", ErrIncorrectArgs)
+	}
+
+	if q.SortBy != SortByAdded && q.SortBy != SortByPublished {
+		return fmt.Errorf("%w: unknown sort field %d", ErrIncorrectArgs, q.SortBy)
+	}
+
+	if q.Cursor != nil && (q.SortBy != SortByAdded || q.Offset > 0) {
+		return fmt.Errorf("%w: cursor can't be used with offset or sorting by publication time", ErrIncorrectArgs)
+	}
+
+	for _, f := range q.Fields {
+		if f.Name == "" || strings.ContainsAny(f.Name, `"\`) {
+			return fmt.Errorf("%w: incorrect payload field name '%s'", ErrIncorrectArgs, f.Name)
+		}
+	}
+
+	return nil
+}
+
+// searchQuery parses full-text query of news. It's nil if the query is empty
+func (q *NewsQuery) searchQuery() (*searchQuery, error) {
+	if q.Search == "" {
+		return nil, nil
+	}
+
+	return parseSearchQuery(q.Search)
+}
+
+// inRange checks whether t is in the range. Zero t is out of any restricted range
+func inRange(t, from, to time.Time) bool {
+	if from.IsZero() && to.IsZero() {
+		return true
+	}
+
+	return !t.IsZero() && (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
+
+// matchFields checks whether payload matches field filters like SQL databases do
+func matchFields(payload string, filters []FieldFilter) bool {
+	if len(filters) == 0 {
+		return true
+	}
+
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(payload), &fields) != nil {
+		return false
+	}
+
+	for _, f := range filters {
+		raw, exist := fields[f.Name]
+		if !exist || string(raw) == "null" {
+			return false
+		}
+
+		if f.Value != nil && fieldText(raw) != *f.Value {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fieldText returns string field as is and other fields as compact JSON
+func fieldText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+
+	var b bytes.Buffer
+	if json.Compact(&b, raw) != nil {
+		return string(raw)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,285 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/feeder"
+	_ "github.com/lib/pq"
+)
+
+// PostgresDatabase stores news and feed sources in PostgreSQL,
+// so several feeder instances can share one database
+type PostgresDatabase struct {
+	db *sql.DB
+}
+
+// NewPostgresDatabase connects to PostgreSQL by DSN and applies pending migrations
+func NewPostgresDatabase(dsn string) (*PostgresDatabase, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if _, err = migrate(db, postgresMigrations, numberPlaceholders); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &PostgresDatabase{db: db}, nil
+}
+
+// GetNews returns specific news count from database
+func (p *PostgresDatabase) GetNews(offset int, count int) ([]*News, error) {
+	return readNewsQuery(p.db, &NewsQuery{Offset: offset, Count: count})
+}
+
+// GetNewsWithTitle returns specific news count from database
+func (p *PostgresDatabase) GetNewsWithTitle(title string, offset int, count int) ([]*News, error) {
+	return readNewsQuery(p.db, &NewsQuery{Title: title, Offset: offset, Count: count})
+}
+
+// QueryNews returns news selected by the query
+func (p *PostgresDatabase) QueryNews(q *NewsQuery) ([]*News, error) {
+	return readNewsQuery(p.db, q)
+}
+
+// GetNewsDetail returns detail for news
+func (p *PostgresDatabase) GetNewsDetail(id int) (*NewsDetail, error) {
+	return readNewsDetail(p.db, id)
+}
+
+// CreateNews insert news to database or updates it if the source already has news with the GUID
+// and different content. Returns ID of news and whether it was updated.
+// Returns ErrAlreadyExists if the source already has the same news
+func (p *PostgresDatabase) CreateNews(sourceID int, guid, title string, payloadJSON []byte, published time.Time) (int, bool, error) {
+	return writeNews(p.db, sourceID, guid, title, payloadJSON, published)
+}
+
+// SearchNews returns news matching full-text search query from the most relevant.
+// PostgreSQL has no full-text index of news, so all news are scanned
+func (p *PostgresDatabase) SearchNews(query string, offset int, count int) ([]*SearchResult, error) {
+	return searchNewsScan(p.db, query, count, offset)
+}
+
+// GetNewsRevisions returns all versions of news from the oldest to the current one
+func (p *PostgresDatabase) GetNewsRevisions(id int) ([]*NewsRevision, error) {
+	return readNewsRevisions(p.db, id)
+}
+
+// GetFeedSources returns all feed sources
+func (p *PostgresDatabase) GetFeedSources() ([]*feeder.FeedSource, error) {
+	return readFeedSources(p.db)
+}
+
+// UpdateFeedSourceCache saves HTTP cache validators of the last feed response
+func (p *PostgresDatabase) UpdateFeedSourceCache(sourceID int, etag, lastModified string) error {
+	return writeFeedSourceCache(p.db, sourceID, etag, lastModified)
+}
+
+// RecordFeedSourceReading applies outcome of the reading to the stored health of the source
+// and returns the resulting health
+func (p *PostgresDatabase) RecordFeedSourceReading(r *feeder.FeedSourceReading) (*feeder.FeedSourceHealth, error) {
+	return writeFeedSourceReading(p.db, r)
+}
+
+// GetFeedSourceHealth returns state of feed source readings
+func (p *PostgresDatabase) GetFeedSourceHealth(sourceID int) (*feeder.FeedSourceHealth, error) {
+	return readFeedSourceHealth(p.db, sourceID)
+}
+
+// GetFeedSourcesHealth returns states of all feed sources readings including disabled sources
+func (p *PostgresDatabase) GetFeedSourcesHealth() ([]*feeder.FeedSourceHealth, error) {
+	return readFeedSourcesHealth(p.db)
+}
+
+// CreateFeedSource saves feed source with its rule, filter, interval and paused state and returns its ID.
+// Zero interval means the source is read with the feed's own hint or the default period
+func (p *PostgresDatabase) CreateFeedSource(src *Source) (int, error) {
+	return writeFeedSource(p.db, src)
+}
+
+// ListFeedSources returns all feed sources including paused and disabled ones
+func (p *PostgresDatabase) ListFeedSources() ([]*Source, error) {
+	return readSources(p.db)
+}
+
+// GetFeedSource returns feed source by ID
+func (p *PostgresDatabase) GetFeedSource(id int) (*Source, error) {
+	return readSource(p.db, id)
+}
+
+// UpdateFeedSource changes settings of feed source
+func (p *PostgresDatabase) UpdateFeedSource(id int, u *SourceUpdate) error {
+	return updateFeedSource(p.db, id, u)
+}
+
+// DeleteFeedSource deletes feed source. News of the source are deleted if withNews is set
+func (p *PostgresDatabase) DeleteFeedSource(id int, withNews bool) error {
+	return deleteFeedSource(p.db, id, withNews)
+}
+
+// CreateWebhook saves webhook and returns its ID
+func (p *PostgresDatabase) CreateWebhook(w *Webhook) (int, error) {
+	return writeWebhook(p.db, w)
+}
+
+// ListWebhooks returns all webhooks
+func (p *PostgresDatabase) ListWebhooks() ([]*Webhook, error) {
+	return readWebhooks(p.db)
+}
+
+// GetWebhook returns webhook by ID
+func (p *PostgresDatabase) GetWebhook(id int) (*Webhook, error) {
+	return readWebhook(p.db, id)
+}
+
+// DeleteWebhook deletes webhook with its delivery log
+func (p *PostgresDatabase) DeleteWebhook(id int) error {
+	return deleteWebhook(p.db, id)
+}
+
+// AddWebhookDelivery saves attempt to deliver news to webhook
+func (p *PostgresDatabase) AddWebhookDelivery(d *WebhookDelivery) error {
+	return writeWebhookDelivery(p.db, d)
+}
+
+// GetWebhookDeliveries returns delivery log of webhook, the latest attempts go first
+func (p *PostgresDatabase) GetWebhookDeliveries(webhookID int, offset, count int) ([]*WebhookDelivery, error) {
+	return readWebhookDeliveries(p.db, webhookID, offset, count)
+}
+
+// Migrate applies pending schema migrations and returns their versions
+func (p *PostgresDatabase) Migrate() ([]int, error) {
+	return migrate(p.db, postgresMigrations, numberPlaceholders)
+}
+
+// Close closes database connection pool
+func (p *PostgresDatabase) Close() error {
+	return p.db.Close()
+}
+
+// postgresMigrations are applied to PostgreSQL database. Unlike SQLite migrations
+// they don't need to support databases created before the migrations subsystem
+var postgresMigrations = []migration{
+	{1, "create news, news revisions and sources", createPostgresTables},
+	{2, "add news publication time", addPostgresNewsPublished},
+	{3, "add feed source pause", addPostgresSourcePaused},
+	{4, "add webhooks", createPostgresWebhooks},
+	{5, "add feed source filter", addPostgresSourceFilter},
+	{6, "add safe payload cast", createPostgresSafeJSON},
+}
+
+func createPostgresTables(tx *sql.Tx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS news(
+		ID SERIAL PRIMARY KEY,
+		GUID TEXT NOT NULL,
+		Title TEXT,
+		PayloadJSON TEXT,
+		Hash TEXT NOT NULL DEFAULT '',
+		SourceID INTEGER NOT NULL,
+		AddedAt TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		UpdatedAt TIMESTAMPTZ,
+		UNIQUE(SourceID, GUID)
+	);
+	CREATE TABLE IF NOT EXISTS news_revisions(
+		ID SERIAL PRIMARY KEY,
+		NewsID INTEGER NOT NULL,
+		Revision INTEGER NOT NULL,
+		Title TEXT,
+		PayloadJSON TEXT,
+		Hash TEXT NOT NULL,
+		AddedAt TIMESTAMPTZ,
+		UNIQUE(NewsID, Revision)
+	);
+	CREATE TABLE IF NOT EXISTS sources(
+		ID SERIAL PRIMARY KEY,
+		URL TEXT NOT NULL UNIQUE,
+		Rule TEXT NOT NULL,
+		"Interval" INTEGER NOT NULL DEFAULT 0,
+		ETag TEXT NOT NULL DEFAULT '',
+		LastModified TEXT NOT NULL DEFAULT '',
+		LastAttempt TIMESTAMPTZ,
+		LastSuccess TIMESTAMPTZ,
+		Failures INTEGER NOT NULL DEFAULT 0,
+		LastError TEXT NOT NULL DEFAULT '',
+		LastStatus INTEGER NOT NULL DEFAULT 0,
+		Disabled BOOLEAN NOT NULL DEFAULT FALSE
+	);
+	`
+	_, err := tx.Exec(query)
+
+	return err
+}
+
+func addPostgresNewsPublished(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE news ADD COLUMN IF NOT EXISTS PublishedAt TIMESTAMPTZ;` + newsIndexes)
+
+	return err
+}
+
+func addPostgresSourcePaused(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE sources ADD COLUMN IF NOT EXISTS Paused BOOLEAN NOT NULL DEFAULT FALSE;`)
+
+	return err
+}
+
+func addPostgresSourceFilter(tx *sql.Tx) error {
+	query := `
+	ALTER TABLE sources ADD COLUMN IF NOT EXISTS Filter TEXT NOT NULL DEFAULT '';
+	ALTER TABLE sources ADD COLUMN IF NOT EXISTS Filtered INTEGER NOT NULL DEFAULT 0;
+	`
+	_, err := tx.Exec(query)
+
+	return err
+}
+
+// createPostgresSafeJSON adds function which casts payload to jsonb. Payload which isn't JSON,
+// e.g. saved by older versions, is NULL, so it doesn't fail queries filtering by payload fields
+func createPostgresSafeJSON(tx *sql.Tx) error {
+	query := `
+	CREATE OR REPLACE FUNCTION feeder_jsonb(payload TEXT) RETURNS jsonb AS $$
+	BEGIN
+		RETURN payload::jsonb;
+	EXCEPTION WHEN others THEN
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql IMMUTABLE;
+	`
+	_, err := tx.Exec(query)
+
+	return err
+}
+
+func createPostgresWebhooks(tx *sql.Tx) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS webhooks(
+		ID SERIAL PRIMARY KEY,
+		URL TEXT NOT NULL,
+		SourceIDs TEXT NOT NULL DEFAULT '',
+		Keyword TEXT NOT NULL DEFAULT '',
+		Secret TEXT NOT NULL,
+		CreatedAt TIMESTAMPTZ NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries(
+		ID SERIAL PRIMARY KEY,
+		WebhookID INTEGER NOT NULL,
+		NewsID INTEGER NOT NULL,
+		Attempt INTEGER NOT NULL,
+		Status INTEGER NOT NULL DEFAULT 0,
+		Error TEXT NOT NULL DEFAULT '',
+		Delivered BOOLEAN NOT NULL DEFAULT FALSE,
+		CreatedAt TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries(WebhookID);
+	`
+	_, err := tx.Exec(query)
+
+	return err
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"testing"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	"github.com/stretchr/testify/assert"
+)
+
+// postgresDSNEnv is the environment variable with DSN of a local PostgreSQL used by tests.
+// If it is empty, tests start an embedded PostgreSQL
+const postgresDSNEnv = "FEEDER_POSTGRES_DSN"
+
+const embeddedPostgresPort = 54329
+
+// startPostgres returns DSN of an empty PostgreSQL database. It skips the test
+// if neither local nor embedded PostgreSQL is available
+func startPostgres(t *testing.T) string {
+	if dsn := os.Getenv(postgresDSNEnv); dsn != "" {
+		return dsn
+	}
+
+	pg := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(embeddedPostgresPort).
+		Database("feeder").
+		RuntimePath(t.TempDir()).
+		Logger(io.Discard))
+	if err := pg.Start(); err != nil {
+		t.Skipf("PostgreSQL isn't available, set %s to run the test: %s", postgresDSNEnv, err)
+	}
+	t.Cleanup(func() { pg.Stop() })
+
+	return "host=localhost port=" + strconv.Itoa(embeddedPostgresPort) +
+		" user=postgres password=postgres dbname=feeder sslmode=disable"
+}
+
+func TestPostgresDatabaseConformance(t *testing.T) {
+	dsn := startPostgres(t)
+
+	testConformance(t, func(t *testing.T) conformanceStorage {
+		p, err := NewPostgresDatabase(dsn)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		t.Cleanup(func() { p.Close() })
+
+		_, err = p.db.Exec(`TRUNCATE news, news_revisions, sources, webhooks, webhook_deliveries RESTART IDENTITY`)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		return p
+	})
+}
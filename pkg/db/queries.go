@@ -0,0 +1,943 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/feeder"
+	"github.com/bsbsm/feeder/pkg/metrics"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Queries below are shared by SQLite and PostgreSQL databases.
+// They are written with '?' placeholders which bind converts for PostgreSQL
+
+// pgUniqueViolation is PostgreSQL error code of UNIQUE constraint violation
+const pgUniqueViolation = "23505"
+
+// isPostgres checks whether db is PostgreSQL database
+func isPostgres(db *sql.DB) bool {
+	_, ok := db.Driver().(*pq.Driver)
+	return ok
+}
+
+// bind converts '?' placeholders of the query to '$N' if db is PostgreSQL
+func bind(db *sql.DB, query string) string {
+	if !isPostgres(db) {
+		return query
+	}
+
+	return numberPlaceholders(query)
+}
+
+// observeQuery records duration of the storage operation started at start
+func observeQuery(db *sql.DB, operation string, start time.Time) {
+	backend := "sqlite"
+	if isPostgres(db) {
+		backend = "postgres"
+	}
+
+	metrics.QueryDuration.WithLabelValues(backend, operation).Observe(time.Since(start).Seconds())
+}
+
+func numberPlaceholders(query string) string {
+	var b strings.Builder
+	n := 0
+
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// writeNews inserts news or updates it if the source already has news with the GUID
+// and its content is changed. Previous version of updated news is kept in news_revisions
+func writeNews(db *sql.DB, sourceID int, guid, title string, payloadJSON []byte, published time.Time) (int, bool, error) {
+	defer observeQuery(db, "create_news", time.Now())
+
+	if guid == "" || (title == "" && len(payloadJSON) == 0) {
+		return 0, false, ErrIncorrectArgs
+	}
+
+	hash := newsHash(title, payloadJSON)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var (
+		id                     int
+		oldTitle, oldPayload   sql.NullString
+		oldHash                string
+		oldAddedAt, oldUpdated sql.NullTime
+	)
+
+	err = tx.QueryRow(bind(db, `
+	SELECT ID, Title, PayloadJSON, Hash, AddedAt, UpdatedAt FROM news
+	WHERE SourceID = ? AND GUID = ?;
+	`), sourceID, guid).Scan(&id, &oldTitle, &oldPayload, &oldHash, &oldAddedAt, &oldUpdated)
+
+	// news migrated from versions without GUID are identified by their titles until they are read again,
+	// then they get the real GUID, so the feed doesn't duplicate them
+	relinked := false
+	if err == sql.ErrNoRows && title != "" {
+		err = tx.QueryRow(bind(db, `
+		SELECT ID, Title, PayloadJSON, Hash, AddedAt, UpdatedAt FROM news
+		WHERE SourceID = ? AND Title = ? AND GUID = Title
+		ORDER BY ID LIMIT 1;
+		`), sourceID, title).Scan(&id, &oldTitle, &oldPayload, &oldHash, &oldAddedAt, &oldUpdated)
+
+		if err == nil {
+			if _, err = tx.Exec(bind(db, `UPDATE news SET GUID = ? WHERE ID = ?;`), guid, id); err != nil {
+				return 0, false, err
+			}
+			relinked = true
+		}
+	}
+
+	switch {
+	case err == sql.ErrNoRows:
+		// news may be inserted concurrently by another instance sharing the database
+		err = tx.QueryRow(bind(db, `
+		INSERT INTO news(
+			GUID,
+			Title,
+			PayloadJSON,
+			Hash,
+			SourceID,
+			PublishedAt
+		) values(?, ?, ?, ?, ?, ?)
+		ON CONFLICT(SourceID, GUID) DO NOTHING
+		RETURNING ID;
+		`), guid, title, string(payloadJSON), hash, sourceID, nullTime(published)).Scan(&id)
+		if err == sql.ErrNoRows || isUniqueViolation(err) {
+			return 0, false, ErrAlreadyExists
+		} else if err != nil {
+			return 0, false, err
+		}
+
+		return id, false, tx.Commit()
+	case err != nil:
+		return 0, false, err
+	case oldHash == hash:
+		if relinked {
+			if err = tx.Commit(); err != nil {
+				return 0, false, err
+			}
+		}
+
+		return id, false, ErrAlreadyExists
+	case oldHash == "":
+		// news saved by previous versions has no hash, so the change can't be detected
+		if _, err = tx.Exec(bind(db, `UPDATE news SET Hash = ? WHERE ID = ?;`), hash, id); err != nil {
+			return 0, false, err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return 0, false, err
+		}
+
+		return id, false, ErrAlreadyExists
+	}
+
+	_, err = tx.Exec(bind(db, `
+	INSERT INTO news_revisions(
+		NewsID,
+		Revision,
+		Title,
+		PayloadJSON,
+		Hash,
+		AddedAt
+	) values(?, (SELECT COALESCE(MAX(Revision), 0) + 1 FROM news_revisions WHERE NewsID = ?), ?, ?, ?, ?);
+	`), id, id, oldTitle, oldPayload, oldHash, latestTime(oldAddedAt, oldUpdated))
+	if err != nil {
+		return 0, false, err
+	}
+
+	_, err = tx.Exec(bind(db, `
+	UPDATE news SET Title = ?, PayloadJSON = ?, Hash = ?, PublishedAt = ?, UpdatedAt = CURRENT_TIMESTAMP
+	WHERE ID = ?;
+	`), title, string(payloadJSON), hash, nullTime(published), id)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return id, true, tx.Commit()
+}
+
+// readNewsQuery returns news selected by the query
+func readNewsQuery(db *sql.DB, q *NewsQuery) ([]*News, error) {
+	defer observeQuery(db, "query_news", time.Now())
+
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+
+	pg := isPostgres(db)
+
+	var where []string
+	var args []interface{}
+
+	if q.Title != "" {
+		where = append(where, "LOWER(t1.Title) LIKE LOWER(?)")
+		args = append(args, "%"+q.Title+"%")
+	}
+
+	inList := func(column string, ids []int) {
+		if len(ids) == 0 {
+			return
+		}
+
+		where = append(where, column+" IN (?"+strings.Repeat(", ?", len(ids)-1)+")")
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	inList("t1.ID", q.IDs)
+	inList("t1.SourceID", q.SourceIDs)
+
+	search, err := q.searchQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite searches by full-text index if it's built, otherwise news are matched while they're read
+	scan := search != nil && (pg || !searchIndexEnabled)
+	if search != nil && !scan {
+		where = append(where, "t1.ID IN (SELECT rowid FROM news_fts WHERE news_fts MATCH ?)")
+		args = append(args, search.fts5())
+	}
+
+	timeRange := func(column string, from, to time.Time) {
+		if !from.IsZero() {
+			where = append(where, timeExpr(pg, column)+" >= "+timeExpr(pg, "?"))
+			args = append(args, from.UTC())
+		}
+
+		if !to.IsZero() {
+			where = append(where, timeExpr(pg, column)+" < "+timeExpr(pg, "?"))
+			args = append(args, to.UTC())
+		}
+	}
+	timeRange("t1.AddedAt", q.AddedFrom, q.AddedTo)
+	timeRange("t1.PublishedAt", q.PublishedFrom, q.PublishedTo)
+
+	for _, f := range q.Fields {
+		if f.Value == nil {
+			where = append(where, fieldExpr(pg)+" IS NOT NULL")
+			args = append(args, fieldPath(pg, f.Name))
+		} else {
+			where = append(where, fieldExpr(pg)+" = ?")
+			args = append(args, fieldPath(pg, f.Name), *f.Value)
+		}
+	}
+
+	// news preceding the cursor are selected in reverse order and then reversed back
+	desc, reverse := q.Desc, q.Cursor != nil && q.Cursor.Before
+	if reverse {
+		desc = !desc
+	}
+
+	if q.Cursor != nil {
+		op := ">"
+		if desc {
+			op = "<"
+		}
+
+		where = append(where, "(t1.AddedAt, t1.ID) "+op+" (?, ?)")
+		args = append(args, cursorTime(pg, q.Cursor.AddedAt), q.Cursor.ID)
+	}
+
+	withPayload := q.WithPayload || scan
+
+	query := `
+	SELECT t1.ID, t1.Title, COALESCE(t2.URL, ''), t1.AddedAt, t1.PublishedAt`
+	if withPayload {
+		query += ", COALESCE(t1.PayloadJSON, '')"
+	}
+	query += ` FROM news t1
+	LEFT JOIN sources t2 ON t1.SourceID = t2.ID
+	`
+	if len(where) > 0 {
+		query += "WHERE " + strings.Join(where, " AND ") + "\n"
+	}
+
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+
+	switch q.SortBy {
+	case SortByPublished:
+		query += "ORDER BY t1.PublishedAt IS NULL, " + timeExpr(pg, "t1.PublishedAt") + " " + dir + ", t1.ID " + dir
+	default:
+		query += "ORDER BY t1.AddedAt " + dir + ", t1.ID " + dir
+	}
+
+	// matched news are paged while they're read
+	if !scan {
+		query += "\nLIMIT ? OFFSET ?"
+		args = append(args, q.Count, q.Offset)
+	}
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*News
+	skip := q.Offset
+
+	for rows.Next() {
+		if scan && len(result) == q.Count {
+			break
+		}
+
+		var item News
+		var published sql.NullTime
+		dest := []interface{}{&item.ID, &item.Title, &item.Source, &item.AddedAt, &published}
+		if withPayload {
+			dest = append(dest, &item.PayloadJSON)
+		}
+
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		if scan {
+			if !search.matches(item.Title, item.PayloadJSON) {
+				continue
+			}
+
+			if skip > 0 {
+				skip--
+				continue
+			}
+		}
+
+		if published.Valid {
+			item.PublishedAt = &published.Time
+		}
+		if !q.WithPayload {
+			item.PayloadJSON = ""
+		}
+
+		result = append(result, &item)
+	}
+
+	if reverse {
+		for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+			result[i], result[j] = result[j], result[i]
+		}
+	}
+
+	return result, rows.Err()
+}
+
+// cursorTime returns time of cursor to compare with AddedAt column as is, so its index is used.
+// SQLite stores AddedAt as text in CURRENT_TIMESTAMP format
+func cursorTime(pg bool, t time.Time) interface{} {
+	if pg {
+		return t
+	}
+
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// timeExpr returns comparable SQL expression of time. SQLite stores time as text in different formats
+func timeExpr(pg bool, expr string) string {
+	if pg {
+		return expr
+	}
+
+	return "julianday(" + expr + ")"
+}
+
+// fieldExpr returns SQL expression of payload field as text. Its path is the parameter.
+// Strings are unquoted and other values are kept as they are in JSON like fieldText does,
+// e.g. true isn't turned into 1 and 1.50 isn't turned into 1.5 by SQLite
+func fieldExpr(pg bool) string {
+	if pg {
+		return "(feeder_jsonb(t1.PayloadJSON) ->> ?)"
+	}
+
+	return `(SELECT CASE WHEN v = 'null' THEN NULL WHEN v LIKE '"%' THEN v ->> '$' ELSE v END
+		FROM (SELECT CASE WHEN json_valid(t1.PayloadJSON) THEN t1.PayloadJSON -> ? END AS v))`
+}
+
+// fieldPath returns path of payload field which fieldExpr expects
+func fieldPath(pg bool, name string) string {
+	if pg {
+		return name
+	}
+
+	return `$."` + name + `"`
+}
+
+func readNewsDetail(db *sql.DB, id int) (*NewsDetail, error) {
+	defer observeQuery(db, "get_news_detail", time.Now())
+
+	query := `
+	SELECT t1.Title, t1.PayloadJSON, COALESCE(t2.URL, '') FROM news t1
+	LEFT JOIN sources t2 ON t1.SourceID = t2.ID
+	WHERE t1.ID = ?;
+	`
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item NewsDetail
+
+		err = rows.Scan(&item.Title, &item.PayloadJSON, &item.Source)
+		if err != nil {
+			return nil, err
+		}
+
+		return &item, nil
+	}
+
+	return nil, ErrNotFound
+}
+
+func readNewsRevisions(db *sql.DB, id int) ([]*NewsRevision, error) {
+	defer observeQuery(db, "get_news_revisions", time.Now())
+
+	var current NewsRevision
+	var title, payload sql.NullString
+	var addedAt, updatedAt sql.NullTime
+
+	err := db.QueryRow(bind(db, `
+	SELECT Title, PayloadJSON, AddedAt, UpdatedAt FROM news
+	WHERE ID = ?;
+	`), id).Scan(&title, &payload, &addedAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	current.Title, current.PayloadJSON = title.String, payload.String
+	current.AddedAt = latestTime(addedAt, updatedAt).Time
+	current.Current = true
+
+	query := `
+	SELECT Revision, Title, PayloadJSON, AddedAt FROM news_revisions
+	WHERE NewsID = ?
+	ORDER BY Revision ASC
+	`
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*NewsRevision
+
+	for rows.Next() {
+		var item NewsRevision
+
+		err = rows.Scan(&item.Revision, &title, &payload, &addedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		item.Title, item.PayloadJSON, item.AddedAt = title.String, payload.String, addedAt.Time
+		result = append(result, &item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	current.Revision = len(result) + 1
+
+	return append(result, &current), nil
+}
+
+// latestTime returns updated if it's set and added otherwise
+func latestTime(added, updated sql.NullTime) sql.NullTime {
+	if updated.Valid {
+		return updated
+	}
+
+	return added
+}
+
+func readFeedSources(db *sql.DB) ([]*feeder.FeedSource, error) {
+	defer observeQuery(db, "get_feed_sources", time.Now())
+
+	query := `
+	SELECT ID, URL, Rule, Filter, "Interval", ETag, LastModified,
+		LastAttempt, LastSuccess, Failures, LastError, LastStatus, Disabled, Filtered
+	FROM sources
+	WHERE NOT Disabled AND NOT Paused
+	ORDER BY ID
+	`
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*feeder.FeedSource
+
+	for rows.Next() {
+		item := feeder.FeedSource{}
+		var ruleJSON, filter string
+		var interval int64
+		var h healthRow
+		err = rows.Scan(&item.ID, &item.URL, &ruleJSON, &filter, &interval, &item.ETag, &item.LastModified,
+			&h.lastAttempt, &h.lastSuccess, &h.failures, &h.lastError, &h.lastStatus, &h.disabled, &h.filtered)
+		if err != nil {
+			return nil, err
+		}
+
+		item.Interval = time.Duration(interval) * time.Second
+		item.Health = h.health(item.ID)
+
+		if !implementSource(&item, ruleJSON, filter) {
+			continue
+		}
+
+		result = append(result, &item)
+	}
+
+	return result, rows.Err()
+}
+
+// writeFeedSource inserts feed source with all its settings at once and returns its ID,
+// so the source is never read half-configured, e.g. not yet paused
+func writeFeedSource(db *sql.DB, s *Source) (int, error) {
+	defer observeQuery(db, "create_feed_source", time.Now())
+
+	if s == nil {
+		return 0, ErrIncorrectArgs
+	}
+
+	if err := s.Validate(); err != nil {
+		return 0, err
+	}
+
+	query := `
+	INSERT INTO sources(
+		URL,
+		Rule,
+		Filter,
+		"Interval",
+		Paused
+	) values(?, ?, ?, ?, ?)
+	RETURNING ID;
+	`
+
+	var id int
+	err := db.QueryRow(bind(db, query), s.URL, s.Rule, s.Filter, int64(s.Interval/time.Second), s.Paused).Scan(&id)
+	if isUniqueViolation(err) {
+		return 0, ErrAlreadyExists
+	}
+
+	return id, err
+}
+
+// sourceColumns are selected by readSources and scanned by scanSource
+const sourceColumns = `ID, URL, Rule, Filter, "Interval", Paused,
+	LastAttempt, LastSuccess, Failures, LastError, LastStatus, Disabled, Filtered`
+
+// rowScanner is implemented by sql.Row and sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSource(row rowScanner) (*Source, error) {
+	var item Source
+	var interval int64
+	var h healthRow
+	err := row.Scan(&item.ID, &item.URL, &item.Rule, &item.Filter, &interval, &item.Paused,
+		&h.lastAttempt, &h.lastSuccess, &h.failures, &h.lastError, &h.lastStatus, &h.disabled, &h.filtered)
+	if err != nil {
+		return nil, err
+	}
+
+	item.Interval = time.Duration(interval) * time.Second
+	item.Health = h.health(item.ID)
+
+	return &item, nil
+}
+
+// readSources returns all feed sources including paused and disabled ones
+func readSources(db *sql.DB) ([]*Source, error) {
+	defer observeQuery(db, "list_feed_sources", time.Now())
+
+	rows, err := db.Query(`SELECT ` + sourceColumns + ` FROM sources ORDER BY ID`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*Source
+
+	for rows.Next() {
+		item, err := scanSource(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, item)
+	}
+
+	return result, rows.Err()
+}
+
+func readSource(db *sql.DB, id int) (*Source, error) {
+	defer observeQuery(db, "get_feed_source", time.Now())
+
+	item, err := scanSource(db.QueryRow(bind(db, `SELECT `+sourceColumns+` FROM sources WHERE ID = ?`), id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+
+	return item, err
+}
+
+// updateFeedSource changes settings of feed source. Outdated HTTP cache validators are cleared
+func updateFeedSource(db *sql.DB, id int, u *SourceUpdate) error {
+	defer observeQuery(db, "update_feed_source", time.Now())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	item, err := scanSource(tx.QueryRow(bind(db, `SELECT `+sourceColumns+` FROM sources WHERE ID = ?`), id))
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	outdated, err := item.apply(u)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE sources SET
+		URL = ?,
+		Rule = ?,
+		Filter = ?,
+		"Interval" = ?,
+		Paused = ?,
+		Failures = ?,
+		LastError = ?,
+		Disabled = ?,
+		Filtered = ?
+	WHERE ID = ?;
+	`
+	_, err = tx.Exec(bind(db, query), item.URL, item.Rule, item.Filter, int64(item.Interval/time.Second), item.Paused,
+		item.Health.Failures, item.Health.LastError, item.Health.Disabled, item.Health.Filtered, id)
+	if isUniqueViolation(err) {
+		return ErrAlreadyExists
+	} else if err != nil {
+		return err
+	}
+
+	if outdated {
+		if _, err = tx.Exec(bind(db, `UPDATE sources SET ETag = '', LastModified = '' WHERE ID = ?`), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// deleteFeedSource deletes feed source and, if withNews is set, its news with their revisions.
+// Otherwise news are kept without source
+func deleteFeedSource(db *sql.DB, id int, withNews bool) error {
+	defer observeQuery(db, "delete_feed_source", time.Now())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(bind(db, `DELETE FROM sources WHERE ID = ?`), id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if withNews {
+		query := `DELETE FROM news_revisions WHERE NewsID IN (SELECT ID FROM news WHERE SourceID = ?)`
+		if _, err = tx.Exec(bind(db, query), id); err != nil {
+			return err
+		}
+
+		if _, err = tx.Exec(bind(db, `DELETE FROM news WHERE SourceID = ?`), id); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func writeFeedSourceCache(db *sql.DB, sourceID int, etag, lastModified string) error {
+	defer observeQuery(db, "update_feed_source_cache", time.Now())
+
+	query := `
+	UPDATE sources SET ETag = ?, LastModified = ? WHERE ID = ?;
+	`
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(etag, lastModified, sourceID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// healthRow is a feed source health as it's stored in the database
+type healthRow struct {
+	lastAttempt, lastSuccess sql.NullTime
+	failures, lastStatus     int
+	filtered                 int
+	lastError                string
+	disabled                 bool
+}
+
+func (r *healthRow) health(sourceID int) feeder.FeedSourceHealth {
+	return feeder.FeedSourceHealth{
+		SourceID:    sourceID,
+		LastAttempt: r.lastAttempt.Time,
+		LastSuccess: r.lastSuccess.Time,
+		Failures:    r.failures,
+		LastError:   r.lastError,
+		LastStatus:  r.lastStatus,
+		Disabled:    r.disabled,
+		Filtered:    r.filtered,
+	}
+}
+
+// isUniqueViolation checks whether err is caused by UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation
+}
+
+// nullTime converts zero time to NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// writeFeedSourceReading applies outcome of the reading to the stored health by one statement,
+// so failures reset and filtered items forgotten while the source was read stay so
+func writeFeedSourceReading(db *sql.DB, r *feeder.FeedSourceReading) (*feeder.FeedSourceHealth, error) {
+	defer observeQuery(db, "record_feed_source_reading", time.Now())
+
+	if r == nil {
+		return nil, ErrIncorrectArgs
+	}
+
+	query := `
+	UPDATE sources SET
+		LastAttempt = ?,
+		LastSuccess = CASE WHEN ? = '' THEN ? ELSE LastSuccess END,
+		Failures = CASE WHEN ? = '' THEN 0 ELSE Failures + 1 END,
+		LastError = ?,
+		LastStatus = ?,
+		Disabled = CASE WHEN ? <> '' AND ? > 0 AND Failures + 1 >= ? THEN TRUE ELSE Disabled END,
+		Filtered = Filtered + ?
+	WHERE ID = ?;
+	`
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	at := nullTime(r.At)
+	res, err := stmt.Exec(at, r.Error, at, r.Error, r.Error, r.Status, r.Error, r.MaxFailures, r.MaxFailures,
+		r.Filtered, r.SourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	return readFeedSourceHealth(db, r.SourceID)
+}
+
+func readFeedSourceHealth(db *sql.DB, sourceID int) (*feeder.FeedSourceHealth, error) {
+	defer observeQuery(db, "get_feed_source_health", time.Now())
+
+	query := `
+	SELECT LastAttempt, LastSuccess, Failures, LastError, LastStatus, Disabled, Filtered FROM sources
+	WHERE ID = ?;
+	`
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var h healthRow
+	err = stmt.QueryRow(sourceID).Scan(&h.lastAttempt, &h.lastSuccess, &h.failures, &h.lastError,
+		&h.lastStatus, &h.disabled, &h.filtered)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := h.health(sourceID)
+
+	return &result, nil
+}
+
+func readFeedSourcesHealth(db *sql.DB) ([]*feeder.FeedSourceHealth, error) {
+	defer observeQuery(db, "get_feed_sources_health", time.Now())
+
+	query := `
+	SELECT ID, LastAttempt, LastSuccess, Failures, LastError, LastStatus, Disabled, Filtered FROM sources
+	ORDER BY ID
+	`
+
+	stmt, err := db.Prepare(bind(db, query))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*feeder.FeedSourceHealth
+
+	for rows.Next() {
+		var id int
+		var h healthRow
+		err = rows.Scan(&id, &h.lastAttempt, &h.lastSuccess, &h.failures, &h.lastError, &h.lastStatus,
+			&h.disabled, &h.filtered)
+		if err != nil {
+			return nil, err
+		}
+
+		item := h.health(id)
+		result = append(result, &item)
+	}
+
+	return result, rows.Err()
+}
+
+// searchNewsScan searches news without full-text index by matching every news
+func searchNewsScan(db *sql.DB, query string, limit, offset int) ([]*SearchResult, error) {
+	defer observeQuery(db, "search_news", time.Now())
+
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+	SELECT t1.ID, t1.Title, t1.PayloadJSON, t2.URL FROM news t1
+	LEFT JOIN sources t2 ON t1.SourceID = t2.ID
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*SearchResult
+
+	for rows.Next() {
+		var id int
+		var title, payload, source sql.NullString
+		if err = rows.Scan(&id, &title, &payload, &source); err != nil {
+			return nil, err
+		}
+
+		if item := q.result(id, title.String, payload.String, source.String); item != nil {
+			result = append(result, item)
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sortSearchResults(result, limit, offset), nil
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// NewsRevision is a version of news. The last revision of news is its current version
+type NewsRevision struct {
+	Revision    int       `json:"Revision"`
+	Title       string    `json:"Title"`
+	PayloadJSON string    `json:"PayloadJSON"`
+	AddedAt     time.Time `json:"AddedAt"`
+	Current     bool      `json:"Current"`
+}
+
+// Kinds of payload field changes
+const (
+	FieldAdded   = "added"
+	FieldRemoved = "removed"
+	FieldChanged = "changed"
+)
+
+// FieldDiff is a change of one payload field between revisions
+type FieldDiff struct {
+	Name   string          `json:"Name"`
+	Change string          `json:"Change"`
+	Old    json.RawMessage `json:"Old,omitempty"`
+	New    json.RawMessage `json:"New,omitempty"`
+}
+
+// NewsDiff is a difference between two revisions of news
+type NewsDiff struct {
+	From     int         `json:"From"`
+	To       int         `json:"To"`
+	OldTitle string      `json:"OldTitle,omitempty"`
+	NewTitle string      `json:"NewTitle,omitempty"`
+	Fields   []FieldDiff `json:"Fields"`
+}
+
+// DiffNewsRevisions compares title and payload fields of revisions.
+// Payloads which aren't JSON objects are compared as a whole
+func DiffNewsRevisions(from, to *NewsRevision) *NewsDiff {
+	result := &NewsDiff{
+		From:   from.Revision,
+		To:     to.Revision,
+		Fields: []FieldDiff{},
+	}
+
+	if from.Title != to.Title {
+		result.OldTitle = from.Title
+		result.NewTitle = to.Title
+	}
+
+	oldFields, oldErr := payloadFields(from.PayloadJSON)
+	newFields, newErr := payloadFields(to.PayloadJSON)
+
+	if oldErr != nil || newErr != nil {
+		if from.PayloadJSON != to.PayloadJSON {
+			result.Fields = append(result.Fields, FieldDiff{
+				Name:   "",
+				Change: FieldChanged,
+				Old:    rawString(from.PayloadJSON),
+				New:    rawString(to.PayloadJSON),
+			})
+		}
+		return result
+	}
+
+	for name, oldVal := range oldFields {
+		newVal, exist := newFields[name]
+		switch {
+		case !exist:
+			result.Fields = append(result.Fields, FieldDiff{Name: name, Change: FieldRemoved, Old: oldVal})
+		case !jsonEqual(oldVal, newVal):
+			result.Fields = append(result.Fields, FieldDiff{Name: name, Change: FieldChanged, Old: oldVal, New: newVal})
+		}
+	}
+
+	for name, newVal := range newFields {
+		if _, exist := oldFields[name]; !exist {
+			result.Fields = append(result.Fields, FieldDiff{Name: name, Change: FieldAdded, New: newVal})
+		}
+	}
+
+	sort.Slice(result.Fields, func(i, j int) bool { return result.Fields[i].Name < result.Fields[j].Name })
+
+	return result
+}
+
+func payloadFields(payload string) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if payload == "" {
+		return fields, nil
+	}
+
+	err := json.Unmarshal([]byte(payload), &fields)
+
+	return fields, err
+}
+
+// jsonEqual compares JSON values ignoring formatting
+func jsonEqual(a, b json.RawMessage) bool {
+	var bufA, bufB bytes.Buffer
+	if json.Compact(&bufA, a) != nil || json.Compact(&bufB, b) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return bytes.Equal(bufA.Bytes(), bufB.Bytes())
+}
+
+func rawString(s string) json.RawMessage {
+	b, _ := json.Marshal(s)
+	return b
+}
+
+// newsHash returns hash of news content which is used to detect updated news
+func newsHash(title string, payloadJSON []byte) string {
+	h := sha256.New()
+	h.Write([]byte(title))
+	h.Write([]byte{0})
+	h.Write(payloadJSON)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
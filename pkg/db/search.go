@@ -0,0 +1,552 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Search query syntax follows SQLite FTS5. Words match whole words ignoring case,
+// "quoted words" match a phrase, a word or a phrase followed by * matches a prefix.
+// AND, OR and NOT are boolean operators, NOT binds tighter than AND and AND tighter than OR.
+// Words without an operator between them are joined by AND, parentheses group expressions
+
+// Marks of matched words in search snippets
+const (
+	HighlightStart = "<mark>"
+	HighlightEnd   = "</mark>"
+)
+
+const (
+	snippetEllipsis = "…"
+	// snippetTokens is maximum count of words in a snippet
+	snippetTokens = 16
+	// titleWeight is how much a match in title is more relevant than a match in payload
+	titleWeight = 2
+)
+
+// SearchResult is news found by full-text search. Higher rank is more relevant.
+// Snippet is a fragment of news with matched words between HighlightStart and HighlightEnd
+type SearchResult struct {
+	ID      int     `json:"ID"`
+	Title   string  `json:"Title"`
+	Source  string  `json:"Source"`
+	Snippet string  `json:"Snippet"`
+	Rank    float64 `json:"Rank"`
+}
+
+type searchKind int
+
+const (
+	searchPhrase searchKind = iota
+	searchAnd
+	searchOr
+	searchNot
+)
+
+// searchNode is a node of parsed search query. A word is a phrase of one token
+type searchNode struct {
+	kind        searchKind
+	tokens      []string
+	prefix      bool
+	left, right *searchNode
+}
+
+// searchQuery is a parsed search query
+type searchQuery struct {
+	root *searchNode
+}
+
+// parseSearchQuery parses query. It returns ErrIncorrectArgs if query is empty or has syntax errors
+func parseSearchQuery(query string) (*searchQuery, error) {
+	terms, err := lexSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%w: empty search query", ErrIncorrectArgs)
+	}
+
+	p := searchParser{terms: terms}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.terms) {
+		return nil, fmt.Errorf("%w: unexpected '%s' in search query", ErrIncorrectArgs, p.terms[p.pos].text)
+	}
+
+	return &searchQuery{root: root}, nil
+}
+
+// searchTerm is a lexeme of search query: an operator, a parenthesis or a phrase
+type searchTerm struct {
+	text     string
+	operator bool
+	tokens   []string
+	prefix   bool
+}
+
+func lexSearchQuery(query string) ([]searchTerm, error) {
+	var terms []searchTerm
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			terms = append(terms, searchTerm{text: string(r), operator: true})
+			i++
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+
+			if end == len(runes) {
+				return nil, fmt.Errorf("%w: unterminated phrase in search query", ErrIncorrectArgs)
+			}
+
+			t := searchTerm{text: string(runes[i : end+1]), tokens: searchTokens(string(runes[i+1 : end]))}
+			if len(t.tokens) == 0 {
+				return nil, fmt.Errorf("%w: empty phrase in search query", ErrIncorrectArgs)
+			}
+
+			i = end + 1
+			if i < len(runes) && runes[i] == '*' {
+				t.prefix = true
+				i++
+			}
+
+			terms = append(terms, t)
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune(`()"`, runes[end]) {
+				end++
+			}
+
+			word := string(runes[i:end])
+			i = end
+
+			t := searchTerm{text: word}
+			if strings.HasSuffix(word, "*") {
+				t.prefix = true
+				word = strings.TrimRight(word, "*")
+			}
+
+			switch {
+			case !t.prefix && (word == "AND" || word == "OR" || word == "NOT"):
+				t.operator = true
+			default:
+				// words without letters and digits, like '-', aren't indexed
+				if t.tokens = searchTokens(word); len(t.tokens) == 0 {
+					continue
+				}
+			}
+
+			terms = append(terms, t)
+		}
+	}
+
+	return terms, nil
+}
+
+type searchParser struct {
+	terms []searchTerm
+	pos   int
+}
+
+func (p *searchParser) peekOperator(op string) bool {
+	return p.pos < len(p.terms) && p.terms[p.pos].operator && p.terms[p.pos].text == op
+}
+
+// peekOperand checks whether the next term starts an operand
+func (p *searchParser) peekOperand() bool {
+	return p.pos < len(p.terms) && (!p.terms[p.pos].operator || p.terms[p.pos].text == "(")
+}
+
+func (p *searchParser) parseOr() (*searchNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekOperator("OR") {
+		p.pos++
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &searchNode{kind: searchOr, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *searchParser) parseAnd() (*searchNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekOperator("AND") || p.peekOperand() {
+		if p.peekOperator("AND") {
+			p.pos++
+		}
+
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &searchNode{kind: searchAnd, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *searchParser) parseNot() (*searchNode, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekOperator("NOT") {
+		p.pos++
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &searchNode{kind: searchNot, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *searchParser) parseOperand() (*searchNode, error) {
+	if p.pos == len(p.terms) {
+		return nil, fmt.Errorf("%w: unexpected end of search query", ErrIncorrectArgs)
+	}
+
+	t := p.terms[p.pos]
+	p.pos++
+
+	if !t.operator {
+		return &searchNode{kind: searchPhrase, tokens: t.tokens, prefix: t.prefix}, nil
+	}
+
+	if t.text != "(" {
+		return nil, fmt.Errorf("%w: unexpected '%s' in search query", ErrIncorrectArgs, t.text)
+	}
+
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.peekOperator(")") {
+		return nil, fmt.Errorf("%w: missing ')' in search query", ErrIncorrectArgs)
+	}
+	p.pos++
+
+	return n, nil
+}
+
+// fts5 returns the query in SQLite FTS5 syntax. Every phrase is quoted, so words
+// like column names or FTS5 keywords in any case can't change meaning of the query
+func (q *searchQuery) fts5() string {
+	return q.root.fts5()
+}
+
+func (n *searchNode) fts5() string {
+	switch n.kind {
+	case searchAnd:
+		return "(" + n.left.fts5() + " AND " + n.right.fts5() + ")"
+	case searchOr:
+		return "(" + n.left.fts5() + " OR " + n.right.fts5() + ")"
+	case searchNot:
+		return "(" + n.left.fts5() + " NOT " + n.right.fts5() + ")"
+	}
+
+	phrase := `"` + strings.Join(n.tokens, " ") + `"`
+	if n.prefix {
+		phrase += " *"
+	}
+
+	return phrase
+}
+
+// match returns count of matched phrases in tokens or 0 if tokens don't match the query
+func (n *searchNode) match(tokens []string) int {
+	switch n.kind {
+	case searchAnd:
+		left, right := n.left.match(tokens), n.right.match(tokens)
+		if left == 0 || right == 0 {
+			return 0
+		}
+		return left + right
+	case searchOr:
+		return n.left.match(tokens) + n.right.match(tokens)
+	case searchNot:
+		if n.right.match(tokens) > 0 {
+			return 0
+		}
+		return n.left.match(tokens)
+	}
+
+	return len(n.occurrences(tokens))
+}
+
+// occurrences returns indexes of the first tokens of the phrase occurrences
+func (n *searchNode) occurrences(tokens []string) []int {
+	var result []int
+
+	for i := 0; i+len(n.tokens) <= len(tokens); i++ {
+		matched := true
+		for j, t := range n.tokens {
+			last := j == len(n.tokens)-1
+			if tokens[i+j] != t && !(last && n.prefix && strings.HasPrefix(tokens[i+j], t)) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			result = append(result, i)
+		}
+	}
+
+	return result
+}
+
+// phrases returns phrases which are highlighted in snippets, excluded ones aren't highlighted
+func (n *searchNode) phrases() []*searchNode {
+	switch n.kind {
+	case searchAnd, searchOr:
+		return append(n.left.phrases(), n.right.phrases()...)
+	case searchNot:
+		return n.left.phrases()
+	}
+
+	return []*searchNode{n}
+}
+
+// result returns search result for news or nil if news doesn't match the query.
+// It's used by storages which have no full-text index
+func (q *searchQuery) result(id int, title, payload, source string) *SearchResult {
+	body := payloadText(payload)
+	titleTokens, bodyTokens := searchTokens(title), searchTokens(body)
+
+	// like FTS5, the whole query must match either the title, the payload or both of them
+	all := append(append([]string{}, titleTokens...), bodyTokens...)
+	if q.root.match(all) == 0 {
+		return nil
+	}
+
+	rank := titleWeight*q.root.match(titleTokens) + q.root.match(bodyTokens)
+	if rank == 0 {
+		rank = 1
+	}
+
+	snippet := q.snippet(body)
+	if snippet == "" {
+		snippet = q.snippet(title)
+	}
+
+	return &SearchResult{ID: id, Title: title, Source: source, Snippet: snippet, Rank: float64(rank)}
+}
+
+// matches checks whether the whole query matches the title, the payload or both of them
+func (q *searchQuery) matches(title, payload string) bool {
+	tokens := append(searchTokens(title), searchTokens(payloadText(payload))...)
+	return q.root.match(tokens) > 0
+}
+
+// snippet returns fragment of text around the first matched phrase or "" if text has no matches
+func (q *searchQuery) snippet(text string) string {
+	spans := tokenSpans(text)
+	tokens := make([]string, len(spans))
+	for i, s := range spans {
+		tokens[i] = s.token
+	}
+
+	marked := make([]bool, len(spans))
+	first := -1
+
+	for _, p := range q.root.phrases() {
+		for _, i := range p.occurrences(tokens) {
+			for j := i; j < i+len(p.tokens); j++ {
+				marked[j] = true
+			}
+
+			if first == -1 || i < first {
+				first = i
+			}
+		}
+	}
+
+	if first == -1 {
+		return ""
+	}
+
+	start := first - snippetTokens/4
+	if start < 0 {
+		start = 0
+	}
+
+	end := start + snippetTokens
+	if end > len(spans) {
+		end = len(spans)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString(snippetEllipsis)
+	}
+
+	for i := start; i < end; i++ {
+		if i > start {
+			b.WriteString(text[spans[i-1].end:spans[i].start])
+		}
+
+		if marked[i] && (i == start || !marked[i-1]) {
+			b.WriteString(HighlightStart)
+		}
+
+		b.WriteString(text[spans[i].start:spans[i].end])
+
+		if marked[i] && (i == end-1 || !marked[i+1]) {
+			b.WriteString(HighlightEnd)
+		}
+	}
+
+	if end < len(spans) {
+		b.WriteString(snippetEllipsis)
+	}
+
+	return b.String()
+}
+
+// sortSearchResults sorts results from the most relevant and returns the page of them
+func sortSearchResults(results []*SearchResult, limit, offset int) []*SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].ID < results[j].ID
+	})
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset >= len(results) || limit <= 0 {
+		return nil
+	}
+
+	end := offset + limit
+	if end > len(results) {
+		end = len(results)
+	}
+
+	return results[offset:end]
+}
+
+type tokenSpan struct {
+	start, end int
+	token      string
+}
+
+// tokenSpans splits text into lowercase words like FTS5 unicode61 tokenizer does
+func tokenSpans(text string) []tokenSpan {
+	var result []tokenSpan
+	start := -1
+
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.Co, r)
+
+		switch {
+		case word && start == -1:
+			start = i
+		case !word && start != -1:
+			result = append(result, tokenSpan{start: start, end: i, token: strings.ToLower(text[start:i])})
+			start = -1
+		}
+	}
+
+	if start != -1 {
+		result = append(result, tokenSpan{start: start, end: len(text), token: strings.ToLower(text[start:])})
+	}
+
+	return result
+}
+
+func searchTokens(text string) []string {
+	spans := tokenSpans(text)
+	result := make([]string, len(spans))
+	for i, s := range spans {
+		result[i] = s.token
+	}
+
+	return result
+}
+
+// payloadText returns string values of JSON payload joined by spaces.
+// Payload which isn't JSON is returned as is
+func payloadText(payload string) string {
+	if !json.Valid([]byte(payload)) {
+		return payload
+	}
+
+	var parts []string
+	dec := json.NewDecoder(strings.NewReader(payload))
+	if err := collectText(dec, &parts); err != nil {
+		return payload
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func collectText(dec *json.Decoder, parts *[]string) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch v := t.(type) {
+	case string:
+		*parts = append(*parts, v)
+	case json.Delim:
+		object := v == '{'
+		for dec.More() {
+			if object {
+				// skip key
+				if _, err = dec.Token(); err != nil {
+					return err
+				}
+			}
+
+			if err = collectText(dec, parts); err != nil {
+				return err
+			}
+		}
+
+		// closing delimiter
+		_, err = dec.Token()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{name: "word", in: "Go", want: `"go"`},
+		{name: "implicit and", in: "go router", want: `("go" AND "router")`},
+		{name: "prefix", in: "rout*", want: `"rout" *`},
+		{name: "phrase", in: `"HTTP router"`, want: `"http router"`},
+		{name: "phrase prefix", in: `"http rout"*`, want: `"http rout" *`},
+		{name: "word with punctuation is a phrase", in: "go-style", want: `"go style"`},
+		{name: "words without letters are skipped", in: "go - router", want: `("go" AND "router")`},
+		{name: "lowercase operators are words", in: "go or not", want: `(("go" AND "or") AND "not")`},
+		{name: "column filter is a word", in: "title:go", want: `"title go"`},
+		{
+			name: "precedence",
+			in:   "a OR b AND c NOT d",
+			want: `("a" OR ("b" AND ("c" NOT "d")))`,
+		},
+		{name: "parentheses", in: "(a OR b) c", want: `(("a" OR "b") AND "c")`},
+		{name: "empty", in: "  ", wantErr: true},
+		{name: "only punctuation", in: "- +", wantErr: true},
+		{name: "leading operator", in: "NOT go", wantErr: true},
+		{name: "trailing operator", in: "go OR", wantErr: true},
+		{name: "unterminated phrase", in: `"go router`, wantErr: true},
+		{name: "empty phrase", in: `go ""`, wantErr: true},
+		{name: "missing parenthesis", in: "(go OR rust", wantErr: true},
+		{name: "extra parenthesis", in: "go)", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseSearchQuery(tt.in)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrIncorrectArgs)
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, q.fts5())
+			}
+		})
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	q, err := parseSearchQuery(`"new router" OR go NOT python`)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	text := "One two three four five six seven eight Go has a new router, and a long tail of words after it here"
+	assert.Equal(t, "…five six seven eight <mark>Go</mark> has a <mark>new router</mark>, and a long tail of words after…",
+		q.snippet(text))
+
+	assert.Equal(t, "", q.snippet("nothing here"))
+}
+
+func TestPayloadText(t *testing.T) {
+	assert.Equal(t, "Title Body Name", payloadText(`{"title":"Title","n":1,"body":["Body",{"name":"Name"}]}`))
+	assert.Equal(t, "not json", payloadText("not json"))
+}
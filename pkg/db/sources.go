@@ -0,0 +1,157 @@
+package db
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/feeder"
+)
+
+// Source is a feed source with its settings and state of readings
+type Source struct {
+	ID   int
+	URL  string
+	Rule string
+	// Filter decides which feed items are saved, see feeder.ImplementFilter
+	Filter string
+	// Interval is a period between readings. Zero means the feed's own hint or the default period
+	Interval time.Duration
+	// Paused sources aren't read until they are resumed
+	Paused bool
+	Health feeder.FeedSourceHealth
+}
+
+// SourceUpdate is a change of feed source settings. Nil fields aren't changed
+type SourceUpdate struct {
+	URL      *string
+	Rule     *string
+	Filter   *string
+	Interval *time.Duration
+	Paused   *bool
+}
+
+// FieldError is an incorrect setting of feed source. Expr is the incorrect field of rule
+// or condition of filter, it's empty if the whole setting is incorrect
+type FieldError struct {
+	Field   string
+	Expr    string
+	Message string
+}
+
+// ValidationError lists incorrect settings of feed source. It matches ErrIncorrectArgs
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, f := range e.Errors {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+
+	return fmt.Sprintf("%s: %s", ErrIncorrectArgs, strings.Join(msgs, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrIncorrectArgs
+}
+
+// Validate checks settings of the source, rule and filter are checked against their grammar.
+// It returns *ValidationError with every incorrect setting
+func (s *Source) Validate() error {
+	return validateSource(s.URL, s.Rule, s.Filter, s.Interval)
+}
+
+// validateSource checks settings of feed source
+func validateSource(u, rule, filter string, interval time.Duration) error {
+	var errs []FieldError
+
+	if _, err := url.ParseRequestURI(u); err != nil {
+		errs = append(errs, FieldError{Field: "URL", Message: fmt.Sprintf("incorrect URL '%s'", u)})
+	}
+
+	for _, e := range feeder.ValidateRule(rule) {
+		errs = append(errs, FieldError{Field: "Rule", Expr: e.Expr, Message: e.Error()})
+	}
+
+	for _, e := range feeder.ValidateFilter(filter) {
+		errs = append(errs, FieldError{Field: "Filter", Expr: e.Expr, Message: e.Error()})
+	}
+
+	if interval < 0 {
+		errs = append(errs, FieldError{Field: "Interval", Message: "interval must not be negative"})
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+
+	return nil
+}
+
+// implementSource parses rule and filter of feed source. Source with incorrect ones, e.g. saved
+// before they were validated, is skipped with a message, so it doesn't stop other sources from reading
+func implementSource(s *feeder.FeedSource, rule, filter string) bool {
+	err := feeder.ImplementRule(s, rule)
+	if err == nil {
+		err = feeder.ImplementFilter(s, filter)
+	}
+
+	if err != nil {
+		fmt.Printf("Feed source %d '%s' is skipped: %s\n", s.ID, s.URL, err)
+		return false
+	}
+
+	return true
+}
+
+// apply changes settings of the source and returns whether its HTTP cache validators
+// are outdated. Failures of the source are forgotten if its URL or rule is changed or it's resumed,
+// so resumed source is read even if it was disabled after failures. Count of filtered items is
+// forgotten if the filter is changed, and the feed is read again in full by the new filter
+func (s *Source) apply(u *SourceUpdate) (bool, error) {
+	if u == nil {
+		return false, ErrIncorrectArgs
+	}
+
+	changed := false
+
+	if u.URL != nil && *u.URL != s.URL {
+		s.URL = *u.URL
+		changed = true
+	}
+
+	if u.Rule != nil && *u.Rule != s.Rule {
+		s.Rule = *u.Rule
+		changed = true
+	}
+
+	filtered := false
+	if u.Filter != nil && *u.Filter != s.Filter {
+		s.Filter = *u.Filter
+		s.Health.Filtered = 0
+		filtered = true
+	}
+
+	if u.Interval != nil {
+		s.Interval = *u.Interval / time.Second * time.Second
+	}
+
+	resumed := false
+	if u.Paused != nil {
+		resumed = !*u.Paused && (s.Paused || s.Health.Disabled)
+		s.Paused = *u.Paused
+	}
+
+	if err := s.Validate(); err != nil {
+		return false, err
+	}
+
+	if changed || resumed {
+		s.Health.Failures, s.Health.LastError, s.Health.Disabled = 0, "", false
+	}
+
+	return changed || filtered, nil
+}
@@ -3,8 +3,9 @@ package db
 import (
 	"database/sql"
 	"errors"
-	"net/url"
+	"fmt"
 	"sync"
+	"time"
 
 	"github.com/bsbsm/feeder/pkg/feeder"
 	_ "github.com/mattn/go-sqlite3"
@@ -12,18 +13,24 @@ import (
 
 var ErrNotFound = errors.New("Not found")
 var ErrIncorrectArgs = errors.New("Incorrect arguments")
+var ErrAlreadyExists = feeder.ErrAlreadyExists
 
 type SQLiteDatabase struct {
 }
 
 // GetNews returns specific news count from database
 func (s *SQLiteDatabase) GetNews(offset int, count int) ([]*News, error) {
-	return readNews(getDb(), count, offset)
+	return readNewsQuery(getDb(), &NewsQuery{Offset: offset, Count: count})
 }
 
 // GetNewsWithTitle returns specific news count from database
 func (s *SQLiteDatabase) GetNewsWithTitle(title string, offset int, count int) ([]*News, error) {
-	return readNewsWithTitle(getDb(), title, count, offset)
+	return readNewsQuery(getDb(), &NewsQuery{Title: title, Offset: offset, Count: count})
+}
+
+// QueryNews returns news selected by the query
+func (s *SQLiteDatabase) QueryNews(q *NewsQuery) ([]*News, error) {
+	return readNewsQuery(getDb(), q)
 }
 
 // GetNewsDetail returns detail for news
@@ -31,9 +38,32 @@ func (s *SQLiteDatabase) GetNewsDetail(id int) (*NewsDetail, error) {
 	return readNewsDetail(getDb(), id)
 }
 
-// CreateNews insert news to database and return errors if need
-func (s *SQLiteDatabase) CreateNews(sourceID int, title string, payloadJSON []byte) error {
-	return writeNews(getDb(), sourceID, title, payloadJSON)
+// CreateNews insert news to database or updates it if the source already has news with the GUID
+// and different content. Returns ID of news and whether it was updated.
+// Returns ErrAlreadyExists if the source already has the same news
+func (s *SQLiteDatabase) CreateNews(sourceID int, guid, title string, payloadJSON []byte, published time.Time) (int, bool, error) {
+	return writeNews(getDb(), sourceID, guid, title, payloadJSON, published)
+}
+
+// SearchNews returns news matching full-text search query from the most relevant.
+// It uses FTS5 index if SQLite supports it and scans all news otherwise
+func (s *SQLiteDatabase) SearchNews(query string, offset int, count int) ([]*SearchResult, error) {
+	db := getDb()
+	if !searchIndexEnabled {
+		return searchNewsScan(db, query, count, offset)
+	}
+
+	q, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return searchNewsIndex(db, q, count, offset)
+}
+
+// GetNewsRevisions returns all versions of news from the oldest to the current one
+func (s *SQLiteDatabase) GetNewsRevisions(id int) ([]*NewsRevision, error) {
+	return readNewsRevisions(getDb(), id)
 }
 
 // GetFeedSources returns all feed sources
@@ -41,278 +71,184 @@ func (s *SQLiteDatabase) GetFeedSources() ([]*feeder.FeedSource, error) {
 	return readFeedSources(getDb())
 }
 
-// CreateFeedSource insert new feed source to database and return errors if need
-func (s *SQLiteDatabase) CreateFeedSource(url, rule string) error {
-	return writeFeedSource(getDb(), url, rule)
+// UpdateFeedSourceCache saves HTTP cache validators of the last feed response
+func (s *SQLiteDatabase) UpdateFeedSourceCache(sourceID int, etag, lastModified string) error {
+	return writeFeedSourceCache(getDb(), sourceID, etag, lastModified)
 }
 
-type News struct {
-	Title  string `json:"Title"`
-	Source string `json:"Source"`
-	ID     int    `json:"ID"`
+// RecordFeedSourceReading applies outcome of the reading to the stored health of the source
+// and returns the resulting health
+func (s *SQLiteDatabase) RecordFeedSourceReading(r *feeder.FeedSourceReading) (*feeder.FeedSourceHealth, error) {
+	return writeFeedSourceReading(getDb(), r)
 }
 
-type NewsDetail struct {
-	Title       string `json:"Title"`
-	PayloadJSON string `json:"PayloadJSON"`
-	Source      string `json:"Source"`
+// GetFeedSourceHealth returns state of feed source readings
+func (s *SQLiteDatabase) GetFeedSourceHealth(sourceID int) (*feeder.FeedSourceHealth, error) {
+	return readFeedSourceHealth(getDb(), sourceID)
 }
 
-// getDb returns database connection pool
-func getDb() *sql.DB {
-	if databaseInstance != nil {
-		return databaseInstance
-	}
-
-	dbMut.Lock()
-	if databaseInstance == nil {
-		databaseInstance = initDB()
-	}
-	dbMut.Unlock()
-
-	return databaseInstance
+// GetFeedSourcesHealth returns states of all feed sources readings including disabled sources
+func (s *SQLiteDatabase) GetFeedSourcesHealth() ([]*feeder.FeedSourceHealth, error) {
+	return readFeedSourcesHealth(getDb())
 }
 
-var (
-	dbMut            sync.Mutex
-	databaseInstance *sql.DB
-)
-
-var databaseFilePath = "./local.db"
+// CreateFeedSource saves feed source with its rule, filter, interval and paused state and returns its ID.
+// Zero interval means the source is read with the feed's own hint or the default period
+func (s *SQLiteDatabase) CreateFeedSource(src *Source) (int, error) {
+	return writeFeedSource(getDb(), src)
+}
 
-// initDB prepare database before using
-func initDB() *sql.DB {
-	//os.Remove(databaseFilePath)
+// ListFeedSources returns all feed sources including paused and disabled ones
+func (s *SQLiteDatabase) ListFeedSources() ([]*Source, error) {
+	return readSources(getDb())
+}
 
-	db, err := sql.Open("sqlite3", databaseFilePath)
-	if err != nil {
-		panic(err)
-	}
-	if db == nil {
-		panic("db is nil")
-	}
-	err = createTables(db)
+// GetFeedSource returns feed source by ID
+func (s *SQLiteDatabase) GetFeedSource(id int) (*Source, error) {
+	return readSource(getDb(), id)
+}
 
-	if err != nil {
-		db.Close()
-		db = nil
-		panic(err)
-	}
+// UpdateFeedSource changes settings of feed source
+func (s *SQLiteDatabase) UpdateFeedSource(id int, u *SourceUpdate) error {
+	return updateFeedSource(getDb(), id, u)
+}
 
-	return db
+// DeleteFeedSource deletes feed source. News of the source are deleted if withNews is set
+func (s *SQLiteDatabase) DeleteFeedSource(id int, withNews bool) error {
+	return deleteFeedSource(getDb(), id, withNews)
 }
 
-// createTable creates needed tables if its not exist
-func createTables(db *sql.DB) error {
-	query := `
-	CREATE TABLE IF NOT EXISTS news(
-		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-		Title TEXT UNIQUE,
-		PayloadJSON TEXT,
-		SourceID INTEGER NOT NULL,
-		AddedAt DATETIME DEFAULT CURRENT_TIMESTAMP
-	);
-	CREATE TABLE IF NOT EXISTS sources(
-		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
-		URL TEXT NOT NULL UNIQUE,
-		Rule TEXT NOT NULL
-	);
-	`
-	_, err := db.Exec(query)
+// CreateWebhook saves webhook and returns its ID
+func (s *SQLiteDatabase) CreateWebhook(w *Webhook) (int, error) {
+	return writeWebhook(getDb(), w)
+}
 
-	return err
+// ListWebhooks returns all webhooks
+func (s *SQLiteDatabase) ListWebhooks() ([]*Webhook, error) {
+	return readWebhooks(getDb())
 }
 
-func writeNews(db *sql.DB, sourceID int, title string, payloadJSON []byte) error {
-	if title == "" && len(payloadJSON) == 0 {
-		return ErrIncorrectArgs
-	}
+// GetWebhook returns webhook by ID
+func (s *SQLiteDatabase) GetWebhook(id int) (*Webhook, error) {
+	return readWebhook(getDb(), id)
+}
 
-	query := `
-	INSERT INTO news(
-		Title,
-		PayloadJSON,
-		SourceID
-	) values(?, ?, ?);
-	`
+// DeleteWebhook deletes webhook with its delivery log
+func (s *SQLiteDatabase) DeleteWebhook(id int) error {
+	return deleteWebhook(getDb(), id)
+}
 
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return err
-	}
-	defer stmt.Close()
+// AddWebhookDelivery saves attempt to deliver news to webhook
+func (s *SQLiteDatabase) AddWebhookDelivery(d *WebhookDelivery) error {
+	return writeWebhookDelivery(getDb(), d)
+}
 
-	_, err = stmt.Exec(title, payloadJSON, sourceID)
-	if err != nil {
-		return err
-	}
+// GetWebhookDeliveries returns delivery log of webhook, the latest attempts go first
+func (s *SQLiteDatabase) GetWebhookDeliveries(webhookID int, offset, count int) ([]*WebhookDelivery, error) {
+	return readWebhookDeliveries(getDb(), webhookID, offset, count)
+}
 
-	return nil
+type News struct {
+	Title       string     `json:"Title"`
+	Source      string     `json:"Source"`
+	ID          int        `json:"ID"`
+	AddedAt     time.Time  `json:"AddedAt"`
+	PublishedAt *time.Time `json:"PublishedAt,omitempty"`
+	// PayloadJSON is filled if it's requested by NewsQuery.WithPayload
+	PayloadJSON string `json:"PayloadJSON,omitempty"`
 }
 
-func readNews(db *sql.DB, limit, offset int) ([]*News, error) {
-	query := `
-	SELECT t1.ID, t1.Title, t2.URL FROM news t1
-	LEFT JOIN sources t2 ON t1.SourceID = t2.ID
-	ORDER BY t1.AddedAt ASC
-	LIMIT ? OFFSET ?
-	`
+type NewsDetail struct {
+	Title       string `json:"Title"`
+	PayloadJSON string `json:"PayloadJSON"`
+	Source      string `json:"Source"`
+}
 
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return nil, err
-	}
-	defer stmt.Close()
+// Close closes database connection pool. The next call of any method opens it again
+func (s *SQLiteDatabase) Close() error {
+	dbMut.Lock()
+	defer dbMut.Unlock()
 
-	rows, err := stmt.Query(limit, offset)
-	if err != nil {
-		return nil, err
+	if databaseInstance == nil {
+		return nil
 	}
-	defer rows.Close()
 
-	var result []*News
+	err := databaseInstance.Close()
+	databaseInstance = nil
 
-	for rows.Next() {
-		var item News
-		err = rows.Scan(&item.ID, &item.Title, &item.Source)
-		if err != nil {
-			return nil, err
-		}
-
-		result = append(result, &item)
-	}
-
-	return result, nil
+	return err
 }
 
-func readNewsWithTitle(db *sql.DB, title string, limit, offset int) ([]*News, error) {
-	query := `
-	SELECT t1.ID, t1.Title, t2.URL FROM news t1
-	LEFT JOIN sources t2 ON t1.SourceID = t2.ID
-	WHERE t1.Title like ?
-	ORDER BY t1.AddedAt ASC
-	LIMIT ? OFFSET ?
-	`
+// Migrate applies pending schema migrations and returns their versions.
+// Migrations are also applied automatically when database is opened
+func (s *SQLiteDatabase) Migrate() ([]int, error) {
+	dbMut.Lock()
+	defer dbMut.Unlock()
 
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return nil, err
+	if databaseInstance != nil {
+		return migrate(databaseInstance, migrations, nil)
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query("%"+title+"%", limit, offset)
+	db, err := sql.Open("sqlite3", databaseFilePath)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
+	defer db.Close()
 
-	var result []*News
-
-	for rows.Next() {
-		var item News
-		err = rows.Scan(&item.ID, &item.Title, &item.Source)
-		if err != nil {
-			return nil, err
-		}
-
-		result = append(result, &item)
-	}
-
-	return result, nil
+	return migrate(db, migrations, nil)
 }
 
-func readNewsDetail(db *sql.DB, id int) (*NewsDetail, error) {
-	query := `
-	SELECT t1.Title, t1.PayloadJSON, t2.URL FROM news t1
-	LEFT JOIN sources t2 ON t1.SourceID = t2.ID
-	WHERE t1.ID = ?;
-	`
-
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return nil, err
+// getDb returns database connection pool
+func getDb() *sql.DB {
+	if databaseInstance != nil {
+		return databaseInstance
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query(id)
-	if err != nil {
-		return nil, err
+	dbMut.Lock()
+	if databaseInstance == nil {
+		databaseInstance = initDB()
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var item NewsDetail
+	dbMut.Unlock()
 
-		err = rows.Scan(&item.Title, &item.PayloadJSON, &item.Source)
-		if err != nil {
-			return nil, err
-		}
+	return databaseInstance
+}
 
-		return &item, nil
-	}
+var (
+	dbMut            sync.Mutex
+	databaseInstance *sql.DB
+	// searchIndexEnabled is set when database is opened
+	searchIndexEnabled bool
+)
 
-	return nil, ErrNotFound
-}
+var databaseFilePath = "./local.db"
 
-func readFeedSources(db *sql.DB) ([]*feeder.FeedSource, error) {
-	query := `
-	SELECT ID, URL, Rule FROM sources
-	`
+// initDB prepare database before using
+func initDB() *sql.DB {
+	//os.Remove(databaseFilePath)
 
-	stmt, err := db.Prepare(query)
+	db, err := sql.Open("sqlite3", databaseFilePath)
 	if err != nil {
-		return nil, err
+		panic(err)
 	}
-	defer stmt.Close()
-
-	rows, err := stmt.Query()
-	if err != nil {
-		return nil, err
+	if db == nil {
+		panic("db is nil")
 	}
-	defer rows.Close()
-
-	var result []*feeder.FeedSource
-
-	for rows.Next() {
-		item := feeder.FeedSource{}
-		var ruleJSON string
-		err = rows.Scan(&item.ID, &item.URL, &ruleJSON)
-		if err != nil {
-			return nil, err
-		}
+	// SQLite allows only one writer at a time, concurrent transactions would fail as busy
+	db.SetMaxOpenConns(1)
 
-		if err = feeder.ImplementRule(&item, ruleJSON); err != nil {
-			return nil, err
+	_, err = migrate(db, migrations, nil)
+	if err == nil {
+		searchIndexEnabled, err = syncSearchIndex(db)
+		if err == nil && !searchIndexEnabled {
+			fmt.Println("Full-text index isn't available, SQLite is built without FTS5 and search scans all news, build with -tags sqlite_fts5")
 		}
-
-		result = append(result, &item)
-	}
-
-	return result, nil
-}
-
-func writeFeedSource(db *sql.DB, u string, rule string) error {
-	if _, err := url.ParseRequestURI(u); err != nil || rule == "" {
-		return ErrIncorrectArgs
-	}
-
-	query := `
-	INSERT INTO sources(
-		URL,
-		Rule
-	) values(?, ?);
-	`
-
-	stmt, err := db.Prepare(query)
-	if err != nil {
-		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(u, rule)
 	if err != nil {
-		return err
+		db.Close()
+		db = nil
+		panic(err)
 	}
 
-	return nil
+	return db
 }
@@ -2,10 +2,12 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/bsbsm/feeder/pkg/feeder"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -21,20 +23,23 @@ func prepareDbForRead(t *testing.T) {
 
 	query := `
 	INSERT INTO news(
+		GUID,
 		Title,
 		SourceID,
 		PayloadJSON
-	) values('NewTitle1', 1, "json");
+	) values('guid1', 'NewTitle1', 1, "json");
 	INSERT INTO news(
+		GUID,
 		Title,
 		SourceID,
 		PayloadJSON
-	) values('NewTitle2', 2, "json");
+	) values('guid2', 'NewTitle2', 2, "json");
 	INSERT INTO news(
+		GUID,
 		Title,
 		SourceID,
 		PayloadJSON
-	) values('NewTitle3', 3, "json");
+	) values('guid3', 'NewTitle3', 3, "json");
 	INSERT INTO sources(
 		URL,
 		Rule
@@ -301,6 +306,22 @@ func TestGetFeedSource(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "source with incorrect rule is skipped",
+			prepare: func(t *testing.T) {
+				prepareDbForRead(t)
+
+				query := `
+				INSERT INTO sources(URL, Rule) values('brokenrule', 'title[');
+				INSERT INTO sources(URL, Rule, Filter) values('brokenfilter', 'title', 'title like go');
+				`
+				if _, err := getDb().Exec(query); err != nil {
+					t.Error(err)
+				}
+			},
+			wantLen: 3,
+			wantErr: false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -333,20 +354,30 @@ func TestCreateNews(t *testing.T) {
 
 	type args struct {
 		sourceID    int
+		guid        string
 		title       string
 		payloadJSON []byte
 	}
 
+	countNews := func(t *testing.T, want int) {
+		var c int
+		err := getDb().QueryRow(`SELECT count(*) FROM news`).Scan(&c)
+		if err != nil || c != want {
+			t.Errorf("Expect %v but return %v OR err: %s", want, c, err)
+		}
+	}
+
 	tests := []struct {
 		name       string
 		in         args
+		prepare    func(t *testing.T)
 		inspect    func(t *testing.T) //inspects database after execution of CreateNews
 		wantErr    bool
 		inspectErr func(err error, t *testing.T)
 	}{
 		{
 			name:    "success adding",
-			in:      args{1, "News title", []byte("{\"id\":11,\"title\":\"News title\",\"body\":\"News body\"}")},
+			in:      args{1, "guid", "News title", []byte("{\"id\":11,\"title\":\"News title\",\"body\":\"News body\"}")},
 			wantErr: false,
 			inspect: func(t *testing.T) {
 				db := getDb()
@@ -366,7 +397,7 @@ func TestCreateNews(t *testing.T) {
 		},
 		{
 			name:    "failed adding",
-			in:      args{1, "", nil},
+			in:      args{1, "guid", "", nil},
 			wantErr: true,
 			inspectErr: func(err error, t *testing.T) {
 				assert.Equal(t, err, ErrIncorrectArgs, "SQLiteDatabase.CreateNews returned unexpected error")
@@ -387,15 +418,44 @@ func TestCreateNews(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:    "without guid",
+			in:      args{1, "", "News title", []byte("{}")},
+			wantErr: true,
+			inspectErr: func(err error, t *testing.T) {
+				assert.Equal(t, err, ErrIncorrectArgs, "SQLiteDatabase.CreateNews returned unexpected error")
+			},
+			inspect: func(t *testing.T) { countNews(t, 0) },
+		},
+		{
+			name:    "duplicate guid in the same source",
+			in:      args{1, "guid1", "NewTitle1", []byte("json")},
+			prepare: prepareDbForRead,
+			wantErr: true,
+			inspectErr: func(err error, t *testing.T) {
+				assert.Equal(t, err, ErrAlreadyExists, "SQLiteDatabase.CreateNews returned unexpected error")
+			},
+			inspect: func(t *testing.T) { countNews(t, 3) },
+		},
+		{
+			name:    "same guid and title in another source",
+			in:      args{2, "guid1", "NewTitle1", []byte("{}")},
+			prepare: prepareDbForRead,
+			inspect: func(t *testing.T) { countNews(t, 4) },
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			defer time.Sleep(time.Millisecond)
 
-			prepareDatabase()
+			if tt.prepare != nil {
+				tt.prepare(t)
+			} else {
+				prepareDatabase()
+			}
 
-			err := sqlite.CreateNews(tt.in.sourceID, tt.in.title, tt.in.payloadJSON)
+			_, _, err := sqlite.CreateNews(tt.in.sourceID, tt.in.guid, tt.in.title, tt.in.payloadJSON, time.Time{})
 
 			if tt.wantErr {
 				if assert.Error(t, err) && tt.inspectErr != nil {
@@ -416,8 +476,9 @@ func TestCreateFeedSource(t *testing.T) {
 	sqlite := SQLiteDatabase{}
 
 	type args struct {
-		url  string
-		rule string
+		url      string
+		rule     string
+		interval time.Duration
 	}
 
 	tests := []struct {
@@ -429,7 +490,7 @@ func TestCreateFeedSource(t *testing.T) {
 	}{
 		{
 			name:    "success adding",
-			in:      args{url: "https://www.netroby.com/rss", rule: "Title=NewTitle"},
+			in:      args{url: "https://www.netroby.com/rss", rule: "Title=NewTitle", interval: time.Minute},
 			wantErr: false,
 			inspect: func(t *testing.T) {
 				db := getDb()
@@ -445,6 +506,11 @@ func TestCreateFeedSource(t *testing.T) {
 				if err != nil || c < 1 {
 					t.Errorf("Expect 1 but return 0. Err: %s", err)
 				}
+
+				sources, err := readFeedSources(db)
+				if assert.NoError(t, err) && assert.Len(t, sources, 1) {
+					assert.Equal(t, time.Minute, sources[0].Interval, "SQLiteDatabase.CreateFeedSource saved unexpected interval")
+				}
 			},
 		},
 		{
@@ -452,7 +518,7 @@ func TestCreateFeedSource(t *testing.T) {
 			in:      args{url: "https", rule: ""},
 			wantErr: true,
 			inspectErr: func(err error, t *testing.T) {
-				assert.Equal(t, err, ErrIncorrectArgs, "SQLiteDatabase.CreateFeedSource returned unexpected error")
+				assert.ErrorIs(t, err, ErrIncorrectArgs, "SQLiteDatabase.CreateFeedSource returned unexpected error")
 			},
 			inspect: func(t *testing.T) {
 				db := getDb()
@@ -478,7 +544,7 @@ func TestCreateFeedSource(t *testing.T) {
 
 			prepareDatabase()
 
-			err := sqlite.CreateFeedSource(tt.in.url, tt.in.rule)
+			_, err := sqlite.CreateFeedSource(&Source{URL: tt.in.url, Rule: tt.in.rule, Interval: tt.in.interval})
 
 			if tt.wantErr {
 				if assert.Error(t, err) && tt.inspectErr != nil {
@@ -494,3 +560,400 @@ func TestCreateFeedSource(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateFeedSourceCache(t *testing.T) {
+	sqlite := SQLiteDatabase{}
+
+	tests := []struct {
+		name       string
+		in         int
+		wantErr    bool
+		inspectErr func(err error, t *testing.T)
+	}{
+		{
+			name:    "success updating",
+			in:      2,
+			wantErr: false,
+		},
+		{
+			name:    "not found",
+			in:      5,
+			wantErr: true,
+			inspectErr: func(err error, t *testing.T) {
+				assert.Equal(t, err, ErrNotFound, "SQLiteDatabase.UpdateFeedSourceCache returned unexpected error")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer time.Sleep(time.Millisecond)
+
+			prepareDbForRead(t)
+
+			err := sqlite.UpdateFeedSourceCache(tt.in, `"etag"`, "Mon, 02 Jan 2006 15:04:05 GMT")
+
+			if tt.wantErr {
+				if assert.Error(t, err) && tt.inspectErr != nil {
+					tt.inspectErr(err, t)
+				}
+				return
+			}
+
+			assert.NoError(t, err)
+
+			sources, err := sqlite.GetFeedSources()
+			assert.NoError(t, err)
+
+			for _, s := range sources {
+				if s.ID == tt.in {
+					assert.Equal(t, `"etag"`, s.ETag)
+					assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", s.LastModified)
+				} else {
+					assert.Empty(t, s.ETag)
+				}
+			}
+		})
+	}
+}
+
+func TestFeedSourceHealth(t *testing.T) {
+	sqlite := SQLiteDatabase{}
+	prepareDbForRead(t)
+
+	attempt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		in         *feeder.FeedSourceReading
+		want       *feeder.FeedSourceHealth
+		wantErr    bool
+		inspectErr func(err error, t *testing.T)
+	}{
+		{
+			name: "failed reading",
+			in:   &feeder.FeedSourceReading{SourceID: 1, At: attempt, Error: "timeout", MaxFailures: 10},
+			want: &feeder.FeedSourceHealth{
+				SourceID:    1,
+				LastAttempt: attempt,
+				Failures:    1,
+				LastError:   "timeout",
+			},
+		},
+		{
+			name: "disabled",
+			in: &feeder.FeedSourceReading{SourceID: 2, At: attempt, Status: 404,
+				Error: "Unexpected HTTP status 404 Not Found", Filtered: 2, MaxFailures: 1},
+			want: &feeder.FeedSourceHealth{
+				SourceID:    2,
+				LastAttempt: attempt,
+				Failures:    1,
+				LastError:   "Unexpected HTTP status 404 Not Found",
+				LastStatus:  404,
+				Disabled:    true,
+				Filtered:    2,
+			},
+		},
+		{
+			name:    "not found",
+			in:      &feeder.FeedSourceReading{SourceID: 5},
+			wantErr: true,
+			inspectErr: func(err error, t *testing.T) {
+				assert.Equal(t, err, ErrNotFound, "SQLiteDatabase.RecordFeedSourceReading returned unexpected error")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer time.Sleep(time.Millisecond)
+
+			_, err := sqlite.RecordFeedSourceReading(tt.in)
+
+			if tt.wantErr {
+				if assert.Error(t, err) && tt.inspectErr != nil {
+					tt.inspectErr(err, t)
+				}
+				return
+			}
+
+			assert.NoError(t, err)
+
+			res, err := sqlite.GetFeedSourceHealth(tt.in.SourceID)
+			if assert.NoError(t, err) {
+				assert.True(t, tt.want.LastAttempt.Equal(res.LastAttempt))
+				assert.True(t, tt.want.LastSuccess.Equal(res.LastSuccess))
+				res.LastAttempt, res.LastSuccess = tt.want.LastAttempt, tt.want.LastSuccess
+				assert.Equal(t, tt.want, res, "SQLiteDatabase.GetFeedSourceHealth returned unexpected health")
+			}
+		})
+	}
+
+	all, err := sqlite.GetFeedSourcesHealth()
+	assert.NoError(t, err)
+	assert.Len(t, all, 3, "SQLiteDatabase.GetFeedSourcesHealth should return disabled sources too")
+
+	sources, err := sqlite.GetFeedSources()
+	assert.NoError(t, err)
+	assert.Len(t, sources, 2, "SQLiteDatabase.GetFeedSources shouldn't return disabled sources")
+}
+
+func TestMigrateNewsIdentity(t *testing.T) {
+	databaseFilePath = "./test.db"
+	os.Remove(databaseFilePath)
+	databaseInstance = nil
+
+	db, err := sql.Open("sqlite3", databaseFilePath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Close()
+
+	query := `
+	CREATE TABLE news(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		Title TEXT UNIQUE,
+		PayloadJSON TEXT,
+		SourceID INTEGER NOT NULL,
+		AddedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO news(Title, SourceID, PayloadJSON) values('OldTitle', 1, "json");
+	`
+	if _, err = db.Exec(query); !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = migrate(db, migrations, nil)
+	assert.NoError(t, err)
+
+	var guid, title string
+	err = db.QueryRow(`SELECT GUID, Title FROM news WHERE ID = 1`).Scan(&guid, &title)
+	assert.NoError(t, err)
+	assert.Equal(t, "OldTitle", guid, "migrated news should be identified by its title")
+	assert.Equal(t, "OldTitle", title)
+
+	_, _, err = writeNews(db, 2, "guid", "OldTitle", []byte("{}"), time.Time{})
+	assert.NoError(t, err, "titles should be unique only within a source")
+}
+
+func TestMigrateLegacyNewsIdentity(t *testing.T) {
+	databaseFilePath = "./test.db"
+	os.Remove(databaseFilePath)
+	databaseInstance = nil
+
+	db, err := sql.Open("sqlite3", databaseFilePath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// schema and data of the versions before migrations
+	query := `
+	CREATE TABLE news(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		Title TEXT UNIQUE,
+		PayloadJSON TEXT,
+		SourceID INTEGER NOT NULL,
+		AddedAt DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE sources(
+		ID INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		URL TEXT NOT NULL UNIQUE,
+		Rule TEXT NOT NULL
+	);
+	INSERT INTO sources(URL, Rule) values('http://feed', 'title');
+	INSERT INTO news(Title, SourceID, PayloadJSON) values('Old news', 1, '{"title":"Old news"}');
+	INSERT INTO news(Title, SourceID, PayloadJSON) values('Changed news', 1, '{"title":"Changed news"}');
+	`
+	_, err = db.Exec(query)
+	db.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sqlite := SQLiteDatabase{}
+	_, err = sqlite.Migrate()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	id, _, err := sqlite.CreateNews(1, "http://feed/old", "Old news", []byte(`{"title":"Old news"}`), time.Time{})
+	assert.Equal(t, ErrAlreadyExists, err, "migrated news read again must not be duplicated")
+	assert.Equal(t, 1, id)
+
+	id, _, err = sqlite.CreateNews(1, "http://feed/old", "Old news", []byte(`{"title":"Old news"}`), time.Time{})
+	assert.Equal(t, ErrAlreadyExists, err, "migrated news should be found by its real GUID")
+	assert.Equal(t, 1, id)
+
+	changed := []byte(`{"title":"Changed news","body":"new"}`)
+	id, _, err = sqlite.CreateNews(1, "http://feed/changed", "Changed news", changed, time.Time{})
+	assert.Equal(t, ErrAlreadyExists, err, "migrated news has no hash, so its first reading isn't a change")
+	assert.Equal(t, 2, id)
+
+	id, updated, err := sqlite.CreateNews(1, "http://feed/changed", "Changed news", []byte(`{"body":"newer"}`), time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, id)
+	assert.True(t, updated, "migrated news should be updated by its GUID")
+
+	var count int
+	err = getDb().QueryRow(`SELECT count(*) FROM news`).Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	var guid string
+	err = getDb().QueryRow(`SELECT GUID FROM news WHERE ID = 1`).Scan(&guid)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://feed/old", guid)
+}
+
+func TestNewsRevisions(t *testing.T) {
+	sqlite := SQLiteDatabase{}
+	prepareDbForRead(t)
+
+	id, updated, err := sqlite.CreateNews(1, "guid", "Title", []byte(`{"title":"Title","body":"Body"}`), time.Time{})
+	assert.NoError(t, err)
+	assert.False(t, updated)
+
+	sameID, updated, err := sqlite.CreateNews(1, "guid", "Title", []byte(`{"title":"Title","body":"Body"}`), time.Time{})
+	assert.Equal(t, ErrAlreadyExists, err, "SQLiteDatabase.CreateNews should return ErrAlreadyExists for unchanged news")
+	assert.Equal(t, id, sameID)
+	assert.False(t, updated)
+
+	for _, title := range []string{"Edited title", "Edited twice"} {
+		sameID, updated, err = sqlite.CreateNews(1, "guid", title, []byte(`{"title":"`+title+`","link":"l"}`), time.Time{})
+		assert.NoError(t, err)
+		assert.True(t, updated, "SQLiteDatabase.CreateNews should update changed news")
+		assert.Equal(t, id, sameID)
+	}
+
+	d, err := sqlite.GetNewsDetail(id)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Edited twice", d.Title)
+	}
+
+	revisions, err := sqlite.GetNewsRevisions(id)
+	if assert.NoError(t, err) && assert.Len(t, revisions, 3) {
+		for i, r := range revisions {
+			assert.Equal(t, i+1, r.Revision)
+			assert.Equal(t, i == 2, r.Current)
+		}
+		assert.Equal(t, "Title", revisions[0].Title)
+		assert.Equal(t, "Edited title", revisions[1].Title)
+		assert.Equal(t, "Edited twice", revisions[2].Title)
+	}
+
+	_, err = sqlite.GetNewsRevisions(id + 1)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestDiffNewsRevisions(t *testing.T) {
+	from := &NewsRevision{Revision: 1, Title: "Title", PayloadJSON: `{"title":"Title","body":"Body","same":[1, 2]}`}
+	to := &NewsRevision{Revision: 2, Title: "Edited", PayloadJSON: `{"title":"Edited","same":[1,2],"link":"l"}`}
+
+	want := &NewsDiff{
+		From:     1,
+		To:       2,
+		OldTitle: "Title",
+		NewTitle: "Edited",
+		Fields: []FieldDiff{
+			{Name: "body", Change: FieldRemoved, Old: json.RawMessage(`"Body"`)},
+			{Name: "link", Change: FieldAdded, New: json.RawMessage(`"l"`)},
+			{Name: "title", Change: FieldChanged, Old: json.RawMessage(`"Title"`), New: json.RawMessage(`"Edited"`)},
+		},
+	}
+
+	assert.Equal(t, want, DiffNewsRevisions(from, to))
+
+	plain := DiffNewsRevisions(&NewsRevision{Revision: 1, PayloadJSON: "json"}, &NewsRevision{Revision: 2, PayloadJSON: "other"})
+	assert.Len(t, plain.Fields, 1, "not JSON payloads should be compared as a whole")
+}
+
+func TestMigrate(t *testing.T) {
+	databaseFilePath = "./test.db"
+	os.Remove(databaseFilePath)
+	databaseInstance = nil
+
+	sqlite := SQLiteDatabase{}
+
+	applied, err := sqlite.Migrate()
+	assert.NoError(t, err)
+	assert.Len(t, applied, len(migrations), "SQLiteDatabase.Migrate should apply all migrations to new database")
+
+	applied, err = sqlite.Migrate()
+	assert.NoError(t, err)
+	assert.Empty(t, applied, "SQLiteDatabase.Migrate shouldn't apply migrations twice")
+
+	db := getDb()
+	last := migrations[len(migrations)-1].version
+
+	failing := append(migrations[:len(migrations):len(migrations)],
+		migration{last + 1, "create table", func(tx *sql.Tx) error {
+			_, err := tx.Exec(`CREATE TABLE migrated(ID INTEGER)`)
+			return err
+		}},
+		migration{last + 2, "broken", func(tx *sql.Tx) error {
+			if _, err := tx.Exec(`CREATE TABLE broken(ID INTEGER)`); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`SELECT * FROM not_existing_table`)
+			return err
+		}},
+	)
+
+	applied, err = migrate(db, failing, nil)
+	assert.Error(t, err)
+	assert.Equal(t, []int{last + 1}, applied)
+
+	version, err := schemaVersion(db)
+	assert.NoError(t, err)
+	assert.Equal(t, last+1, version, "failed migration shouldn't be recorded")
+
+	var c int
+	err = db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE name = 'broken'`).Scan(&c)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c, "failed migration should be rolled back")
+}
+
+func TestSearchIndex(t *testing.T) {
+	db := prepareDatabase()
+
+	available, err := fts5Available(db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !available {
+		t.Skip("SQLite is built without FTS5, run tests with -tags sqlite_fts5")
+	}
+
+	assert.True(t, searchIndexEnabled)
+
+	sqlite := SQLiteDatabase{}
+	_, _, err = sqlite.CreateNews(1, "guid1", "Indexed news", []byte(`{"description":"first"}`), time.Time{})
+	assert.NoError(t, err)
+
+	var count int
+	err = db.QueryRow(`SELECT count(*) FROM news_fts WHERE news_fts MATCH 'first'`).Scan(&count)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, count, "inserted news must be indexed")
+	}
+
+	// news changed while triggers are missing must be found after the index is synced
+	_, err = db.Exec(`DROP TRIGGER news_fts_update`)
+	assert.NoError(t, err)
+
+	_, _, err = sqlite.CreateNews(1, "guid1", "Indexed news", []byte(`{"description":"second"}`), time.Time{})
+	assert.NoError(t, err)
+
+	enabled, err := syncSearchIndex(db)
+	if assert.NoError(t, err) {
+		assert.True(t, enabled)
+	}
+
+	found, err := sqlite.SearchNews("second", 0, 10)
+	if assert.NoError(t, err) && assert.Len(t, found, 1) {
+		assert.Equal(t, "Indexed news", found[0].Title)
+	}
+
+	found, err = sqlite.SearchNews("first", 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
@@ -0,0 +1,953 @@
+package db
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/feeder"
+	"github.com/stretchr/testify/assert"
+)
+
+// conformanceStorage is a set of operations every storage backend must implement with the same semantics
+type conformanceStorage interface {
+	feeder.FeedStorage
+	GetNews(offset int, count int) ([]*News, error)
+	GetNewsWithTitle(title string, offset int, count int) ([]*News, error)
+	GetNewsDetail(id int) (*NewsDetail, error)
+	GetNewsRevisions(id int) ([]*NewsRevision, error)
+	GetFeedSourceHealth(sourceID int) (*feeder.FeedSourceHealth, error)
+	GetFeedSourcesHealth() ([]*feeder.FeedSourceHealth, error)
+	CreateFeedSource(s *Source) (int, error)
+	SearchNews(query string, offset int, count int) ([]*SearchResult, error)
+	QueryNews(q *NewsQuery) ([]*News, error)
+	ListFeedSources() ([]*Source, error)
+	GetFeedSource(id int) (*Source, error)
+	UpdateFeedSource(id int, u *SourceUpdate) error
+	DeleteFeedSource(id int, withNews bool) error
+	CreateWebhook(w *Webhook) (int, error)
+	ListWebhooks() ([]*Webhook, error)
+	GetWebhook(id int) (*Webhook, error)
+	DeleteWebhook(id int) error
+	AddWebhookDelivery(d *WebhookDelivery) error
+	GetWebhookDeliveries(webhookID int, offset, count int) ([]*WebhookDelivery, error)
+}
+
+// testConformance runs the shared suite against a backend. newStorage must return an empty storage
+func testConformance(t *testing.T, newStorage func(t *testing.T) conformanceStorage) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s conformanceStorage)
+	}{
+		{"create feed source", conformanceCreateFeedSource},
+		{"create news", conformanceCreateNews},
+		{"news revisions", conformanceNewsRevisions},
+		{"pagination", conformancePagination},
+		{"title search", conformanceTitleSearch},
+		{"not found", conformanceNotFound},
+		{"feed source cache and health", conformanceFeedSourceHealth},
+		{"reading after reset of health", conformanceReadingAfterReset},
+		{"concurrent writes", conformanceConcurrentWrites},
+		{"search", conformanceSearch},
+		{"query news", conformanceQueryNews},
+		{"query news with incorrect payload", conformanceQueryIncorrectPayload},
+		{"query news by search", conformanceQuerySearch},
+		{"cursor pagination", conformanceCursor},
+		{"manage feed sources", conformanceManageFeedSources},
+		{"delete feed source", conformanceDeleteFeedSource},
+		{"feed source filter", conformanceFeedSourceFilter},
+		{"validate feed source", conformanceValidateFeedSource},
+		{"webhooks", conformanceWebhooks},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.run(t, newStorage(t))
+		})
+	}
+}
+
+// createSource creates feed source with default settings and returns its ID
+func createSource(t *testing.T, s conformanceStorage, u, rule string) int {
+	t.Helper()
+
+	id, err := s.CreateFeedSource(&Source{URL: u, Rule: rule})
+	assert.NoError(t, err)
+
+	return id
+}
+
+func conformanceCreateFeedSource(t *testing.T, s conformanceStorage) {
+	id, err := s.CreateFeedSource(&Source{URL: "http://feed1", Rule: "title", Interval: time.Minute + time.Millisecond})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, id)
+	}
+	assert.Equal(t, 2, createSource(t, s, "http://feed2", "title=Title,link"))
+
+	id, err = s.CreateFeedSource(&Source{URL: "http://feed3", Rule: "title", Filter: `exclude title contains "draft"`,
+		Paused: true})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, id)
+	}
+
+	_, err = s.CreateFeedSource(&Source{URL: "http://feed1", Rule: "title"})
+	assert.Equal(t, ErrAlreadyExists, err, "URL must be unique")
+	_, err = s.CreateFeedSource(&Source{URL: "https"})
+	assert.ErrorIs(t, err, ErrIncorrectArgs)
+	_, err = s.CreateFeedSource(&Source{URL: "http://feed4", Rule: "title", Interval: -time.Second})
+	assert.ErrorIs(t, err, ErrIncorrectArgs)
+	_, err = s.CreateFeedSource(&Source{URL: "http://feed4", Rule: "title", Filter: "title like go"})
+	assert.ErrorIs(t, err, ErrIncorrectArgs)
+	_, err = s.CreateFeedSource(nil)
+	assert.ErrorIs(t, err, ErrIncorrectArgs)
+
+	sources, err := s.GetFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, sources, 2, "paused source must not be read") {
+		assert.Equal(t, 1, sources[0].ID)
+		assert.Equal(t, "http://feed1", sources[0].URL)
+		assert.Equal(t, time.Minute, sources[0].Interval)
+		assert.Equal(t, map[string]string{"title": "Title", "link": "link"}, sources[1].Rule)
+		assert.Equal(t, time.Duration(0), sources[1].Interval)
+	}
+
+	src, err := s.GetFeedSource(3)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `exclude title contains "draft"`, src.Filter)
+		assert.True(t, src.Paused, "source must be created paused")
+	}
+}
+
+func conformanceCreateNews(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+	createSource(t, s, "http://feed2", "title")
+
+	id, updated, err := s.CreateNews(1, "guid1", "First", []byte(`{"a":1}`), time.Time{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, id)
+		assert.False(t, updated)
+	}
+
+	_, _, err = s.CreateNews(1, "guid1", "First", []byte(`{"a":1}`), time.Time{})
+	assert.Equal(t, ErrAlreadyExists, err, "the same news must not be created twice")
+
+	id, _, err = s.CreateNews(2, "guid1", "First", []byte(`{"a":1}`), time.Time{})
+	if assert.NoError(t, err, "GUID is unique only within a source") {
+		assert.Equal(t, 2, id)
+	}
+
+	id, updated, err = s.CreateNews(1, "guid1", "First changed", []byte(`{"a":2}`), time.Time{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, id)
+		assert.True(t, updated)
+	}
+
+	_, _, err = s.CreateNews(1, "", "Title", nil, time.Time{})
+	assert.Equal(t, ErrIncorrectArgs, err)
+
+	_, _, err = s.CreateNews(1, "guid2", "", nil, time.Time{})
+	assert.Equal(t, ErrIncorrectArgs, err)
+
+	news, err := s.GetNews(0, 10)
+	if assert.NoError(t, err) && assert.Len(t, news, 2) {
+		assert.Equal(t, []interface{}{1, "First changed", "http://feed1"}, []interface{}{news[0].ID, news[0].Title, news[0].Source})
+		assert.Equal(t, []interface{}{2, "First", "http://feed2"}, []interface{}{news[1].ID, news[1].Title, news[1].Source})
+		assert.False(t, news[0].AddedAt.IsZero())
+		assert.Nil(t, news[0].PublishedAt)
+	}
+
+	detail, err := s.GetNewsDetail(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, &NewsDetail{Title: "First changed", PayloadJSON: `{"a":2}`, Source: "http://feed1"}, detail)
+	}
+}
+
+func conformanceNewsRevisions(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	for _, payload := range []string{`{"a":1}`, `{"a":2}`, `{"a":3}`} {
+		_, _, err := s.CreateNews(1, "guid1", "News", []byte(payload), time.Time{})
+		assert.NoError(t, err)
+	}
+
+	revisions, err := s.GetNewsRevisions(1)
+	if assert.NoError(t, err) && assert.Len(t, revisions, 3) {
+		for i, r := range revisions {
+			assert.Equal(t, i+1, r.Revision)
+			assert.Equal(t, `{"a":`+strconv.Itoa(i+1)+`}`, r.PayloadJSON)
+			assert.Equal(t, i == 2, r.Current)
+			assert.False(t, r.AddedAt.IsZero())
+		}
+	}
+}
+
+func conformancePagination(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	for i := 1; i <= 25; i++ {
+		_, _, err := s.CreateNews(1, "guid"+strconv.Itoa(i), "News "+strconv.Itoa(i), nil, time.Time{})
+		assert.NoError(t, err)
+	}
+
+	tests := []struct {
+		name          string
+		offset, count int
+		wantLen       int
+		wantFirstID   int
+	}{
+		{name: "first page", offset: 0, count: 10, wantLen: 10, wantFirstID: 1},
+		{name: "middle page", offset: 10, count: 10, wantLen: 10, wantFirstID: 11},
+		{name: "last page", offset: 20, count: 10, wantLen: 5, wantFirstID: 21},
+		{name: "after the end", offset: 30, count: 10, wantLen: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			news, err := s.GetNews(tt.offset, tt.count)
+			if assert.NoError(t, err) && assert.Len(t, news, tt.wantLen) && tt.wantLen > 0 {
+				assert.Equal(t, tt.wantFirstID, news[0].ID)
+			}
+		})
+	}
+}
+
+func conformanceTitleSearch(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	for i, title := range []string{"Go release", "Rust release", "GOPHERS meetup", "Weather"} {
+		_, _, err := s.CreateNews(1, "guid"+strconv.Itoa(i), title, nil, time.Time{})
+		assert.NoError(t, err)
+	}
+
+	news, err := s.GetNewsWithTitle("go", 0, 10)
+	if assert.NoError(t, err) && assert.Len(t, news, 2, "search must ignore case") {
+		assert.Equal(t, "Go release", news[0].Title)
+		assert.Equal(t, "GOPHERS meetup", news[1].Title)
+	}
+
+	news, err = s.GetNewsWithTitle("release", 1, 10)
+	if assert.NoError(t, err) && assert.Len(t, news, 1) {
+		assert.Equal(t, "Rust release", news[0].Title)
+	}
+
+	news, err = s.GetNewsWithTitle("nothing", 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, news)
+}
+
+func conformanceNotFound(t *testing.T, s conformanceStorage) {
+	_, err := s.GetNewsDetail(1)
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = s.GetNewsRevisions(1)
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = s.GetFeedSourceHealth(1)
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Equal(t, ErrNotFound, s.UpdateFeedSourceCache(1, "etag", ""))
+	_, err = s.RecordFeedSourceReading(&feeder.FeedSourceReading{SourceID: 1})
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.RecordFeedSourceReading(nil)
+	assert.Equal(t, ErrIncorrectArgs, err)
+
+	news, err := s.GetNews(0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, news)
+}
+
+func conformanceFeedSourceHealth(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+	createSource(t, s, "http://feed2", "title")
+
+	assert.NoError(t, s.UpdateFeedSourceCache(1, `"etag"`, "Mon, 02 Jan 2006 15:04:05 GMT"))
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	h, err := s.RecordFeedSourceReading(&feeder.FeedSourceReading{SourceID: 2, At: at.Add(-time.Hour), Status: 200,
+		Filtered: 2})
+	if assert.NoError(t, err) {
+		assert.True(t, at.Add(-time.Hour).Equal(h.LastSuccess))
+		assert.Equal(t, 2, h.Filtered)
+	}
+
+	for i := 1; i <= 3; i++ {
+		h, err = s.RecordFeedSourceReading(&feeder.FeedSourceReading{SourceID: 2, At: at, Status: 500,
+			Error: "Unexpected HTTP status 500", Filtered: 1, MaxFailures: 3})
+		if assert.NoError(t, err) {
+			assert.Equal(t, i, h.Failures)
+			assert.Equal(t, i == 3, h.Disabled, "source must be disabled after max failures")
+		}
+	}
+
+	saved, err := s.GetFeedSourceHealth(2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, saved.SourceID)
+		assert.True(t, at.Equal(saved.LastAttempt))
+		assert.True(t, at.Add(-time.Hour).Equal(saved.LastSuccess), "failure must not change the last success")
+		assert.Equal(t, 3, saved.Failures)
+		assert.Equal(t, "Unexpected HTTP status 500", saved.LastError)
+		assert.Equal(t, 500, saved.LastStatus)
+		assert.Equal(t, 5, saved.Filtered, "filtered items of readings must be summed")
+		assert.True(t, saved.Disabled)
+	}
+
+	all, err := s.GetFeedSourcesHealth()
+	if assert.NoError(t, err) && assert.Len(t, all, 2, "disabled sources must have health") {
+		assert.Equal(t, 1, all[0].SourceID)
+		assert.Equal(t, 2, all[1].SourceID)
+	}
+
+	sources, err := s.GetFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, sources, 1, "disabled sources must not be read") {
+		assert.Equal(t, `"etag"`, sources[0].ETag)
+		assert.Equal(t, "Mon, 02 Jan 2006 15:04:05 GMT", sources[0].LastModified)
+	}
+}
+
+func conformanceReadingAfterReset(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	failed := &feeder.FeedSourceReading{SourceID: 1, At: time.Now(), Error: "timeout", Filtered: 3, MaxFailures: 2}
+	for i := 0; i < 2; i++ {
+		_, err := s.RecordFeedSourceReading(failed)
+		assert.NoError(t, err)
+	}
+
+	// the source is resumed and its filter is changed while it's read again
+	paused, filter := false, `exclude title contains "ad"`
+	assert.NoError(t, s.UpdateFeedSource(1, &SourceUpdate{Paused: &paused, Filter: &filter}))
+
+	h, err := s.RecordFeedSourceReading(failed)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, h.Failures, "reset failures must not be restored by the reading")
+		assert.False(t, h.Disabled)
+		assert.Equal(t, 3, h.Filtered, "reset count of filtered items must not be restored by the reading")
+	}
+}
+
+func conformanceConcurrentWrites(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				_, _, err := s.CreateNews(1, "guid"+strconv.Itoa(j), "News", nil, time.Time{})
+				if err != nil && err != ErrAlreadyExists {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	news, err := s.GetNews(0, 100)
+	if assert.NoError(t, err) {
+		assert.Len(t, news, 5, "every GUID must be saved once")
+	}
+}
+
+func conformanceSearch(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	news := []struct{ title, payload string }{
+		{"Go 1.22 released", `{"description":"Range over integers and a new HTTP router"}`},
+		{"Rust release notes", `{"description":"Go-style channels are not in this release"}`},
+		{"Weather", `{"description":"Sunny weekend","author":{"name":"Gopher"}}`},
+		{"Router firmware", "not json"},
+	}
+	for i, n := range news {
+		_, _, err := s.CreateNews(1, "guid"+strconv.Itoa(i), n.title, []byte(n.payload), time.Time{})
+		assert.NoError(t, err)
+	}
+
+	tests := []struct {
+		name    string
+		query   string
+		wantIDs []int
+		wantErr bool
+	}{
+		{name: "word in title is more relevant", query: "go", wantIDs: []int{1, 2}},
+		{name: "word in payload", query: "router", wantIDs: []int{4, 1}},
+		{name: "nested payload field", query: "gopher", wantIDs: []int{3}},
+		{name: "prefix", query: "gopher*", wantIDs: []int{3}},
+		{name: "phrase", query: `"new http router"`, wantIDs: []int{1}},
+		{name: "phrase prefix", query: `"new http rout"*`, wantIDs: []int{1}},
+		{name: "implicit and", query: "release go", wantIDs: []int{2}},
+		{name: "or", query: "weather OR firmware", wantIDs: []int{3, 4}},
+		{name: "not", query: "release* NOT rust", wantIDs: []int{1}},
+		{name: "parentheses", query: "(rust OR sunny) NOT channels", wantIDs: []int{3}},
+		{name: "nothing found", query: "python", wantIDs: nil},
+		{name: "empty query", query: " ", wantErr: true},
+		{name: "syntax error", query: "go AND", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := s.SearchNews(tt.query, 0, 10)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrIncorrectArgs)
+				return
+			}
+
+			var ids []int
+			for _, n := range found {
+				ids = append(ids, n.ID)
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantIDs, ids)
+			}
+		})
+	}
+
+	found, err := s.SearchNews("integers", 0, 10)
+	if assert.NoError(t, err) && assert.Len(t, found, 1) {
+		assert.Equal(t, "Go 1.22 released", found[0].Title)
+		assert.Equal(t, "http://feed1", found[0].Source)
+		assert.Contains(t, found[0].Snippet, HighlightStart+"integers"+HighlightEnd)
+		assert.True(t, found[0].Rank > 0)
+	}
+
+	found, err = s.SearchNews("go OR router", 1, 1)
+	if assert.NoError(t, err) {
+		assert.Len(t, found, 1, "search must be paginated")
+	}
+
+	_, _, err = s.CreateNews(1, "guid2", "Weather", []byte(`{"description":"Rainy weekend"}`), time.Time{})
+	assert.NoError(t, err)
+
+	found, err = s.SearchNews("sunny", 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, found, "updated news must be searched by the current version")
+}
+
+func conformanceQueryNews(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+	createSource(t, s, "http://feed2", "title")
+	createSource(t, s, "http://feed3", "title")
+
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+
+	news := []struct {
+		sourceID  int
+		title     string
+		payload   string
+		published time.Time
+	}{
+		{1, "First", `{"author":"Ann","tags":["go"],"flag":true}`, day(3)},
+		{2, "Second", `{"author":"Bob","rating":5,"flag":false,"score":1.50}`, day(1)},
+		{3, "Third", `{"author":null}`, time.Time{}},
+		{1, "Fourth", `{"rating":4}`, day(2)},
+	}
+	for i, n := range news {
+		_, _, err := s.CreateNews(n.sourceID, "guid"+strconv.Itoa(i), n.title, []byte(n.payload), n.published)
+		assert.NoError(t, err)
+	}
+
+	added, err := s.GetNews(0, 10)
+	if !assert.NoError(t, err) || !assert.Len(t, added, 4) {
+		return
+	}
+
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		name    string
+		in      NewsQuery
+		wantIDs []int
+		wantErr bool
+	}{
+		{name: "default", in: NewsQuery{Count: 10}, wantIDs: []int{1, 2, 3, 4}},
+		{name: "newest first", in: NewsQuery{Desc: true, Count: 10}, wantIDs: []int{4, 3, 2, 1}},
+		{name: "page", in: NewsQuery{Desc: true, Offset: 1, Count: 2}, wantIDs: []int{3, 2}},
+		{name: "sources", in: NewsQuery{SourceIDs: []int{1, 3}, Count: 10}, wantIDs: []int{1, 3, 4}},
+		{name: "title and source", in: NewsQuery{Title: "f", SourceIDs: []int{1}, Count: 10}, wantIDs: []int{1, 4}},
+		{name: "ids", in: NewsQuery{IDs: []int{4, 2, 7}, Desc: true, Count: 10}, wantIDs: []int{4, 2}},
+		{name: "ids and source", in: NewsQuery{IDs: []int{1, 2}, SourceIDs: []int{2}, Count: 10}, wantIDs: []int{2}},
+		{
+			name:    "sort by publication time",
+			in:      NewsQuery{SortBy: SortByPublished, Count: 10},
+			wantIDs: []int{2, 4, 1, 3},
+		},
+		{
+			name:    "sort by publication time descending",
+			in:      NewsQuery{SortBy: SortByPublished, Desc: true, Count: 10},
+			wantIDs: []int{1, 4, 2, 3},
+		},
+		{
+			name:    "published range",
+			in:      NewsQuery{PublishedFrom: day(2), PublishedTo: day(3), Count: 10},
+			wantIDs: []int{4},
+		},
+		{
+			name:    "published from",
+			in:      NewsQuery{PublishedFrom: day(2), Count: 10},
+			wantIDs: []int{1, 4},
+		},
+		{
+			name:    "added range",
+			in:      NewsQuery{AddedFrom: added[0].AddedAt, AddedTo: added[3].AddedAt.Add(time.Second), Count: 10},
+			wantIDs: []int{1, 2, 3, 4},
+		},
+		{
+			name:    "added in the future",
+			in:      NewsQuery{AddedFrom: time.Now().Add(time.Hour), Count: 10},
+			wantIDs: nil,
+		},
+		{
+			name:    "field exists",
+			in:      NewsQuery{Fields: []FieldFilter{{Name: "author"}}, Count: 10},
+			wantIDs: []int{1, 2},
+		},
+		{
+			name:    "field value",
+			in:      NewsQuery{Fields: []FieldFilter{{Name: "author", Value: str("Bob")}}, Count: 10},
+			wantIDs: []int{2},
+		},
+		{
+			name:    "number field value",
+			in:      NewsQuery{Fields: []FieldFilter{{Name: "rating", Value: str("4")}}, Count: 10},
+			wantIDs: []int{4},
+		},
+		{
+			name:    "boolean field value",
+			in:      NewsQuery{Fields: []FieldFilter{{Name: "flag", Value: str("true")}}, Count: 10},
+			wantIDs: []int{1},
+		},
+		{
+			name:    "false field value",
+			in:      NewsQuery{Fields: []FieldFilter{{Name: "flag", Value: str("false")}}, Count: 10},
+			wantIDs: []int{2},
+		},
+		{
+			name:    "fractional number field value",
+			in:      NewsQuery{Fields: []FieldFilter{{Name: "score", Value: str("1.50")}}, Count: 10},
+			wantIDs: []int{2},
+		},
+		{
+			name:    "several fields",
+			in:      NewsQuery{Fields: []FieldFilter{{Name: "author"}, {Name: "rating"}}, Count: 10},
+			wantIDs: []int{2},
+		},
+		{name: "incorrect field", in: NewsQuery{Fields: []FieldFilter{{Name: `a"b`}}, Count: 10}, wantErr: true},
+		{name: "unknown sort", in: NewsQuery{SortBy: 10, Count: 10}, wantErr: true},
+		{name: "negative offset", in: NewsQuery{Offset: -1, Count: 10}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := s.QueryNews(&tt.in)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrIncorrectArgs)
+				return
+			}
+
+			var ids []int
+			for _, n := range found {
+				ids = append(ids, n.ID)
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.wantIDs, ids)
+			}
+		})
+	}
+
+	found, err := s.QueryNews(&NewsQuery{SourceIDs: []int{2}, Count: 1})
+	if assert.NoError(t, err) && assert.Len(t, found, 1) && assert.NotNil(t, found[0].PublishedAt) {
+		assert.True(t, day(1).Equal(*found[0].PublishedAt))
+	}
+}
+
+func conformanceQueryIncorrectPayload(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	for i, payload := range []string{`{"author":"Ann"}`, `not json`, ``, `{"author":"Bob"}`} {
+		_, _, err := s.CreateNews(1, "guid"+strconv.Itoa(i), "News "+strconv.Itoa(i), []byte(payload), time.Time{})
+		assert.NoError(t, err)
+	}
+
+	ids := func(news []*News) []int {
+		var result []int
+		for _, n := range news {
+			result = append(result, n.ID)
+		}
+		return result
+	}
+
+	ann := "Ann"
+	res, err := s.QueryNews(&NewsQuery{Fields: []FieldFilter{{Name: "author", Value: &ann}}, Count: 10})
+	if assert.NoError(t, err, "payload which isn't JSON must not fail the query") {
+		assert.Equal(t, []int{1}, ids(res))
+	}
+
+	res, err = s.QueryNews(&NewsQuery{Fields: []FieldFilter{{Name: "author"}}, Count: 10})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{1, 4}, ids(res), "payload which isn't JSON has no fields")
+	}
+}
+
+func conformanceQuerySearch(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+	createSource(t, s, "http://feed2", "title")
+
+	for i := 1; i <= 6; i++ {
+		payload := `{"body":"Go is released","n":` + strconv.Itoa(i%2) + `}`
+		if i == 3 {
+			payload = `{"body":"Weather"}`
+		}
+
+		_, _, err := s.CreateNews(1+i%2, "guid"+strconv.Itoa(i), "News "+strconv.Itoa(i), []byte(payload), time.Time{})
+		assert.NoError(t, err)
+	}
+
+	ids := func(news []*News) []int {
+		var result []int
+		for _, n := range news {
+			result = append(result, n.ID)
+		}
+		return result
+	}
+
+	res, err := s.QueryNews(&NewsQuery{Search: "released", Desc: true, Count: 10})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int{6, 5, 4, 2, 1}, ids(res))
+		assert.Empty(t, res[0].PayloadJSON, "payload must be filled only if it's requested")
+	}
+
+	zero := "0"
+	res, err = s.QueryNews(&NewsQuery{Search: "go AND released", SourceIDs: []int{1},
+		Fields: []FieldFilter{{Name: "n", Value: &zero}}, Offset: 1, Count: 1, WithPayload: true})
+	if assert.NoError(t, err) && assert.Len(t, res, 1) {
+		assert.Equal(t, 4, res[0].ID, "filters must be applied with the search before paging")
+		assert.Equal(t, `{"body":"Go is released","n":0}`, res[0].PayloadJSON)
+		assert.Equal(t, "http://feed1", res[0].Source)
+	}
+
+	res, err = s.QueryNews(&NewsQuery{Search: "weather OR nothing", Count: 10, WithPayload: true})
+	if assert.NoError(t, err) && assert.Len(t, res, 1) {
+		assert.Equal(t, `{"body":"Weather"}`, res[0].PayloadJSON)
+	}
+
+	_, err = s.QueryNews(&NewsQuery{Search: "(go", Count: 10})
+	assert.ErrorIs(t, err, ErrIncorrectArgs)
+}
+
+func conformanceCursor(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+
+	for i := 1; i <= 7; i++ {
+		_, _, err := s.CreateNews(1, "guid"+strconv.Itoa(i), "News "+strconv.Itoa(i), nil, time.Time{})
+		assert.NoError(t, err)
+	}
+
+	ids := func(news []*News) []int {
+		var result []int
+		for _, n := range news {
+			result = append(result, n.ID)
+		}
+		return result
+	}
+
+	cursor := func(n *News, before bool) *NewsCursor {
+		c, err := ParseNewsCursor((&NewsCursor{AddedAt: n.AddedAt, ID: n.ID, Before: before}).String())
+		assert.NoError(t, err)
+		return c
+	}
+
+	for _, desc := range []bool{false, true} {
+		first, err := s.QueryNews(&NewsQuery{Desc: desc, Count: 3})
+		if !assert.NoError(t, err) || !assert.Len(t, first, 3) {
+			return
+		}
+
+		second, err := s.QueryNews(&NewsQuery{Desc: desc, Count: 3, Cursor: cursor(first[2], false)})
+		if !assert.NoError(t, err) || !assert.Len(t, second, 3) {
+			return
+		}
+
+		// news added between page loads don't shift pages
+		_, _, err = s.CreateNews(1, "new"+strconv.FormatBool(desc), "Newer", nil, time.Time{})
+		assert.NoError(t, err)
+
+		back, err := s.QueryNews(&NewsQuery{Desc: desc, Count: 3, Cursor: cursor(second[0], true)})
+		if assert.NoError(t, err) {
+			assert.Equal(t, ids(first), ids(back), "previous page should be the first one")
+		}
+
+		if !desc {
+			assert.Equal(t, []int{1, 2, 3}, ids(first))
+			assert.Equal(t, []int{4, 5, 6}, ids(second))
+
+			partial, err := s.QueryNews(&NewsQuery{Count: 3, Cursor: cursor(first[1], true)})
+			if assert.NoError(t, err) {
+				assert.Equal(t, []int{1}, ids(partial))
+			}
+		} else {
+			// news 8 is added while ascending pages are loaded
+			assert.Equal(t, []int{8, 7, 6}, ids(first))
+			assert.Equal(t, []int{5, 4, 3}, ids(second))
+
+			newer, err := s.QueryNews(&NewsQuery{Desc: true, Count: 3, Cursor: cursor(first[0], true)})
+			if assert.NoError(t, err) {
+				assert.Equal(t, []int{9}, ids(newer), "news added after the first page should precede it")
+			}
+		}
+	}
+
+	_, err := s.QueryNews(&NewsQuery{SortBy: SortByPublished, Count: 3, Cursor: &NewsCursor{}})
+	assert.ErrorIs(t, err, ErrIncorrectArgs)
+
+	_, err = ParseNewsCursor("not a cursor")
+	assert.ErrorIs(t, err, ErrIncorrectArgs)
+}
+
+func TestMemoryDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) conformanceStorage {
+		t.Parallel()
+		return &MemoryDatabase{}
+	})
+}
+
+func TestSQLiteDatabaseConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) conformanceStorage {
+		prepareDatabase()
+		return &SQLiteDatabase{}
+	})
+}
+
+func conformanceManageFeedSources(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+	createSource(t, s, "http://feed2", "title")
+	assert.NoError(t, s.UpdateFeedSourceCache(1, "etag", "yesterday"))
+	_, err := s.RecordFeedSourceReading(&feeder.FeedSourceReading{SourceID: 1, Error: "timeout", MaxFailures: 1})
+	assert.NoError(t, err)
+
+	sources, err := s.ListFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, sources, 2) {
+		assert.Equal(t, "http://feed1", sources[0].URL)
+		assert.True(t, sources[0].Health.Disabled, "disabled sources must be listed")
+	}
+
+	interval, paused := time.Minute, true
+	assert.NoError(t, s.UpdateFeedSource(2, &SourceUpdate{Interval: &interval, Paused: &paused}))
+
+	src, err := s.GetFeedSource(2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{"http://feed2", "title", time.Minute, true},
+			[]interface{}{src.URL, src.Rule, src.Interval, src.Paused})
+	}
+
+	readable, err := s.GetFeedSources()
+	if assert.NoError(t, err) {
+		assert.Empty(t, readable, "paused and disabled sources must not be read")
+	}
+
+	rule := "title=Title,link"
+	assert.NoError(t, s.UpdateFeedSource(1, &SourceUpdate{Rule: &rule}))
+
+	readable, err = s.GetFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, readable, 1, "source with fixed rule must be enabled") {
+		assert.Equal(t, map[string]string{"title": "Title", "link": "link"}, readable[0].Rule)
+		assert.Empty(t, readable[0].ETag, "cache validators of changed source must be cleared")
+		assert.Equal(t, 0, readable[0].Health.Failures)
+		assert.Empty(t, readable[0].Health.LastError)
+	}
+
+	paused = false
+	assert.NoError(t, s.UpdateFeedSource(2, &SourceUpdate{Paused: &paused}))
+
+	readable, err = s.GetFeedSources()
+	if assert.NoError(t, err) {
+		assert.Len(t, readable, 2, "resumed source must be read")
+	}
+
+	u, wrong := "http://feed1", "feed"
+	assert.Equal(t, ErrAlreadyExists, s.UpdateFeedSource(2, &SourceUpdate{URL: &u}), "URL must be unique")
+	assert.ErrorIs(t, s.UpdateFeedSource(2, &SourceUpdate{URL: &wrong}), ErrIncorrectArgs)
+	assert.Equal(t, ErrNotFound, s.UpdateFeedSource(3, &SourceUpdate{Rule: &rule}))
+
+	_, err = s.GetFeedSource(3)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func conformanceFeedSourceFilter(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+	assert.NoError(t, s.UpdateFeedSourceCache(1, "etag", "yesterday"))
+
+	filter := `exclude title contains "ad"`
+	assert.NoError(t, s.UpdateFeedSource(1, &SourceUpdate{Filter: &filter}))
+	_, err := s.RecordFeedSourceReading(&feeder.FeedSourceReading{SourceID: 1, Filtered: 5})
+	assert.NoError(t, err)
+
+	readable, err := s.GetFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, readable, 1) {
+		assert.NotNil(t, readable[0].Filter)
+		assert.Empty(t, readable[0].ETag, "cache validators must be cleared, so items are filtered again")
+		assert.Equal(t, 5, readable[0].Health.Filtered)
+	}
+
+	src, err := s.GetFeedSource(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, filter, src.Filter)
+		assert.Equal(t, 5, src.Health.Filtered)
+	}
+
+	wrong := "title like ad"
+	assert.ErrorIs(t, s.UpdateFeedSource(1, &SourceUpdate{Filter: &wrong}), ErrIncorrectArgs)
+
+	filter = ""
+	assert.NoError(t, s.UpdateFeedSource(1, &SourceUpdate{Filter: &filter}))
+
+	readable, err = s.GetFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, readable, 1) {
+		assert.Nil(t, readable[0].Filter)
+		assert.Equal(t, 0, readable[0].Health.Filtered, "count of filtered items must be reset with the filter")
+	}
+}
+
+func conformanceValidateFeedSource(t *testing.T, s conformanceStorage) {
+	_, err := s.CreateFeedSource(&Source{URL: "feed", Rule: "title,enclosures[first]=url,description|nope",
+		Interval: -time.Second})
+
+	var verr *ValidationError
+	if assert.ErrorAs(t, err, &verr) && assert.Len(t, verr.Errors, 4) {
+		assert.ErrorIs(t, err, ErrIncorrectArgs)
+		assert.Equal(t, "URL", verr.Errors[0].Field)
+		assert.Equal(t, []string{"Rule", "enclosures[first]"}, []string{verr.Errors[1].Field, verr.Errors[1].Expr})
+		assert.Equal(t, []string{"Rule", "description|nope"}, []string{verr.Errors[2].Field, verr.Errors[2].Expr})
+		assert.Equal(t, "Interval", verr.Errors[3].Field)
+	}
+
+	createSource(t, s, "http://feed1", "title")
+
+	rule, filter := "author..name", "title like go"
+	err = s.UpdateFeedSource(1, &SourceUpdate{Rule: &rule, Filter: &filter})
+	if assert.ErrorAs(t, err, &verr) && assert.Len(t, verr.Errors, 2) {
+		assert.Equal(t, FieldError{Field: "Filter", Expr: filter, Message: verr.Errors[1].Message}, verr.Errors[1])
+	}
+
+	src, err := s.GetFeedSource(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "title", src.Rule, "incorrect rule must not be saved")
+		assert.NoError(t, src.Validate())
+	}
+}
+
+func conformanceDeleteFeedSource(t *testing.T, s conformanceStorage) {
+	createSource(t, s, "http://feed1", "title")
+	createSource(t, s, "http://feed2", "title")
+
+	_, _, err := s.CreateNews(1, "guid1", "News", nil, time.Time{})
+	assert.NoError(t, err)
+	_, _, err = s.CreateNews(2, "guid2", "News", nil, time.Time{})
+	assert.NoError(t, err)
+	_, _, err = s.CreateNews(1, "guid1", "News changed", nil, time.Time{})
+	assert.NoError(t, err)
+
+	assert.NoError(t, s.DeleteFeedSource(1, true))
+	assert.NoError(t, s.DeleteFeedSource(2, false))
+	assert.Equal(t, ErrNotFound, s.DeleteFeedSource(2, false))
+
+	sources, err := s.ListFeedSources()
+	if assert.NoError(t, err) {
+		assert.Empty(t, sources)
+	}
+
+	news, err := s.GetNews(0, 10)
+	if assert.NoError(t, err) && assert.Len(t, news, 1, "news of the source deleted without news must be kept") {
+		assert.Equal(t, 2, news[0].ID)
+		assert.Empty(t, news[0].Source)
+	}
+
+	_, err = s.GetNewsRevisions(1)
+	assert.Equal(t, ErrNotFound, err)
+
+	_, err = s.CreateFeedSource(&Source{URL: "http://feed1", Rule: "title"})
+	assert.NoError(t, err, "URL of deleted source is free")
+
+	sources, err = s.ListFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, sources, 1) {
+		assert.Equal(t, 3, sources[0].ID, "IDs of deleted sources must not be reused")
+	}
+}
+
+func conformanceWebhooks(t *testing.T, s conformanceStorage) {
+	for _, w := range []*Webhook{
+		nil,
+		{URL: "http://hook", Secret: ""},
+		{URL: "hook", Secret: "secret"},
+		{URL: "ftp://hook", Secret: "secret"},
+	} {
+		_, err := s.CreateWebhook(w)
+		assert.Equal(t, ErrIncorrectArgs, err)
+	}
+
+	id, err := s.CreateWebhook(&Webhook{URL: "http://hook1", SourceIDs: []int{1, 2}, Keyword: "go", Secret: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, id)
+
+	id, err = s.CreateWebhook(&Webhook{URL: "https://hook2", Secret: "secret2"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, id)
+
+	w, err := s.GetWebhook(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "http://hook1", w.URL)
+		assert.Equal(t, []int{1, 2}, w.SourceIDs)
+		assert.Equal(t, "go", w.Keyword)
+		assert.Equal(t, "secret", w.Secret)
+		assert.False(t, w.CreatedAt.IsZero())
+	}
+
+	for i := 1; i <= 3; i++ {
+		d := &WebhookDelivery{WebhookID: 1, NewsID: 5, Attempt: i, Status: 500, Error: "HTTP 500"}
+		if i == 3 {
+			d.Status, d.Error, d.Delivered = 200, "", true
+		}
+		assert.NoError(t, s.AddWebhookDelivery(d))
+		assert.Equal(t, i, d.ID)
+	}
+	assert.NoError(t, s.AddWebhookDelivery(&WebhookDelivery{WebhookID: 2, NewsID: 5, Attempt: 1, Status: 204, Delivered: true}))
+	assert.Equal(t, ErrNotFound, s.AddWebhookDelivery(&WebhookDelivery{WebhookID: 3, NewsID: 5, Attempt: 1}))
+	assert.Equal(t, ErrIncorrectArgs, s.AddWebhookDelivery(&WebhookDelivery{WebhookID: 1, NewsID: 5}))
+
+	deliveries, err := s.GetWebhookDeliveries(1, 0, 2)
+	if assert.NoError(t, err) && assert.Len(t, deliveries, 2) {
+		assert.Equal(t, 3, deliveries[0].Attempt, "the latest attempt must be the first")
+		assert.True(t, deliveries[0].Delivered)
+		assert.Equal(t, 200, deliveries[0].Status)
+		assert.Equal(t, 2, deliveries[1].Attempt)
+		assert.False(t, deliveries[1].Delivered)
+		assert.Equal(t, "HTTP 500", deliveries[1].Error)
+		assert.Equal(t, 5, deliveries[1].NewsID)
+	}
+
+	deliveries, err = s.GetWebhookDeliveries(1, 2, 10)
+	if assert.NoError(t, err) && assert.Len(t, deliveries, 1) {
+		assert.Equal(t, 1, deliveries[0].Attempt)
+	}
+
+	_, err = s.GetWebhookDeliveries(3, 0, 10)
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.NoError(t, s.DeleteWebhook(1))
+	assert.Equal(t, ErrNotFound, s.DeleteWebhook(1))
+
+	_, err = s.GetWebhook(1)
+	assert.Equal(t, ErrNotFound, err)
+
+	webhooks, err := s.ListWebhooks()
+	if assert.NoError(t, err) && assert.Len(t, webhooks, 1) {
+		assert.Equal(t, 2, webhooks[0].ID)
+		assert.Empty(t, webhooks[0].SourceIDs)
+	}
+
+	deliveries, err = s.GetWebhookDeliveries(2, 0, 10)
+	if assert.NoError(t, err) {
+		assert.Len(t, deliveries, 1, "deliveries of other webhooks must be kept")
+	}
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"database/sql"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook is a subscription of external service to inserted news
+type Webhook struct {
+	ID  int
+	URL string
+	// SourceIDs and Keyword select news, empty ones select all news
+	SourceIDs []int
+	Keyword   string
+	// Secret is a key of HMAC signature of delivered news
+	Secret    string
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is an attempt to deliver news to webhook
+type WebhookDelivery struct {
+	ID        int
+	WebhookID int
+	NewsID    int
+	// Attempt is a number of the attempt starting from 1
+	Attempt int
+	// Status is HTTP status of the response or 0 if there is no response
+	Status    int
+	Error     string
+	Delivered bool
+	CreatedAt time.Time
+}
+
+// validateWebhook checks settings of webhook
+func validateWebhook(w *Webhook) error {
+	if w == nil || w.Secret == "" {
+		return ErrIncorrectArgs
+	}
+
+	u, err := url.ParseRequestURI(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrIncorrectArgs
+	}
+
+	return nil
+}
+
+// joinIDs and splitIDs convert source IDs of webhook to the database column and back
+func joinIDs(ids []int) string {
+	items := make([]string, len(ids))
+	for i, id := range ids {
+		items[i] = strconv.Itoa(id)
+	}
+
+	return strings.Join(items, ",")
+}
+
+func splitIDs(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ids []int
+	for _, item := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+func writeWebhook(db *sql.DB, w *Webhook) (int, error) {
+	defer observeQuery(db, "create_webhook", time.Now())
+
+	if err := validateWebhook(w); err != nil {
+		return 0, err
+	}
+
+	query := `
+	INSERT INTO webhooks(
+		URL,
+		SourceIDs,
+		Keyword,
+		Secret,
+		CreatedAt
+	) values(?, ?, ?, ?, ?)
+	RETURNING ID;
+	`
+
+	var id int
+	err := db.QueryRow(bind(db, query), w.URL, joinIDs(w.SourceIDs), w.Keyword, w.Secret,
+		time.Now().UTC()).Scan(&id)
+
+	return id, err
+}
+
+// webhookColumns are selected by readWebhooks and scanned by scanWebhook
+const webhookColumns = `ID, URL, SourceIDs, Keyword, Secret, CreatedAt`
+
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	var item Webhook
+	var ids string
+	if err := row.Scan(&item.ID, &item.URL, &ids, &item.Keyword, &item.Secret, &item.CreatedAt); err != nil {
+		return nil, err
+	}
+
+	var err error
+	item.SourceIDs, err = splitIDs(ids)
+
+	return &item, err
+}
+
+func readWebhooks(db *sql.DB) ([]*Webhook, error) {
+	defer observeQuery(db, "list_webhooks", time.Now())
+
+	rows, err := db.Query(`SELECT ` + webhookColumns + ` FROM webhooks ORDER BY ID`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*Webhook
+
+	for rows.Next() {
+		item, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, item)
+	}
+
+	return result, rows.Err()
+}
+
+func readWebhook(db *sql.DB, id int) (*Webhook, error) {
+	defer observeQuery(db, "get_webhook", time.Now())
+
+	item, err := scanWebhook(db.QueryRow(bind(db, `SELECT `+webhookColumns+` FROM webhooks WHERE ID = ?`), id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+
+	return item, err
+}
+
+// deleteWebhook deletes webhook with its delivery log
+func deleteWebhook(db *sql.DB, id int) error {
+	defer observeQuery(db, "delete_webhook", time.Now())
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(bind(db, `DELETE FROM webhooks WHERE ID = ?`), id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+
+	if _, err = tx.Exec(bind(db, `DELETE FROM webhook_deliveries WHERE WebhookID = ?`), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func writeWebhookDelivery(db *sql.DB, d *WebhookDelivery) error {
+	defer observeQuery(db, "add_webhook_delivery", time.Now())
+
+	if d == nil || d.Attempt < 1 {
+		return ErrIncorrectArgs
+	}
+
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+
+	query := `
+	INSERT INTO webhook_deliveries(
+		WebhookID,
+		NewsID,
+		Attempt,
+		Status,
+		Error,
+		Delivered,
+		CreatedAt
+	) SELECT ?, ?, ?, ?, ?, ?, ? WHERE EXISTS (SELECT 1 FROM webhooks WHERE ID = ?)
+	RETURNING ID;
+	`
+
+	err := db.QueryRow(bind(db, query), d.WebhookID, d.NewsID, d.Attempt, d.Status, d.Error, d.Delivered,
+		d.CreatedAt.UTC(), d.WebhookID).Scan(&d.ID)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// readWebhookDeliveries returns delivery log of webhook, the latest attempts go first
+func readWebhookDeliveries(db *sql.DB, webhookID int, offset, count int) ([]*WebhookDelivery, error) {
+	defer observeQuery(db, "get_webhook_deliveries", time.Now())
+
+	if offset < 0 || count < 0 {
+		return nil, ErrIncorrectArgs
+	}
+
+	if _, err := readWebhook(db, webhookID); err != nil {
+		return nil, err
+	}
+
+	query := `
+	SELECT ID, WebhookID, NewsID, Attempt, Status, Error, Delivered, CreatedAt FROM webhook_deliveries
+	WHERE WebhookID = ?
+	ORDER BY ID DESC
+	LIMIT ? OFFSET ?
+	`
+
+	rows, err := db.Query(bind(db, query), webhookID, count, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*WebhookDelivery
+
+	for rows.Next() {
+		var d WebhookDelivery
+		err = rows.Scan(&d.ID, &d.WebhookID, &d.NewsID, &d.Attempt, &d.Status, &d.Error, &d.Delivered, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, &d)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,226 @@
+package events
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHistory is a count of the latest events which subscribers may resume from
+const DefaultHistory = 1024
+
+// subscriptionBuffer is a count of events which may wait for a slow subscriber
+const subscriptionBuffer = 64
+
+// News is an event about news inserted by the feeder
+type News struct {
+	// ID is a sequence number of the event. It grows by one with every event
+	ID       int64           `json:"ID"`
+	NewsID   int             `json:"NewsID"`
+	SourceID int             `json:"SourceID"`
+	Source   string          `json:"Source"`
+	Title    string          `json:"Title"`
+	Payload  json.RawMessage `json:"Payload,omitempty"`
+	AddedAt  time.Time       `json:"AddedAt"`
+}
+
+// Filter selects events of subscription. Zero value filter selects all events
+type Filter struct {
+	SourceIDs []int
+	// Keyword is a substring of title or payload text, case is ignored
+	Keyword string
+}
+
+// Match checks whether event passes the filter
+func (f *Filter) Match(e *News) bool {
+	if len(f.SourceIDs) > 0 {
+		found := false
+		for _, id := range f.SourceIDs {
+			if id == e.SourceID {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if f.Keyword == "" {
+		return true
+	}
+
+	keyword := strings.ToLower(f.Keyword)
+	if strings.Contains(strings.ToLower(e.Title), keyword) {
+		return true
+	}
+
+	var payload interface{}
+	if json.Unmarshal(e.Payload, &payload) != nil {
+		return strings.Contains(strings.ToLower(string(e.Payload)), keyword)
+	}
+
+	return containsText(payload, keyword)
+}
+
+// containsText checks whether string values of JSON value contain lower case keyword
+func containsText(v interface{}, keyword string) bool {
+	switch v := v.(type) {
+	case string:
+		return strings.Contains(strings.ToLower(v), keyword)
+	case []interface{}:
+		for _, item := range v {
+			if containsText(item, keyword) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if containsText(item, keyword) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Bus delivers news events to subscribers. It keeps the latest events,
+// so subscribers may resume after reconnection without losing events.
+// Zero value isn't usable, use NewBus
+type Bus struct {
+	mut     sync.Mutex
+	lastID  int64
+	history []*News
+	// next is a position in history for the next event when history is full
+	next int
+	subs map[*Subscription]bool
+}
+
+// NewBus returns bus which keeps history of the latest events
+func NewBus(history int) *Bus {
+	if history < 0 {
+		history = 0
+	}
+
+	return &Bus{history: make([]*News, 0, history), subs: make(map[*Subscription]bool)}
+}
+
+// Publish assigns ID to the event and delivers it to subscribers. It never blocks:
+// subscriber which doesn't keep up is closed with Lagged set and may resume from its last event
+func (b *Bus) Publish(e News) *News {
+	if e.AddedAt.IsZero() {
+		e.AddedAt = time.Now().UTC()
+	}
+
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+
+	if cap(b.history) > 0 {
+		if len(b.history) < cap(b.history) {
+			b.history = append(b.history, &e)
+		} else {
+			b.history[b.next] = &e
+			b.next = (b.next + 1) % len(b.history)
+		}
+	}
+
+	for s := range b.subs {
+		if !s.filter.Match(&e) {
+			continue
+		}
+
+		select {
+		case s.c <- &e:
+		default:
+			s.lagged = true
+			b.unsubscribe(s)
+		}
+	}
+
+	return &e
+}
+
+// Subscribe returns subscription to events matching the filter. If lastID is positive,
+// events after it which are still kept in history are delivered first
+func (b *Bus) Subscribe(f Filter, lastID int64) *Subscription {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	var missed []*News
+	if lastID > 0 {
+		for i := range b.history {
+			e := b.history[(b.next+i)%len(b.history)]
+			if e.ID > lastID && f.Match(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	s := &Subscription{bus: b, filter: f, c: make(chan *News, len(missed)+subscriptionBuffer)}
+	for _, e := range missed {
+		s.c <- e
+	}
+
+	b.subs[s] = true
+
+	return s
+}
+
+// LastID returns ID of the last published event or 0
+func (b *Bus) LastID() int64 {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return b.lastID
+}
+
+// Subscribers returns count of open subscriptions
+func (b *Bus) Subscribers() int {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+
+	return len(b.subs)
+}
+
+// unsubscribe must be called under lock
+func (b *Bus) unsubscribe(s *Subscription) {
+	if b.subs[s] {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Subscription receives events of the bus until it's closed
+type Subscription struct {
+	bus    *Bus
+	filter Filter
+	c      chan *News
+	lagged bool
+}
+
+// Events returns channel of events. It's closed when subscription is closed
+func (s *Subscription) Events() <-chan *News {
+	return s.c
+}
+
+// Lagged checks whether subscription was closed by the bus because events weren't received in time
+func (s *Subscription) Lagged() bool {
+	s.bus.mut.Lock()
+	defer s.bus.mut.Unlock()
+
+	return s.lagged
+}
+
+// Close stops delivery of events
+func (s *Subscription) Close() {
+	s.bus.mut.Lock()
+	defer s.bus.mut.Unlock()
+
+	s.bus.unsubscribe(s)
+}
@@ -0,0 +1,107 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ids(events []*News) []int64 {
+	var result []int64
+	for _, e := range events {
+		result = append(result, e.ID)
+	}
+	return result
+}
+
+// receive returns events which are already delivered to subscription
+func receive(s *Subscription) []*News {
+	var result []*News
+	for {
+		select {
+		case e, ok := <-s.Events():
+			if !ok {
+				return result
+			}
+			result = append(result, e)
+		default:
+			return result
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	e := &News{SourceID: 2, Title: "Go release", Payload: []byte(`{"body":"New Generics","tags":["Compiler"],"n":"5"}`)}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{"empty", Filter{}, true},
+		{"source", Filter{SourceIDs: []int{1, 2}}, true},
+		{"other source", Filter{SourceIDs: []int{1}}, false},
+		{"title keyword", Filter{Keyword: "RELEASE"}, true},
+		{"payload keyword", Filter{Keyword: "generics"}, true},
+		{"nested payload keyword", Filter{Keyword: "compiler"}, true},
+		{"payload keys are ignored", Filter{Keyword: "body"}, false},
+		{"source and keyword", Filter{SourceIDs: []int{2}, Keyword: "rust"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.filter.Match(e))
+		})
+	}
+}
+
+func TestBus(t *testing.T) {
+	b := NewBus(3)
+
+	all := b.Subscribe(Filter{}, 0)
+	second := b.Subscribe(Filter{SourceIDs: []int{2}}, 0)
+
+	for i := 1; i <= 5; i++ {
+		e := b.Publish(News{NewsID: i, SourceID: i % 2 * 2})
+		assert.Equal(t, int64(i), e.ID)
+		assert.False(t, e.AddedAt.IsZero())
+	}
+
+	assert.Equal(t, []int64{1, 2, 3, 4, 5}, ids(receive(all)))
+	assert.Equal(t, []int64{1, 3, 5}, ids(receive(second)))
+
+	resumed := b.Subscribe(Filter{}, 2)
+	assert.Equal(t, []int64{3, 4, 5}, ids(receive(resumed)), "events after the last one should be delivered")
+
+	lost := b.Subscribe(Filter{}, 1)
+	assert.Equal(t, []int64{3, 4, 5}, ids(receive(lost)), "only events kept in history can be delivered")
+
+	b.Publish(News{NewsID: 6})
+	assert.Equal(t, []int64{6}, ids(receive(resumed)))
+	assert.Equal(t, int64(6), b.LastID())
+	assert.Equal(t, 4, b.Subscribers())
+
+	all.Close()
+	assert.Equal(t, 3, b.Subscribers())
+	b.Publish(News{NewsID: 7})
+	assert.Equal(t, []int64{6}, ids(receive(all)), "closed subscription should receive nothing new")
+	_, ok := <-all.Events()
+	assert.False(t, ok)
+	assert.False(t, all.Lagged())
+}
+
+func TestBusLagged(t *testing.T) {
+	b := NewBus(DefaultHistory)
+	slow := b.Subscribe(Filter{}, 0)
+
+	for i := 0; i < subscriptionBuffer+1; i++ {
+		b.Publish(News{NewsID: i})
+	}
+
+	assert.Len(t, receive(slow), subscriptionBuffer)
+	assert.True(t, slow.Lagged(), "subscriber which doesn't keep up should be closed")
+	slow.Close()
+
+	resumed := b.Subscribe(Filter{}, subscriptionBuffer)
+	assert.Equal(t, []int64{subscriptionBuffer + 1}, ids(receive(resumed)))
+}
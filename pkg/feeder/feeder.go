@@ -1,126 +1,492 @@
 package feeder
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
 	"strings"
 	"time"
 
+	"github.com/bsbsm/feeder/pkg/events"
+	"github.com/bsbsm/feeder/pkg/metrics"
 	"github.com/mmcdole/gofeed"
 )
 
 var ErrEmptyRule = errors.New("Parsing rule is empty")
 
+// ErrAlreadyExists is returned by FeedStorage when news with the same GUID is already saved
+var ErrAlreadyExists = errors.New("Already exists")
+
+const (
+	defaultWorkers        = 4
+	defaultPerHostWorkers = 1
+	fetchTimeout          = 30 * time.Second
+)
+
 func NewFeeder(s FeedStorage) (*Feeder, error) {
 	if s == nil || reflect.ValueOf(s).IsNil() {
 		return nil, errors.New("FeedStorage is nil")
 	}
 
-	return &Feeder{storage: s}, nil
+	return &Feeder{
+		storage:     s,
+		fetcher:     newFetcher(),
+		workers:     defaultWorkers,
+		perHost:     defaultPerHostWorkers,
+		maxFailures: defaultMaxFailures,
+	}, nil
 }
 
 type FeedStorage interface {
-	CreateNews(sourceID int, title string, payloadJSON []byte) error
+	// CreateNews saves news identified by GUID within the source or updates it if its
+	// content is changed. Returns ID of news and whether it was updated.
+	// Returns ErrAlreadyExists if the source already has the same news
+	CreateNews(sourceID int, guid, title string, payloadJSON []byte, published time.Time) (int, bool, error)
 	GetFeedSources() ([]*FeedSource, error)
+	// UpdateFeedSourceCache saves HTTP cache validators of the last feed response
+	UpdateFeedSourceCache(sourceID int, etag, lastModified string) error
+	// RecordFeedSourceReading applies outcome of the reading to the stored health of the source
+	// and returns the resulting health
+	RecordFeedSourceReading(r *FeedSourceReading) (*FeedSourceHealth, error)
 }
 
 type FeedSource struct {
 	Rule map[string]string
 	URL  string
 	ID   int
+	// Interval is a period between readings. Zero means the feed's own hint or the default period
+	Interval time.Duration
+	// Filter decides which items are saved, nil filter keeps every item
+	Filter *ItemFilter
+	// ETag and LastModified are validators of the last feed response
+	ETag         string
+	LastModified string
+	Health       FeedSourceHealth
 }
 
+// ImplementRule parses the rule into selectors of item values and names of payload fields.
+// It returns the first error of the rule. See rule.go for the syntax
 func ImplementRule(s *FeedSource, rule string) error {
-	if rule == "" {
-		return ErrEmptyRule
+	if errs := ValidateRule(rule); len(errs) > 0 {
+		return errs[0].Err
+	}
+
+	fields, err := splitRule(rule)
+	if err != nil {
+		return err
 	}
 
-	pairs := strings.Split(rule, ",")
-	if len(pairs) == 0 {
-		return ErrEmptyRule
+	result := make(map[string]string, len(fields))
+	for _, f := range fields {
+		result[f.expr] = f.name
 	}
 
-	s.Rule = make(map[string]string)
+	s.Rule = result
+
+	return nil
+}
+
+// RuleError is an error of a rule field or a filter condition
+type RuleError struct {
+	// Expr is the incorrect field or condition. It's empty if the whole text is incorrect, e.g. it's empty
+	Expr string
+	Err  error
+}
+
+func (e *RuleError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
 
-	for _, p := range pairs {
-		nameAndValue := strings.SplitN(p, "=", 2)
+// ValidateRule checks the rule and returns errors of all its incorrect fields
+func ValidateRule(rule string) []*RuleError {
+	if strings.TrimSpace(rule) == "" {
+		return []*RuleError{{Err: ErrEmptyRule}}
+	}
 
-		switch len(nameAndValue) {
-		case 2:
-			s.Rule[nameAndValue[0]] = nameAndValue[1]
-		case 1:
-			s.Rule[nameAndValue[0]] = nameAndValue[0]
+	fields, err := splitRule(rule)
+	if err != nil {
+		return []*RuleError{{Err: err}}
+	}
+
+	if len(fields) == 0 {
+		return []*RuleError{{Err: ErrEmptyRule}}
+	}
+
+	var errs []*RuleError
+	for _, f := range fields {
+		if _, err = parseExpr(f.expr); err != nil {
+			errs = append(errs, &RuleError{Expr: f.expr, Err: err})
 		}
 	}
 
-	return nil
+	return errs
 }
 
 type Feeder struct {
 	storage FeedStorage
+	fetcher *fetcher
 	sources []*FeedSource
+	workers int
+	perHost int
+	// maxFailures is a count of consecutive failures after which source is disabled
+	maxFailures int
+	// bus receives inserted news if it's set
+	bus *events.Bus
+}
+
+// SetConcurrency sets how many feeds may be read simultaneously in total and from one host
+func (f *Feeder) SetConcurrency(workers, perHost int) {
+	f.workers = workers
+	f.perHost = perHost
 }
 
-func (f *Feeder) Reading(period time.Duration) {
+// SetMaxFailures sets a count of consecutive failed readings after which
+// feed source is disabled. Zero means sources are never disabled
+func (f *Feeder) SetMaxFailures(n int) {
+	f.maxFailures = n
+}
+
+// SetEventBus sets bus which newly inserted news are published to
+func (f *Feeder) SetEventBus(b *events.Bus) {
+	f.bus = b
+}
+
+// Reading reads every feed source on its own interval. Sources without an interval
+// are read with the period advertised by the feed or with the default period.
+// Failing sources are read with exponential backoff.
+// The list of sources is refreshed from the storage every period.
+// Reading returns when ctx is done and in-flight readings are finished or canceled
+func (f *Feeder) Reading(ctx context.Context, period time.Duration) {
+	p := newPool(f.workers, f.perHost)
+	sch := newScheduler()
+	done := make(chan *readResult)
+
+	var refreshAt time.Time
+
 	for {
-		for _, s := range f.sources {
-			f.readFeed(s)
+		now := time.Now()
+
+		if !now.Before(refreshAt) {
+			f.refreshSources()
+			sch.update(f.sources, now)
+			refreshAt = now.Add(period)
 		}
 
-		newSources, err := f.storage.GetFeedSources()
-		if err != nil {
-			fmt.Println("Feed reading: error while get feed sources. Use cache")
+		for _, e := range sch.due(now) {
+			e := e
+			s := e.source
+			p.run(sourceHost(s), func() {
+				if ctx.Err() != nil {
+					return
+				}
+
+				start := time.Now()
+				r := f.readFeed(ctx, s)
+				if ctx.Err() != nil {
+					// reading was canceled, it isn't a failure of the source
+					return
+				}
+				observeFetch(s, start, r.status, r.err)
+
+				r.entry = e
+				select {
+				case done <- r:
+				case <-ctx.Done():
+				}
+			})
 		}
 
-		if len(newSources) > 0 {
-			f.sources = newSources
+		timer := time.NewTimer(sch.wait(now, refreshAt.Sub(now)))
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			p.wait()
+			return
+		case r := <-done:
+			timer.Stop()
+			f.finishReading(sch, r, period)
+		case <-timer.C:
 		}
+	}
+}
+
+// readResult is an outcome of the source reading which is sent by worker to the scheduling loop.
+// Hint is an update period which the feed advertises, it's 0 if the feed wasn't read or has no hints
+type readResult struct {
+	entry  *scheduledSource
+	hint   time.Duration
+	status int
+	// filtered is a count of items which the filter dropped
+	filtered int
+	err      error
+}
 
-		time.Sleep(period)
+// finishReading records health of the read source and returns it to the schedule. Outcome is dropped
+// if the source became a new feed while it was read, so it doesn't overwrite the state of the new feed
+func (f *Feeder) finishReading(sch *scheduler, r *readResult, period time.Duration) {
+	e := r.entry
+
+	if !sch.finish(e) {
+		sch.reschedule(e, time.Now())
+		return
+	}
+
+	if r.hint > 0 {
+		e.hint = r.hint
+	}
+	e.failures, e.disabled = f.recordHealth(e.source, r)
+
+	if e.removed {
+		// metrics of the source were forgotten while it was read, the reading mustn't bring them back
+		// unless the source is scheduled again
+		if _, exist := sch.entries[e.source.ID]; !exist {
+			metrics.ForgetSource(e.source.ID)
+		}
+	} else if e.disabled {
+		fmt.Printf("Feed '%s' is disabled after %d failures\n", e.source.URL, e.failures)
+		sch.remove(e)
+	} else {
+		sch.reschedule(e, time.Now().Add(backoff(e.interval(period), e.failures)))
 	}
 }
 
-var fp = gofeed.NewParser()
+// refreshSources loads feed sources from storage. Cached sources stay in use if loading failed
+func (f *Feeder) refreshSources() {
+	newSources, err := f.storage.GetFeedSources()
+	if err != nil {
+		fmt.Println("Feed reading: error while get feed sources. Use cache")
+		return
+	}
+
+	f.sources = newSources
+
+	for _, s := range f.sources {
+		metrics.SetLastSuccess(s.ID, s.Health.LastSuccess)
+	}
+}
+
+// observeFetch records result and duration of the source reading started at start
+func observeFetch(s *FeedSource, start time.Time, status int, err error) {
+	source := metrics.Source(s.ID)
+	metrics.FetchDuration.WithLabelValues(source).Observe(time.Since(start).Seconds())
+
+	result := "ok"
+	switch {
+	case err != nil:
+		result = "error"
+	case status == http.StatusNotModified:
+		result = "not_modified"
+	}
+	metrics.Fetches.WithLabelValues(source, result).Inc()
+
+	if err == nil {
+		metrics.SetLastSuccess(s.ID, time.Now())
+	}
+}
+
+// recordHealth saves the outcome of the source reading and returns
+// count of consecutive failures and whether the source is disabled
+func (f *Feeder) recordHealth(s *FeedSource, r *readResult) (int, bool) {
+	reading := &FeedSourceReading{SourceID: s.ID, At: time.Now(), Status: r.status, Filtered: r.filtered,
+		MaxFailures: f.maxFailures}
+	if r.err != nil {
+		reading.Error = r.err.Error()
+	}
+
+	h, err := f.storage.RecordFeedSourceReading(reading)
+	if err != nil {
+		fmt.Printf("Error while save feed '%s' health: %s\n", s.URL, err)
+
+		s.Health.SourceID = s.ID
+		s.Health.Apply(reading)
+	} else {
+		s.Health = *h
+	}
+
+	return s.Health.Failures, s.Health.Disabled
+}
 
-func (f *Feeder) readFeed(s *FeedSource) {
+// readFeed saves news of the feed and returns outcome of the reading
+func (f *Feeder) readFeed(ctx context.Context, s *FeedSource) *readResult {
 	if len(s.Rule) == 0 {
-		return
+		return &readResult{err: ErrEmptyRule}
+	}
+
+	res, err := f.fetcher.fetch(ctx, s)
+	if err != nil {
+		fmt.Printf("Error while feed '%s' reading: %s\n", s.URL, err)
+
+		if res != nil {
+			return &readResult{status: res.status, err: err}
+		}
+		return &readResult{err: err}
+	}
+
+	result := &readResult{status: res.status}
+	if res.notModified() {
+		f.saveValidators(s, res)
+		return result
 	}
 
-	feed, _ := fp.ParseURL(s.URL)
+	source := metrics.Source(s.ID)
+
+	now := time.Now()
+
+	for _, item := range res.feed.Items {
+		if err := ctx.Err(); err != nil {
+			// validators aren't saved, so the rest of items is read next time
+			result.err = err
+			return result
+		}
 
-	for _, item := range feed.Items {
-		payloadToSave, err := parseFeedItem(item, s.Rule)
+		tctx := &TransformContext{Item: item, FeedLink: res.feed.Link}
 
+		fields, err := itemFields(item)
 		if err != nil {
 			fmt.Printf("Error while feed reading: %s\n", err)
+			metrics.Items.WithLabelValues(source, metrics.ItemFailed).Inc()
+			continue
 		}
 
-		if err := f.storage.CreateNews(s.ID, item.Title, payloadToSave); err != nil &&
-			!strings.HasPrefix(err.Error(), "UNIQUE") {
+		if s.Filter != nil && !s.Filter.Match(fields, tctx, now) {
+			result.filtered++
+			metrics.Items.WithLabelValues(source, metrics.ItemFiltered).Inc()
+			continue
+		}
+
+		payloadToSave, err := extractFields(fields, tctx, s.Rule)
+
+		if err != nil {
+			fmt.Printf("Error while feed reading: %s\n", err)
+		}
+		metrics.Items.WithLabelValues(source, metrics.ItemParsed).Inc()
+
+		id, updated, err := f.storage.CreateNews(s.ID, itemGUID(item), item.Title, payloadToSave, itemPublished(item))
+		switch {
+		case errors.Is(err, ErrAlreadyExists):
+			metrics.Items.WithLabelValues(source, metrics.ItemDuplicated).Inc()
+		case err != nil:
 			fmt.Printf("Error while create news: %s\n", err)
+			metrics.Items.WithLabelValues(source, metrics.ItemFailed).Inc()
+		case updated:
+			metrics.Items.WithLabelValues(source, metrics.ItemUpdated).Inc()
+		default:
+			metrics.Items.WithLabelValues(source, metrics.ItemInserted).Inc()
+			if f.bus != nil {
+				f.bus.Publish(events.News{NewsID: id, SourceID: s.ID, Source: s.URL, Title: item.Title, Payload: payloadToSave})
+			}
 		}
 	}
+
+	result.hint = updateHint(res.feed)
+
+	// validators are saved after news, so news aren't lost if reading is interrupted
+	f.saveValidators(s, res)
+
+	return result
+}
+
+// saveValidators stores cache validators of the response if they were changed
+func (f *Feeder) saveValidators(s *FeedSource, res *fetchResult) {
+	if res.etag == s.ETag && res.lastModified == s.LastModified {
+		return
+	}
+
+	if err := f.storage.UpdateFeedSourceCache(s.ID, res.etag, res.lastModified); err != nil {
+		fmt.Printf("Error while save feed '%s' cache validators: %s\n", s.URL, err)
+		return
+	}
+
+	s.ETag, s.LastModified = res.etag, res.lastModified
+}
+
+// itemPublished returns publication time of the item, its update time or zero time if both are unknown
+func itemPublished(item *gofeed.Item) time.Time {
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed
+	}
+
+	if item.UpdatedParsed != nil {
+		return *item.UpdatedParsed
+	}
+
+	return time.Time{}
 }
 
+// itemGUID returns identity of the item within its feed: GUID, link or hash of the content
+func itemGUID(item *gofeed.Item) string {
+	if item.GUID != "" {
+		return item.GUID
+	}
+
+	if item.Link != "" {
+		return item.Link
+	}
+
+	h := sha256.New()
+	for _, s := range []string{item.Title, item.Description, item.Content, item.Published} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// parseFeedItem returns payload with item values selected by the rule
 func parseFeedItem(item *gofeed.Item, rules map[string]string) ([]byte, error) {
-	payload, err := json.Marshal(item)
+	return parseItem(&TransformContext{Item: item}, rules)
+}
 
+// parseItem returns payload with item values selected and transformed by the rule
+func parseItem(ctx *TransformContext, rules map[string]string) ([]byte, error) {
+	fields, err := itemFields(ctx.Item)
 	if err != nil {
 		return nil, err
 	}
 
-	var fields map[string]*json.RawMessage
-	if err := json.Unmarshal(payload, &fields); err != nil {
+	return extractFields(fields, ctx, rules)
+}
+
+// itemFields returns JSON value of the item which rules and filters select values from
+func itemFields(item *gofeed.Item) (interface{}, error) {
+	payload, err := json.Marshal(item)
+	if err != nil {
 		return nil, err
 	}
 
+	return decodeJSON(payload)
+}
+
+// extractFields returns payload with values of item fields selected and transformed by the rule.
+// Missing and null values are skipped, so are values of expressions which can't be parsed or applied
+func extractFields(fields interface{}, ctx *TransformContext, rules map[string]string) ([]byte, error) {
 	objFields := make(map[string]interface{})
 
+	var exprErr error
 	for k, newK := range rules {
-		if val, exist := fields[strings.ToLower(k)]; exist && val != nil {
+		e, err := parseExpr(k)
+		if err != nil {
+			exprErr = err
+			continue
+		}
+
+		val, exist, err := e.apply(fields, ctx)
+		if err != nil {
+			exprErr = fmt.Errorf("field '%s': %w", newK, err)
+			continue
+		}
+
+		if exist {
 			objFields[newK] = val
 		}
 	}
@@ -130,5 +496,5 @@ func parseFeedItem(item *gofeed.Item, rules map[string]string) ([]byte, error) {
 		return nil, err
 	}
 
-	return resultPayload, nil
+	return resultPayload, exprErr
 }
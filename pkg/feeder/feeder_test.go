@@ -1,11 +1,21 @@
 package feeder
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/bsbsm/feeder/pkg/events"
+	"github.com/bsbsm/feeder/pkg/metrics"
 	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -103,3 +113,613 @@ func TestReadFeed(t *testing.T) {
 		})
 	}
 }
+
+func TestPool(t *testing.T) {
+	tests := []struct {
+		name        string
+		workers     int
+		perHost     int
+		hosts       []string
+		wantMax     int
+		wantHostMax int
+	}{
+		{
+			name:        "limited by workers",
+			workers:     2,
+			perHost:     2,
+			hosts:       []string{"a", "b", "c", "d", "e", "f"},
+			wantMax:     2,
+			wantHostMax: 1,
+		},
+		{
+			name:        "limited by host",
+			workers:     4,
+			perHost:     1,
+			hosts:       []string{"a", "a", "a", "a"},
+			wantMax:     1,
+			wantHostMax: 1,
+		},
+		{
+			name:        "slow host doesn't block others",
+			workers:     3,
+			perHost:     1,
+			hosts:       []string{"a", "a", "a", "b", "c"},
+			wantMax:     3,
+			wantHostMax: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPool(tt.workers, tt.perHost)
+
+			var mut sync.Mutex
+			var running, maxRunning, maxHostRunning int
+			hostRunning := make(map[string]int)
+
+			for _, h := range tt.hosts {
+				h := h
+				p.run(h, func() {
+					mut.Lock()
+					running++
+					hostRunning[h]++
+					if running > maxRunning {
+						maxRunning = running
+					}
+					if hostRunning[h] > maxHostRunning {
+						maxHostRunning = hostRunning[h]
+					}
+					mut.Unlock()
+
+					time.Sleep(10 * time.Millisecond)
+
+					mut.Lock()
+					running--
+					hostRunning[h]--
+					mut.Unlock()
+				})
+			}
+			p.wait()
+
+			assert.Equal(t, tt.wantMax, maxRunning, "pool ran unexpected count of jobs simultaneously")
+			assert.Equal(t, tt.wantHostMax, maxHostRunning, "pool ran unexpected count of host jobs simultaneously")
+			assert.Empty(t, p.hosts, "hosts without jobs must be forgotten")
+		})
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	now := time.Now()
+
+	fast := &FeedSource{ID: 1, URL: "http://a", Interval: time.Minute}
+	slow := &FeedSource{ID: 2, URL: "http://b", Interval: time.Hour}
+	hinted := &FeedSource{ID: 3, URL: "http://c"}
+
+	sch := newScheduler()
+	sch.update([]*FeedSource{fast, slow, hinted}, now)
+
+	due := sch.due(now)
+	assert.Len(t, due, 3, "new sources should be read immediately")
+	assert.Equal(t, time.Hour, sch.wait(now, time.Hour), "empty queue should wait max duration")
+
+	for _, e := range due {
+		if e.source == hinted {
+			e.hint = 10 * time.Minute
+		}
+		sch.reschedule(e, now.Add(e.interval(24*time.Hour)))
+	}
+
+	assert.Equal(t, time.Minute, sch.wait(now, 24*time.Hour))
+
+	due = sch.due(now.Add(15 * time.Minute))
+	if assert.Len(t, due, 2) {
+		assert.Equal(t, fast, due[0].source)
+		assert.Equal(t, hinted, due[1].source)
+	}
+
+	sch.update([]*FeedSource{fast}, now)
+	for _, e := range due {
+		sch.reschedule(e, now.Add(e.interval(24*time.Hour)))
+	}
+
+	assert.Len(t, sch.queue, 1, "removed sources should leave the queue")
+	assert.Len(t, sch.due(now.Add(2*time.Hour)), 1)
+
+	sch.update([]*FeedSource{slow}, now)
+	sch.reschedule(sch.due(now)[0], now.Add(time.Hour))
+
+	moved := &FeedSource{ID: 2, URL: "http://moved", Interval: time.Hour}
+	sch.update([]*FeedSource{moved}, now)
+	if due = sch.due(now); assert.Len(t, due, 1, "source with changed URL should be read immediately") {
+		assert.Equal(t, moved, due[0].source)
+	}
+}
+
+func TestUpdateHint(t *testing.T) {
+	tests := []struct {
+		name string
+		feed *gofeed.Feed
+		want time.Duration
+	}{
+		{
+			name: "no hints",
+			feed: &gofeed.Feed{},
+			want: 0,
+		},
+		{
+			name: "ttl",
+			feed: &gofeed.Feed{Custom: map[string]string{ttlCustomKey: "60"}},
+			want: time.Hour,
+		},
+		{
+			name: "syndication period with frequency",
+			feed: &gofeed.Feed{Extensions: ext.Extensions{"sy": {
+				"updatePeriod":    {{Value: "daily"}},
+				"updateFrequency": {{Value: "4"}},
+			}}},
+			want: 6 * time.Hour,
+		},
+		{
+			name: "unknown syndication period",
+			feed: &gofeed.Feed{Extensions: ext.Extensions{"sy": {
+				"updatePeriod": {{Value: "sometimes"}},
+			}}},
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, updateHint(tt.feed))
+		})
+	}
+}
+
+type fakeStorage struct {
+	mut     sync.Mutex
+	news    []string
+	sources []*FeedSource
+	etags   map[int]string
+	states  map[int]FeedSourceHealth
+	health  []FeedSourceHealth
+}
+
+func (s *fakeStorage) CreateNews(sourceID int, guid, title string, payloadJSON []byte, published time.Time) (int, bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for i, t := range s.news {
+		if t == title {
+			return i + 1, false, ErrAlreadyExists
+		}
+	}
+
+	s.news = append(s.news, title)
+	return len(s.news), false, nil
+}
+
+func (s *fakeStorage) GetFeedSources() ([]*FeedSource, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return s.sources, nil
+}
+
+// setSources replaces feed sources which are read by the feeder
+func (s *fakeStorage) setSources(sources ...*FeedSource) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.sources = sources
+}
+
+// savedHealth returns states of readings saved by the feeder
+func (s *fakeStorage) savedHealth() []FeedSourceHealth {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	return append([]FeedSourceHealth(nil), s.health...)
+}
+
+func (s *fakeStorage) UpdateFeedSourceCache(sourceID int, etag, lastModified string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.etags == nil {
+		s.etags = make(map[int]string)
+	}
+	s.etags[sourceID] = etag
+	return nil
+}
+
+func (s *fakeStorage) RecordFeedSourceReading(r *FeedSourceReading) (*FeedSourceHealth, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.states == nil {
+		s.states = make(map[int]FeedSourceHealth)
+	}
+
+	h := s.states[r.SourceID]
+	h.SourceID = r.SourceID
+	h.Apply(r)
+	s.states[r.SourceID] = h
+
+	s.health = append(s.health, h)
+	return &h, nil
+}
+
+const testRSS = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+<channel>
+	<title>test</title>
+	<ttl>30</ttl>
+	<item><title>title 1</title><guid>g-u-id-1</guid></item>
+	<item><title>title 2</title><guid>g-u-id-2</guid></item>
+</channel>
+</rss>`
+
+func TestReadFeedConditional(t *testing.T) {
+	const etag = `"v1"`
+
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(testRSS))
+	}))
+	defer srv.Close()
+
+	storage := &fakeStorage{}
+	f, err := NewFeeder(storage)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s := &FeedSource{ID: 1, URL: srv.URL, Rule: map[string]string{"Title": "title"}}
+
+	r := f.readFeed(context.Background(), s)
+	assert.NoError(t, r.err)
+	assert.Equal(t, http.StatusOK, r.status)
+	assert.Equal(t, 30*time.Minute, r.hint, "Feeder.readFeed returned unexpected hint")
+	assert.Equal(t, []string{"title 1", "title 2"}, storage.news)
+	assert.Equal(t, etag, storage.etags[1], "Feeder.readFeed didn't save ETag")
+	assert.Equal(t, etag, s.ETag)
+
+	r = f.readFeed(context.Background(), s)
+	assert.NoError(t, r.err)
+	assert.Equal(t, http.StatusNotModified, r.status)
+	assert.Equal(t, time.Duration(0), r.hint)
+	assert.Len(t, storage.news, 2, "not modified feed shouldn't be saved again")
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, notModified)
+}
+
+func TestReadFeedFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	storage := &fakeStorage{}
+	f, err := NewFeeder(storage)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s := &FeedSource{ID: 1, URL: srv.URL, Rule: map[string]string{"Title": "title"}}
+
+	r := f.readFeed(context.Background(), s)
+	assert.Error(t, r.err)
+	assert.Equal(t, http.StatusInternalServerError, r.status)
+	assert.Empty(t, storage.news)
+
+	failures, disabled := f.recordHealth(s, r)
+	assert.Equal(t, 1, failures)
+	assert.False(t, disabled)
+	assert.Equal(t, storage.savedHealth()[0], s.Health, "health should be taken from the storage")
+}
+
+// cancelingStorage cancels reading after the first saved news
+type cancelingStorage struct {
+	*fakeStorage
+	cancel context.CancelFunc
+}
+
+func (s *cancelingStorage) CreateNews(sourceID int, guid, title string, payloadJSON []byte, published time.Time) (int, bool, error) {
+	s.cancel()
+	return s.fakeStorage.CreateNews(sourceID, guid, title, payloadJSON, published)
+}
+
+func TestReadFeedCancel(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(testRSS))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	storage := &cancelingStorage{fakeStorage: &fakeStorage{}, cancel: cancel}
+	f, err := NewFeeder(storage)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	s := &FeedSource{ID: 1, URL: srv.URL, Rule: map[string]string{"Title": "title"}}
+
+	r := f.readFeed(ctx, s)
+	assert.ErrorIs(t, r.err, context.Canceled)
+	assert.Equal(t, []string{"title 1"}, storage.news, "items after cancellation shouldn't be saved")
+	assert.Empty(t, storage.etags, "validators of partially read feed shouldn't be saved")
+	assert.Empty(t, s.ETag)
+}
+
+func TestHealth(t *testing.T) {
+	now := time.Now()
+	fetchErr := errors.New("fetch error")
+
+	var h FeedSourceHealth
+
+	failed := &FeedSourceReading{At: now, Status: http.StatusInternalServerError, Error: fetchErr.Error(),
+		Filtered: 1, MaxFailures: 3}
+	h.Apply(failed)
+	h.Apply(&FeedSourceReading{At: now, Error: fetchErr.Error(), MaxFailures: 3})
+	assert.Equal(t, 2, h.Failures)
+	assert.Equal(t, "fetch error", h.LastError)
+	assert.True(t, h.LastSuccess.IsZero())
+	assert.False(t, h.Disabled)
+	assert.Equal(t, 1, h.Filtered)
+
+	h.Apply(&FeedSourceReading{At: now, Status: http.StatusOK, Filtered: 2, MaxFailures: 3})
+	assert.Equal(t, 0, h.Failures)
+	assert.Equal(t, now, h.LastSuccess)
+	assert.Empty(t, h.LastError)
+	assert.Equal(t, 3, h.Filtered, "filtered items of readings should be summed")
+
+	for i := 0; i < 3; i++ {
+		h.Apply(&FeedSourceReading{At: now, Status: http.StatusNotFound, Error: fetchErr.Error(), MaxFailures: 3})
+	}
+	assert.True(t, h.Disabled, "source should be disabled after max failures")
+	assert.Equal(t, http.StatusNotFound, h.LastStatus)
+
+	assert.Equal(t, time.Minute, backoff(time.Minute, 0))
+	assert.Equal(t, 8*time.Minute, backoff(time.Minute, 3))
+	assert.Equal(t, maxBackoff, backoff(time.Minute, 100))
+	assert.Equal(t, 48*time.Hour, backoff(48*time.Hour, 2), "long interval shouldn't be shortened")
+}
+
+func TestReadingCancel(t *testing.T) {
+	requested := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	storage := &fakeStorage{
+		sources: []*FeedSource{{ID: 1, URL: srv.URL, Rule: map[string]string{"Title": "title"}}},
+	}
+	f, err := NewFeeder(storage)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		f.Reading(ctx, time.Hour)
+		close(stopped)
+	}()
+
+	<-requested
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("Feeder.Reading didn't return after context cancellation")
+	}
+}
+
+func TestReadingSourceChanged(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	movedRead := make(chan struct{}, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		select {
+		case movedRead <- struct{}{}:
+		default:
+		}
+		w.Write([]byte(testRSS))
+	}))
+	defer srv.Close()
+
+	rule := map[string]string{"Title": "title"}
+	storage := &fakeStorage{}
+	storage.setSources(&FeedSource{ID: 1, URL: srv.URL + "/old", Rule: rule, Interval: time.Hour})
+
+	f, err := NewFeeder(storage)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		f.Reading(ctx, 10*time.Millisecond)
+		close(stopped)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	<-started
+	// the source is changed while its old feed is being read, the scheduler picks it up on refresh
+	storage.setSources(&FeedSource{ID: 1, URL: srv.URL + "/moved", Rule: rule, Interval: time.Hour,
+		Health: FeedSourceHealth{SourceID: 1}})
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-movedRead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("changed source wasn't read immediately after the old reading")
+	}
+
+	assert.Eventually(t, func() bool { return len(storage.savedHealth()) > 0 }, 5*time.Second, 10*time.Millisecond)
+	for _, h := range storage.savedHealth() {
+		assert.Equal(t, 0, h.Failures, "failure of the old feed must not be recorded for the changed source")
+		assert.NotEqual(t, http.StatusInternalServerError, h.LastStatus)
+	}
+}
+
+func TestSchedulerPending(t *testing.T) {
+	now := time.Now()
+	src := &FeedSource{ID: 1, URL: "http://a", Interval: time.Minute}
+
+	sch := newScheduler()
+	sch.update([]*FeedSource{src}, now)
+	e := sch.due(now)[0]
+	e.source.ETag = `"v2"`
+
+	// health is reset while the source is read
+	longer := &FeedSource{ID: 1, URL: "http://a", Interval: time.Hour}
+	src.Health.Filtered = 2
+	sch.update([]*FeedSource{longer}, now)
+	assert.Equal(t, src, e.source, "source being read must not be changed")
+
+	assert.True(t, sch.finish(e))
+	assert.Equal(t, longer, e.source)
+	assert.Equal(t, `"v2"`, longer.ETag, "validators saved by the reading should be kept")
+	assert.Equal(t, 0, longer.Health.Filtered, "refreshed health should be kept")
+
+	sch.reschedule(e, now.Add(time.Hour))
+	e = sch.due(now.Add(time.Hour))[0]
+	e.hint = time.Minute
+
+	filtered := &FeedSource{ID: 1, URL: "http://a", Interval: time.Hour, Health: FeedSourceHealth{Failures: 1}}
+	assert.NoError(t, ImplementFilter(filtered, `exclude title ~ ad`))
+	sch.update([]*FeedSource{filtered}, now)
+
+	assert.False(t, sch.finish(e), "source with changed filter is a new feed")
+	assert.Equal(t, filtered, e.source)
+	assert.Equal(t, time.Duration(0), e.hint)
+	assert.Equal(t, 1, e.failures)
+	assert.True(t, sch.finish(e), "pending source should be applied once")
+}
+
+func TestSchedulerRemoveMetrics(t *testing.T) {
+	now := time.Now()
+
+	// metrics are global, so source ID is unique to the test
+	src := &FeedSource{ID: 1003, URL: "http://a", Interval: time.Minute}
+	observeFetch(src, now, http.StatusOK, nil)
+
+	sch := newScheduler()
+	sch.update([]*FeedSource{src}, now)
+	sch.update(nil, now)
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.Fetches.WithLabelValues("1003", "ok")),
+		"series of removed source should be forgotten")
+}
+
+func TestItemGUID(t *testing.T) {
+	assert.Equal(t, "g-u-id-1", itemGUID(&gofeed.Item{GUID: "g-u-id-1", Link: "http://a/1"}))
+	assert.Equal(t, "http://a/1", itemGUID(&gofeed.Item{Link: "http://a/1"}))
+
+	hashed := itemGUID(&gofeed.Item{Title: "title 1", Description: "body"})
+	assert.True(t, strings.HasPrefix(hashed, "sha256:"))
+	assert.Equal(t, hashed, itemGUID(&gofeed.Item{Title: "title 1", Description: "body"}))
+	assert.NotEqual(t, hashed, itemGUID(&gofeed.Item{Title: "title 1", Description: "other body"}))
+}
+
+func TestItemPublished(t *testing.T) {
+	published := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	updated := published.Add(time.Hour)
+
+	assert.Equal(t, published, itemPublished(&gofeed.Item{PublishedParsed: &published, UpdatedParsed: &updated}))
+	assert.Equal(t, updated, itemPublished(&gofeed.Item{UpdatedParsed: &updated}))
+	assert.True(t, itemPublished(&gofeed.Item{}).IsZero())
+}
+
+func TestReadFeedEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRSS))
+	}))
+	defer srv.Close()
+
+	f, err := NewFeeder(&fakeStorage{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	bus := events.NewBus(events.DefaultHistory)
+	f.SetEventBus(bus)
+	sub := bus.Subscribe(events.Filter{}, 0)
+	defer sub.Close()
+
+	s := &FeedSource{ID: 3, URL: srv.URL, Rule: map[string]string{"Title": "title"}}
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, f.readFeed(context.Background(), s).err)
+	}
+
+	assert.Equal(t, int64(2), bus.LastID(), "only inserted news should be published")
+
+	for _, want := range []string{"title 1", "title 2"} {
+		e := <-sub.Events()
+		assert.Equal(t, want, e.Title)
+		assert.Equal(t, 3, e.SourceID)
+		assert.Equal(t, srv.URL, e.Source)
+		assert.JSONEq(t, `{"title":"`+want+`"}`, string(e.Payload))
+	}
+}
+
+func TestReadFeedMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRSS))
+	}))
+	defer srv.Close()
+
+	f, err := NewFeeder(&fakeStorage{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// metrics are global, so source ID is unique to the test
+	s := &FeedSource{ID: 1001, URL: srv.URL, Rule: map[string]string{"Title": "title"}}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		r := f.readFeed(context.Background(), s)
+		observeFetch(s, start, r.status, r.err)
+	}
+
+	items := func(result string) float64 {
+		return testutil.ToFloat64(metrics.Items.WithLabelValues("1001", result))
+	}
+	assert.Equal(t, float64(4), items(metrics.ItemParsed))
+	assert.Equal(t, float64(2), items(metrics.ItemInserted))
+	assert.Equal(t, float64(2), items(metrics.ItemDuplicated))
+	assert.Equal(t, float64(0), items(metrics.ItemFailed))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.Fetches.WithLabelValues("1001", "ok")))
+
+	observeFetch(s, time.Now(), 0, errors.New("connection refused"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.Fetches.WithLabelValues("1001", "error")))
+}
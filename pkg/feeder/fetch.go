@@ -0,0 +1,90 @@
+package feeder
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/mmcdole/gofeed"
+)
+
+const userAgent = "feeder"
+
+// fetchResult is an outcome of one feed request
+type fetchResult struct {
+	// feed is nil when the feed isn't modified since the previous request
+	feed         *gofeed.Feed
+	etag         string
+	lastModified string
+	status       int
+}
+
+func (r *fetchResult) notModified() bool {
+	return r.status == http.StatusNotModified
+}
+
+// fetcher downloads feeds with conditional requests, so unchanged feeds
+// aren't downloaded and parsed again
+type fetcher struct {
+	client *http.Client
+	parser *gofeed.Parser
+}
+
+func newFetcher() *fetcher {
+	parser := gofeed.NewParser()
+	parser.RSSTranslator = &hintsTranslator{}
+
+	return &fetcher{
+		client: &http.Client{Timeout: fetchTimeout},
+		parser: parser,
+	}
+}
+
+// fetch requests the feed of source using its cache validators
+func (f *fetcher) fetch(ctx context.Context, s *FeedSource) (*fetchResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", userAgent)
+	if s.ETag != "" {
+		req.Header.Set("If-None-Match", s.ETag)
+	}
+	if s.LastModified != "" {
+		req.Header.Set("If-Modified-Since", s.LastModified)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &fetchResult{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		status:       resp.StatusCode,
+	}
+
+	if result.notModified() {
+		// server may omit validators in 304 response
+		if result.etag == "" {
+			result.etag = s.ETag
+		}
+		if result.lastModified == "" {
+			result.lastModified = s.LastModified
+		}
+		return result, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return result, fmt.Errorf("Unexpected HTTP status %s", resp.Status)
+	}
+
+	if result.feed, err = f.parser.Parse(resp.Body); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
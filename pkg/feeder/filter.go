@@ -0,0 +1,268 @@
+package feeder
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter syntax. A filter is a list of conditions separated by ';' or new lines:
+// '[include|exclude] expression operator value'. Expression is a selector with optional
+// transforms like in rules. Item is saved if it matches every include condition and
+// no exclude condition, include is the default. Operators:
+//   ~ "pattern"         value matches regular expression
+//   contains "text"     value contains text ignoring case
+//   = "text"            value equals to text ignoring case
+//   in ("a", "b")       value equals to one of texts ignoring case
+//   within 7d           value is a date not older than duration, d is days
+// Condition on list is true if any item satisfies it. Missing values satisfy no condition
+
+// ItemFilter decides whether feed item is saved
+type ItemFilter struct {
+	text  string
+	conds []*condition
+}
+
+// String returns the filter text, nil filter is empty
+func (f *ItemFilter) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.text
+}
+
+type condition struct {
+	exclude bool
+	expr    *fieldExpr
+	match   func(v interface{}, now time.Time) bool
+}
+
+// ImplementFilter parses the filter of feed source. Empty filter keeps every item.
+// It returns the first error of the filter
+func ImplementFilter(s *FeedSource, filter string) error {
+	conds, errs := parseFilter(filter)
+	if len(errs) > 0 {
+		return errs[0].Err
+	}
+
+	s.Filter = nil
+	if len(conds) > 0 {
+		s.Filter = &ItemFilter{text: filter, conds: conds}
+	}
+
+	return nil
+}
+
+// ValidateFilter checks the filter and returns errors of all its incorrect conditions
+func ValidateFilter(filter string) []*RuleError {
+	_, errs := parseFilter(filter)
+	return errs
+}
+
+// parseFilter returns conditions of the filter or errors of incorrect ones
+func parseFilter(filter string) ([]*condition, []*RuleError) {
+	var conds []*condition
+	var errs []*RuleError
+
+	for _, line := range strings.Split(filter, "\n") {
+		for _, part := range splitTop(line, ';') {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+
+			c, err := parseCondition(part)
+			if err != nil {
+				errs = append(errs, &RuleError{Expr: part, Err: err})
+				continue
+			}
+
+			conds = append(conds, c)
+		}
+	}
+
+	return conds, errs
+}
+
+func parseCondition(s string) (*condition, error) {
+	tokens := splitSpaces(s)
+	c := &condition{}
+
+	switch strings.ToLower(tokens[0]) {
+	case "exclude":
+		c.exclude = true
+		tokens = tokens[1:]
+	case "include":
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) != 3 {
+		return nil, fmt.Errorf("%w: condition '%s' must be 'expression operator value'", ErrRuleSyntax, s)
+	}
+
+	var err error
+	if c.expr, err = parseExpr(tokens[0]); err != nil {
+		return nil, err
+	}
+
+	op, value := strings.ToLower(tokens[1]), tokens[2]
+
+	switch op {
+	case "~":
+		pattern, err := parseArg(value)
+		if err != nil {
+			return nil, err
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: condition '%s': %s", ErrRuleSyntax, s, err)
+		}
+
+		c.match = textMatch(re.MatchString)
+	case "contains", "=":
+		text, err := parseArg(value)
+		if err != nil {
+			return nil, err
+		}
+
+		text = strings.ToLower(text)
+		if op == "=" {
+			c.match = textMatch(func(v string) bool { return strings.ToLower(v) == text })
+		} else {
+			c.match = textMatch(func(v string) bool { return strings.Contains(strings.ToLower(v), text) })
+		}
+	case "in":
+		if !strings.HasPrefix(value, "(") || !strings.HasSuffix(value, ")") {
+			return nil, fmt.Errorf("%w: values of 'in' must be in parentheses in '%s'", ErrRuleSyntax, s)
+		}
+
+		set := make(map[string]bool)
+		for _, a := range splitTop(value[1:len(value)-1], ',') {
+			text, err := parseArg(strings.TrimSpace(a))
+			if err != nil {
+				return nil, err
+			}
+			set[strings.ToLower(text)] = true
+		}
+
+		c.match = textMatch(func(v string) bool { return set[strings.ToLower(v)] })
+	case "within":
+		d, err := parseDays(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: condition '%s': %s", ErrRuleSyntax, s, err)
+		}
+
+		c.match = func(v interface{}, now time.Time) bool {
+			return anyText(v, func(v string) bool {
+				t, ok := parseDate(v, dateLayouts)
+				return ok && !t.Before(now.Add(-d))
+			})
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown operator '%s' in '%s'", ErrRuleSyntax, tokens[1], s)
+	}
+
+	return c, nil
+}
+
+// Match checks whether item with JSON value fields passes the filter
+func (f *ItemFilter) Match(fields interface{}, ctx *TransformContext, now time.Time) bool {
+	for _, c := range f.conds {
+		v, ok, err := c.expr.apply(fields, ctx)
+		matched := err == nil && ok && c.match(v, now)
+
+		if matched == c.exclude {
+			return false
+		}
+	}
+
+	return true
+}
+
+// textMatch returns matcher of text of value or of any list item
+func textMatch(fn func(string) bool) func(v interface{}, now time.Time) bool {
+	return func(v interface{}, _ time.Time) bool {
+		return anyText(v, fn)
+	}
+}
+
+func anyText(v interface{}, fn func(string) bool) bool {
+	if list, ok := v.([]interface{}); ok {
+		for _, item := range list {
+			if anyText(item, fn) {
+				return true
+			}
+		}
+		return false
+	}
+
+	s, err := text(v)
+	return err == nil && fn(s)
+}
+
+// parseDays parses duration which may be in days, e.g. 7d or 12h
+func parseDays(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		var n float64
+		n, err = strconv.ParseFloat(days, 64)
+		d = time.Duration(n * float64(24*time.Hour))
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("incorrect duration '%s', e.g. 7d or 12h expected", s)
+	}
+
+	return d, nil
+}
+
+// splitSpaces splits s by whitespace which isn't in quotes, brackets or parentheses
+func splitSpaces(s string) []string {
+	var parts []string
+	quote := rune(0)
+	escaped := false
+	depth := 0
+	var cur strings.Builder
+
+	for _, c := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case unicode.IsSpace(c) && depth == 0:
+			if cur.Len() > 0 {
+				parts = append(parts, cur.String())
+				cur.Reset()
+			}
+			continue
+		}
+
+		cur.WriteRune(c)
+	}
+
+	if cur.Len() > 0 {
+		parts = append(parts, cur.String())
+	}
+
+	return parts
+}
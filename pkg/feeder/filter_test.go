@@ -0,0 +1,127 @@
+package feeder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/metrics"
+	"github.com/mmcdole/gofeed"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	published := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	item := &gofeed.Item{
+		Title:           "Go 1.22 is released",
+		Description:     "<p>Range over integers</p>",
+		Published:       published.Format(time.RFC1123),
+		PublishedParsed: &published,
+		Categories:      []string{"Go", "Release"},
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		at     time.Time
+		want   bool
+	}{
+		{name: "empty", filter: "", want: true},
+		{name: "regex", filter: `title ~ "^Go \d"`, want: true},
+		{name: "regex mismatch", filter: `title ~ "^Rust"`, want: false},
+		{name: "contains ignores case", filter: `description contains "INTEGERS"`, want: true},
+		{name: "contains after transform", filter: `description|striphtml contains "<p>"`, want: false},
+		{name: "equal", filter: `categories[0] = "go"`, want: true},
+		{name: "in list", filter: `categories in ("news", "release")`, want: true},
+		{name: "not in list", filter: `categories in ("rust")`, want: false},
+		{name: "within days", filter: "published within 7d", at: published.Add(48 * time.Hour), want: true},
+		{name: "too old", filter: "publishedParsed within 1d", at: published.Add(48 * time.Hour), want: false},
+		{name: "within duration", filter: "publishedParsed within 36h", at: published.Add(24 * time.Hour), want: true},
+		{name: "exclude", filter: `exclude description contains "integers"`, want: false},
+		{name: "exclude mismatch", filter: `exclude title contains "beta"`, want: true},
+		{name: "include and exclude", filter: `include title ~ Go; exclude categories = "beta"`, want: true},
+		{name: "every include must match", filter: "title ~ Go\ntitle ~ Rust", want: false},
+		{name: "missing value doesn't match", filter: `author.name contains "a"`, want: false},
+		{name: "missing value isn't excluded", filter: `exclude author.name contains "a"`, want: true},
+		{name: "quoted separators", filter: `title ~ "is; released"`, want: false},
+		{name: "operator ignores case", filter: `title CONTAINS "go"`, want: true},
+	}
+
+	fields, err := itemFields(item)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &FeedSource{}
+			if !assert.NoError(t, ImplementFilter(s, tt.filter)) {
+				return
+			}
+
+			at := tt.at
+			if at.IsZero() {
+				at = published
+			}
+			assert.Equal(t, tt.want, s.Filter == nil || s.Filter.Match(fields, &TransformContext{Item: item}, at))
+		})
+	}
+}
+
+func TestFilterSyntax(t *testing.T) {
+	for _, filter := range []string{
+		`title`,
+		`title contains`,
+		`title like "go"`,
+		`title ~ "("`,
+		`title in "go"`,
+		`title in ("go"`,
+		`published within week`,
+		`published within -1d`,
+		`title[ contains "go"`,
+		`title|nope contains "go"`,
+		`exclude title "go"`,
+	} {
+		t.Run(filter, func(t *testing.T) {
+			s := &FeedSource{}
+			err := ImplementFilter(s, filter)
+			assert.Error(t, err)
+			assert.True(t, errors.Is(err, ErrRuleSyntax) || errors.Is(err, ErrUnknownTransform), "unexpected error %v", err)
+		})
+	}
+}
+
+func TestReadFeedFilter(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRSS))
+	}))
+	defer srv.Close()
+
+	storage := &fakeStorage{}
+	f, err := NewFeeder(storage)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// metrics are global, so source ID is unique to the test
+	s := &FeedSource{ID: 1002, URL: srv.URL, Rule: map[string]string{"Title": "title"}}
+	if !assert.NoError(t, ImplementFilter(s, `exclude title ~ "2$"`)) {
+		return
+	}
+
+	filtered := 0
+	for i := 0; i < 2; i++ {
+		r := f.readFeed(context.Background(), s)
+		assert.NoError(t, r.err)
+		filtered += r.filtered
+	}
+
+	assert.Equal(t, []string{"title 1"}, storage.news)
+	assert.Equal(t, 2, filtered)
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.Items.WithLabelValues("1002", metrics.ItemFiltered)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.Items.WithLabelValues("1002", metrics.ItemParsed)))
+}
@@ -0,0 +1,83 @@
+package feeder
+
+import (
+	"time"
+)
+
+const (
+	defaultMaxFailures = 10
+	maxBackoff         = 24 * time.Hour
+	// maxBackoffShift limits the exponent, so the interval doesn't overflow
+	maxBackoffShift = 16
+)
+
+// FeedSourceHealth is a state of feed source readings
+type FeedSourceHealth struct {
+	SourceID int
+	// LastAttempt and LastSuccess are zero if the source has never been read
+	LastAttempt time.Time
+	LastSuccess time.Time
+	// Failures is a count of consecutive failed readings
+	Failures  int
+	LastError string
+	// LastStatus is HTTP status of the last response or 0 if there was no response
+	LastStatus int
+	// Disabled sources aren't read until they are enabled
+	Disabled bool
+	// Filtered is a count of items dropped by the source filter
+	Filtered int
+}
+
+// FeedSourceReading is an outcome of a feed source reading. It's applied to the health
+// as it's stored, so changes of the health made while the source was read aren't lost
+type FeedSourceReading struct {
+	SourceID int
+	At       time.Time
+	// Status is HTTP status of the response or 0 if there was no response
+	Status int
+	// Error is empty if the reading succeeded
+	Error string
+	// Filtered is a count of items which the filter dropped during the reading
+	Filtered int
+	// MaxFailures is a count of consecutive failures which disables the source, zero never disables it
+	MaxFailures int
+}
+
+// Apply changes the state by the outcome of a reading. Source is disabled
+// after MaxFailures consecutive failures
+func (h *FeedSourceHealth) Apply(r *FeedSourceReading) {
+	h.LastAttempt = r.At
+	h.LastStatus = r.Status
+	h.Filtered += r.Filtered
+
+	if r.Error == "" {
+		h.LastSuccess = r.At
+		h.Failures = 0
+		h.LastError = ""
+		return
+	}
+
+	h.Failures++
+	h.LastError = r.Error
+
+	if r.MaxFailures > 0 && h.Failures >= r.MaxFailures {
+		h.Disabled = true
+	}
+}
+
+// backoff returns interval increased exponentially with count of consecutive failures
+func backoff(interval time.Duration, failures int) time.Duration {
+	if failures <= 0 || interval >= maxBackoff {
+		return interval
+	}
+
+	if failures > maxBackoffShift {
+		failures = maxBackoffShift
+	}
+
+	if d := interval << uint(failures); d < maxBackoff {
+		return d
+	}
+
+	return maxBackoff
+}
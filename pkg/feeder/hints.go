@@ -0,0 +1,76 @@
+package feeder
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+)
+
+// hintsTranslator keeps RSS <ttl> which the default translator drops
+type hintsTranslator struct {
+	gofeed.DefaultRSSTranslator
+}
+
+const ttlCustomKey = "ttl"
+
+func (t *hintsTranslator) Translate(feed interface{}) (*gofeed.Feed, error) {
+	result, err := t.DefaultRSSTranslator.Translate(feed)
+	if err != nil {
+		return nil, err
+	}
+
+	if rssFeed, ok := feed.(*rss.Feed); ok && rssFeed.TTL != "" {
+		if result.Custom == nil {
+			result.Custom = make(map[string]string)
+		}
+		result.Custom[ttlCustomKey] = rssFeed.TTL
+	}
+
+	return result, nil
+}
+
+var syndicationPeriods = map[string]time.Duration{
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+}
+
+// updateHint returns update period advertised by feed with <ttl> or
+// sy:updatePeriod and sy:updateFrequency. Returns 0 if feed has no hints
+func updateHint(feed *gofeed.Feed) time.Duration {
+	if feed == nil {
+		return 0
+	}
+
+	if ttl, err := strconv.Atoi(strings.TrimSpace(feed.Custom[ttlCustomKey])); err == nil && ttl > 0 {
+		return time.Duration(ttl) * time.Minute
+	}
+
+	sy := feed.Extensions["sy"]
+	if sy == nil {
+		return 0
+	}
+
+	period := time.Duration(0)
+	if p := sy["updatePeriod"]; len(p) > 0 {
+		period = syndicationPeriods[strings.ToLower(strings.TrimSpace(p[0].Value))]
+	}
+
+	if period == 0 {
+		return 0
+	}
+
+	frequency := 1
+	if f := sy["updateFrequency"]; len(f) > 0 {
+		if v, err := strconv.Atoi(strings.TrimSpace(f[0].Value)); err == nil && v > 0 {
+			frequency = v
+		}
+	}
+
+	return period / time.Duration(frequency)
+}
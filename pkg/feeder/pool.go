@@ -0,0 +1,101 @@
+package feeder
+
+import (
+	"net/url"
+	"sync"
+)
+
+// pool runs jobs with a limited concurrency in total and per host
+type pool struct {
+	slots   chan struct{}
+	perHost int
+
+	mut   sync.Mutex
+	hosts map[string]*hostSlots
+
+	wg sync.WaitGroup
+}
+
+func newPool(workers, perHost int) *pool {
+	if workers <= 0 {
+		workers = 1
+	}
+
+	if perHost <= 0 || perHost > workers {
+		perHost = workers
+	}
+
+	return &pool{
+		slots:   make(chan struct{}, workers),
+		perHost: perHost,
+		hosts:   make(map[string]*hostSlots),
+	}
+}
+
+// hostSlots limits jobs of a host. It's forgotten when the host has no started jobs,
+// so hosts which aren't read anymore don't stay in the pool
+type hostSlots struct {
+	slots chan struct{}
+	jobs  int
+}
+
+// run starts job without blocking the caller. Job waits for a free slot of its host first
+// and only then takes a common slot, so jobs of a busy host don't hold slots of others
+func (p *pool) run(host string, job func()) {
+	h := p.acquireHost(host)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.releaseHost(host, h)
+
+		h.slots <- struct{}{}
+		defer func() { <-h.slots }()
+
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+
+		job()
+	}()
+}
+
+// wait blocks until all started jobs are done
+func (p *pool) wait() {
+	p.wg.Wait()
+}
+
+// acquireHost returns slots of the host and counts the job started
+func (p *pool) acquireHost(host string) *hostSlots {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	h, exist := p.hosts[host]
+	if !exist {
+		h = &hostSlots{slots: make(chan struct{}, p.perHost)}
+		p.hosts[host] = h
+	}
+	h.jobs++
+
+	return h
+}
+
+// releaseHost counts the job done and forgets the host if it has no jobs
+func (p *pool) releaseHost(host string, h *hostSlots) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	h.jobs--
+	if h.jobs == 0 {
+		delete(p.hosts, host)
+	}
+}
+
+// sourceHost returns host of feed source URL or the URL itself if it can't be parsed
+func sourceHost(s *FeedSource) string {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Host == "" {
+		return s.URL
+	}
+
+	return u.Host
+}
@@ -0,0 +1,143 @@
+package feeder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPreviewItems is a count of items which rule preview shows by default
+const DefaultPreviewItems = 5
+
+// RulePreview is an outcome of applying a rule to a feed without saving anything
+type RulePreview struct {
+	// Fields are selectors of values which items of the feed have
+	Fields []string
+	Items  []*PreviewItem
+	// Warnings are rule fields which matched nothing in the items and errors of transforms
+	Warnings []string
+}
+
+// PreviewItem is a feed item with payload which would be saved
+type PreviewItem struct {
+	GUID    string
+	Title   string
+	Payload json.RawMessage
+	// Filtered items would be dropped by the filter
+	Filtered bool
+}
+
+// PreviewRule reads the feed once and applies the rule and the filter to its first count items.
+// Rule and filter syntax errors are returned before the feed is read
+func PreviewRule(ctx context.Context, url, rule, filter string, count int) (*RulePreview, error) {
+	s := &FeedSource{URL: url}
+	if err := ImplementRule(s, rule); err != nil {
+		return nil, err
+	}
+
+	if err := ImplementFilter(s, filter); err != nil {
+		return nil, err
+	}
+
+	res, err := newFetcher().fetch(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RulePreview{Fields: []string{}, Items: []*PreviewItem{}, Warnings: []string{}}
+	paths := make(map[string]bool)
+	matched := make(map[string]bool)
+	failed := make(map[string]error)
+	now := time.Now()
+
+	for i, item := range res.feed.Items {
+		fields, err := itemFields(item)
+		if err != nil {
+			return nil, err
+		}
+		fieldPaths(fields, "", paths)
+
+		if i >= count {
+			continue
+		}
+
+		tctx := &TransformContext{Item: item, FeedLink: res.feed.Link}
+
+		payload, _ := extractFields(fields, tctx, s.Rule)
+		result.Items = append(result.Items, &PreviewItem{
+			GUID:     itemGUID(item),
+			Title:    item.Title,
+			Payload:  payload,
+			Filtered: s.Filter != nil && !s.Filter.Match(fields, tctx, now),
+		})
+
+		for k := range s.Rule {
+			e, err := parseExpr(k)
+			if err != nil {
+				return nil, err
+			}
+
+			_, exist, err := e.apply(fields, tctx)
+			if err != nil && failed[k] == nil {
+				failed[k] = err
+			}
+			matched[k] = matched[k] || exist
+		}
+	}
+
+	for p := range paths {
+		result.Fields = append(result.Fields, p)
+	}
+	sort.Strings(result.Fields)
+
+	keys := make([]string, 0, len(s.Rule))
+	for k := range s.Rule {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := failed[k]; err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("field '%s': %s", s.Rule[k], err))
+		} else if !matched[k] {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("field '%s': '%s' matched nothing", s.Rule[k], k))
+		}
+	}
+
+	return result, nil
+}
+
+// fieldPaths adds selectors of the values in v to paths. Items of lists are selected by [*]
+func fieldPaths(v interface{}, path string, paths map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			key := quoteKey(k)
+			if path != "" && strings.HasPrefix(key, `"`) {
+				key = path + "[" + key + "]"
+			} else if path != "" {
+				key = path + "." + key
+			}
+			fieldPaths(item, key, paths)
+		}
+	case []interface{}:
+		for _, item := range v {
+			fieldPaths(item, path+"[*]", paths)
+		}
+	case nil:
+	default:
+		paths[path] = true
+	}
+}
+
+// quoteKey quotes key which can't be a part of selector as is
+func quoteKey(key string) string {
+	if key != "" && key != "*" && !strings.ContainsAny(key, ".[]\"'\\,=|() \t\n") && !strings.HasPrefix(key, "$") {
+		return key
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(key) + `"`
+}
@@ -0,0 +1,85 @@
+package feeder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const previewRSS = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel>
+	<title>test</title>
+	<link>http://example.com</link>
+	<item><title>Go 1.22</title><guid>1</guid><category>go</category><dc:creator>Gopher</dc:creator></item>
+	<item><title>Rust 1.76</title><guid>2</guid><link>/rust</link></item>
+	<item><title>Zig 0.12</title><guid>3</guid><description>New</description></item>
+</channel>
+</rss>`
+
+func TestPreviewRule(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(previewRSS))
+	}))
+	defer srv.Close()
+
+	p, err := PreviewRule(context.Background(), srv.URL, `Title=t,link|absurl=l,author.name=a,description=d,title|date=p`,
+		`exclude title ~ "^Rust"`, 2)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if assert.Len(t, p.Items, 2) {
+		assert.Equal(t, "1", p.Items[0].GUID)
+		assert.JSONEq(t, `{"t":"Go 1.22","a":"Gopher"}`, string(p.Items[0].Payload))
+		assert.False(t, p.Items[0].Filtered)
+		assert.JSONEq(t, `{"t":"Rust 1.76","l":"http://example.com/rust"}`, string(p.Items[1].Payload))
+		assert.True(t, p.Items[1].Filtered)
+	}
+
+	assert.Subset(t, p.Fields, []string{"title", "categories[*]", "guid", "description", `extensions.dc.creator[*].value`},
+		"fields of every item should be listed")
+	assert.Equal(t, []string{"field 'd': 'description' matched nothing", "field 'p': 'title|date' matched nothing"},
+		p.Warnings, "author.name is set from dc:creator, description is only in the third item")
+}
+
+func TestPreviewRuleErrors(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	_, err := PreviewRule(context.Background(), srv.URL, "title[", "", 1)
+	assert.True(t, errors.Is(err, ErrRuleSyntax))
+
+	_, err = PreviewRule(context.Background(), srv.URL, "title", "title like go", 1)
+	assert.True(t, errors.Is(err, ErrRuleSyntax))
+	assert.Equal(t, 0, requests, "feed shouldn't be read if rule is incorrect")
+
+	_, err = PreviewRule(context.Background(), srv.URL, "title", "", 1)
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestQuoteKey(t *testing.T) {
+	assert.Equal(t, "title", quoteKey("title"))
+	assert.Equal(t, `"a.b"`, quoteKey("a.b"))
+	assert.Equal(t, `"say \"hi\""`, quoteKey(`say "hi"`))
+
+	paths := make(map[string]bool)
+	fieldPaths(map[string]interface{}{"ext": map[string]interface{}{"a.b": []interface{}{"x"}}, "n": nil}, "", paths)
+	assert.Equal(t, map[string]bool{`ext["a.b"][*]`: true}, paths)
+
+	sel, err := parseSelector(`ext["a.b"][*]`)
+	if assert.NoError(t, err) {
+		v, ok := sel.selectValue(map[string]interface{}{"ext": map[string]interface{}{"a.b": []interface{}{"x"}}})
+		assert.True(t, ok)
+		assert.Equal(t, []interface{}{"x"}, v)
+	}
+}
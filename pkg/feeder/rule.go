@@ -0,0 +1,417 @@
+package feeder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rule syntax. A rule is a comma separated list of fields 'selector|transform|...=name'. Name is a key
+// of the field in news payload, it's the selector itself if it's omitted.
+// Selector is a path to a value of JSON marshalled gofeed.Item, e.g. 'author.name',
+// 'enclosures[0].url', 'extensions.media.content[0].attrs.url' or 'categories[*]'.
+// Path may start with '$.' like JSONPath. Keys are compared ignoring case if there is no exact match.
+// Keys and names with special characters are quoted: 'extensions["dc"]', '"a,b"=c' or 'title="x=y"'.
+// Negative index counts from the end and '*' selects all items, then the value is a list of matches.
+// Transforms change the selected value in order, e.g. 'description|striphtml|truncate(300)=summary',
+// see transform.go for the built-in ones
+
+// ErrRuleSyntax is returned for rules which can't be parsed
+var ErrRuleSyntax = errors.New("Rule syntax error")
+
+// ruleField is a field of the rule before its expression is parsed
+type ruleField struct {
+	expr string
+	name string
+}
+
+// splitRule splits the rule into fields. Empty fields are skipped
+func splitRule(rule string) ([]ruleField, error) {
+	var fields []ruleField
+	var cur strings.Builder
+	var expr string
+	hasName := false
+	quote := rune(0)
+	escaped := false
+	depth := 0
+
+	flush := func() error {
+		part := strings.TrimSpace(cur.String())
+		cur.Reset()
+
+		if !hasName {
+			if part != "" {
+				name := strings.TrimSpace(splitTop(part, '|')[0])
+				fields = append(fields, ruleField{expr: part, name: unquoteName(name)})
+			}
+			return nil
+		}
+
+		if expr == "" {
+			return fmt.Errorf("%w: field '=%s' has no selector", ErrRuleSyntax, part)
+		}
+
+		name := unquoteName(part)
+		if name == "" {
+			return fmt.Errorf("%w: field '%s=' has empty name", ErrRuleSyntax, expr)
+		}
+
+		fields = append(fields, ruleField{expr: expr, name: name})
+		expr, hasName = "", false
+
+		return nil
+	}
+
+	for _, c := range rule {
+		switch {
+		case escaped:
+			escaped = false
+		case quote != 0 && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == '=' && depth == 0 && !hasName:
+			expr = strings.TrimSpace(cur.String())
+			cur.Reset()
+			hasName = true
+			continue
+		case c == ',' && depth == 0:
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		cur.WriteRune(c)
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("%w: unterminated quote in '%s'", ErrRuleSyntax, rule)
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return fields, nil
+}
+
+// splitTop splits s by the separator which isn't in quotes, brackets or parentheses
+func splitTop(s string, sep byte) []string {
+	var parts []string
+	quote := byte(0)
+	depth, start := 0, 0
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// unquoteName removes quotes around the name if the whole name is quoted
+func unquoteName(s string) string {
+	if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+		if name, rest, err := readQuoted(s); err == nil && rest == "" {
+			return name
+		}
+	}
+
+	return s
+}
+
+// step is a step of selector path: a key, an index or all items
+type step struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+type selector []step
+
+// parseSelector parses path to a value of feed item
+func parseSelector(s string) (selector, error) {
+	src := s
+	s = strings.TrimSpace(s)
+	if s == "$" {
+		return nil, fmt.Errorf("%w: selector '%s' selects the whole item", ErrRuleSyntax, src)
+	}
+	s = strings.TrimPrefix(s, "$.")
+
+	var sel selector
+	dot := true // a key is expected at the start and after '.'
+
+	for len(s) > 0 {
+		switch {
+		case s[0] == '[':
+			end := closingBracket(s)
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unclosed '[' in selector '%s'", ErrRuleSyntax, src)
+			}
+
+			st, err := parseBracket(strings.TrimSpace(s[1:end]))
+			if err != nil {
+				return nil, fmt.Errorf("%w in selector '%s'", err, src)
+			}
+
+			sel = append(sel, st)
+			s = s[end+1:]
+			dot = false
+		case s[0] == '.':
+			if dot {
+				return nil, fmt.Errorf("%w: empty key in selector '%s'", ErrRuleSyntax, src)
+			}
+			s = s[1:]
+			dot = true
+			if len(s) == 0 {
+				return nil, fmt.Errorf("%w: selector '%s' ends with '.'", ErrRuleSyntax, src)
+			}
+		case dot:
+			key, rest, err := readKey(s)
+			if err != nil {
+				return nil, fmt.Errorf("%w in selector '%s'", err, src)
+			}
+
+			if key == "*" {
+				sel = append(sel, step{wildcard: true})
+			} else {
+				sel = append(sel, step{key: key})
+			}
+			s = rest
+			dot = false
+		default:
+			return nil, fmt.Errorf("%w: unexpected '%s' in selector '%s'", ErrRuleSyntax, s, src)
+		}
+	}
+
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("%w: empty selector", ErrRuleSyntax)
+	}
+
+	return sel, nil
+}
+
+// closingBracket returns position of ']' which closes '[' at the start of s, brackets in quotes are skipped
+func closingBracket(s string) int {
+	quote := byte(0)
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == ']':
+			return i
+		}
+	}
+
+	return -1
+}
+
+// parseBracket parses content of '[...]': an index, '*' or a quoted key
+func parseBracket(s string) (step, error) {
+	if s == "*" {
+		return step{wildcard: true}, nil
+	}
+
+	if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+		key, rest, err := readQuoted(s)
+		if err != nil {
+			return step{}, err
+		}
+
+		if strings.TrimSpace(rest) != "" {
+			return step{}, fmt.Errorf("%w: unexpected '%s' after key", ErrRuleSyntax, rest)
+		}
+
+		return step{key: key}, nil
+	}
+
+	index, err := strconv.Atoi(s)
+	if err != nil {
+		return step{}, fmt.Errorf("%w: '[%s]' is neither an index nor a quoted key", ErrRuleSyntax, s)
+	}
+
+	return step{index: index, isIndex: true}, nil
+}
+
+// readKey reads a quoted key or a key up to '.' or '['
+func readKey(s string) (string, string, error) {
+	if s[0] == '"' || s[0] == '\'' {
+		return readQuoted(s)
+	}
+
+	end := strings.IndexAny(s, ".[")
+	if end < 0 {
+		end = len(s)
+	}
+
+	key := strings.TrimSpace(s[:end])
+	if key == "" || strings.ContainsAny(key, `]"'`) {
+		return "", "", fmt.Errorf("%w: incorrect key '%s'", ErrRuleSyntax, s[:end])
+	}
+
+	return key, s[end:], nil
+}
+
+// readQuoted reads a string in quotes at the start of s. Backslash escapes quotes and backslash,
+// other backslashes are kept, so regular expressions don't need double escaping
+func readQuoted(s string) (string, string, error) {
+	quote := s[0]
+
+	var key strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\'' || s[i+1] == '\\') {
+				i++
+			}
+			key.WriteByte(s[i])
+		case quote:
+			return key.String(), s[i+1:], nil
+		default:
+			key.WriteByte(s[i])
+		}
+	}
+
+	return "", "", fmt.Errorf("%w: unterminated quote", ErrRuleSyntax)
+}
+
+// wildcard checks whether selector may select several values
+func (sel selector) wildcard() bool {
+	for _, st := range sel {
+		if st.wildcard {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectValue returns value selected in JSON value v. Selector with wildcards returns a list
+// of matches. It returns false if nothing is selected or the value is null
+func (sel selector) selectValue(v interface{}) (interface{}, bool) {
+	matches := sel.collect(v, nil)
+
+	if sel.wildcard() {
+		return matches, len(matches) > 0
+	}
+
+	if len(matches) == 0 {
+		return nil, false
+	}
+
+	return matches[0], true
+}
+
+func (sel selector) collect(v interface{}, matches []interface{}) []interface{} {
+	if v == nil {
+		return matches
+	}
+
+	if len(sel) == 0 {
+		return append(matches, v)
+	}
+
+	st, rest := sel[0], sel[1:]
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		switch {
+		case st.wildcard:
+			for _, k := range sortedKeys(v) {
+				matches = rest.collect(v[k], matches)
+			}
+		case !st.isIndex:
+			if item, ok := lookupKey(v, st.key); ok {
+				matches = rest.collect(item, matches)
+			}
+		}
+	case []interface{}:
+		switch {
+		case st.wildcard:
+			for _, item := range v {
+				matches = rest.collect(item, matches)
+			}
+		case st.isIndex:
+			i := st.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				matches = rest.collect(v[i], matches)
+			}
+		}
+	}
+
+	return matches
+}
+
+// lookupKey returns value of the key or of the first key which equals to it ignoring case
+func lookupKey(m map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := m[key]; ok {
+		return v, true
+	}
+
+	for _, k := range sortedKeys(m) {
+		if strings.EqualFold(k, key) {
+			return m[k], true
+		}
+	}
+
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// decodeJSON decodes JSON keeping numbers as they are
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	err := dec.Decode(&v)
+
+	return v, err
+}
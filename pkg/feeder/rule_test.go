@@ -0,0 +1,179 @@
+package feeder
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+	ext "github.com/mmcdole/gofeed/extensions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImplementRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		want    map[string]string
+		wantErr error
+	}{
+		{
+			name: "flat pairs",
+			rule: "Title=Name,link",
+			want: map[string]string{"Title": "Name", "link": "link"},
+		},
+		{
+			name: "spaces and empty fields",
+			rule: " title = Name , ,link,",
+			want: map[string]string{"title": "Name", "link": "link"},
+		},
+		{
+			name: "paths",
+			rule: "author.name=author,enclosures[0].url=audio,categories[*],$.itunesExt.duration=duration",
+			want: map[string]string{
+				"author.name":          "author",
+				"enclosures[0].url":    "audio",
+				"categories[*]":        "categories[*]",
+				"$.itunesExt.duration": "duration",
+			},
+		},
+		{
+			name: "quoted names and keys",
+			rule: `title="a,b=c",extensions["dc"].creator='x\'y',"odd,key"`,
+			want: map[string]string{
+				"title":                    "a,b=c",
+				`extensions["dc"].creator`: "x'y",
+				`"odd,key"`:                "odd,key",
+			},
+		},
+		{
+			name: "comma in brackets",
+			rule: `extensions["a,b"]=ab`,
+			want: map[string]string{`extensions["a,b"]`: "ab"},
+		},
+		{name: "empty", rule: " ", wantErr: ErrEmptyRule},
+		{name: "only commas", rule: ",,", wantErr: ErrEmptyRule},
+		{name: "unterminated quote", rule: `title="name`, wantErr: ErrRuleSyntax},
+		{name: "empty name", rule: "title=", wantErr: ErrRuleSyntax},
+		{name: "no selector", rule: "=name", wantErr: ErrRuleSyntax},
+		{name: "unclosed bracket", rule: "enclosures[0=url", wantErr: ErrRuleSyntax},
+		{name: "incorrect index", rule: "enclosures[first]", wantErr: ErrRuleSyntax},
+		{name: "empty key", rule: "author..name", wantErr: ErrRuleSyntax},
+		{name: "trailing dot", rule: "author.", wantErr: ErrRuleSyntax},
+		{name: "whole item", rule: "$=item", wantErr: ErrRuleSyntax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &FeedSource{}
+			err := ImplementRule(s, tt.rule)
+
+			if tt.wantErr != nil {
+				assert.True(t, errors.Is(err, tt.wantErr), "unexpected error %v", err)
+				assert.Nil(t, s.Rule, "rule should not be changed")
+				return
+			}
+
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, s.Rule)
+			}
+		})
+	}
+}
+
+func TestParseFeedItemSelectors(t *testing.T) {
+	updated := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	item := &gofeed.Item{
+		Title:         "Episode 1",
+		UpdatedParsed: &updated,
+		Author:        &gofeed.Person{Name: "Gopher", Email: "gopher@example.com"},
+		Categories:    []string{"go", "podcast"},
+		Enclosures: []*gofeed.Enclosure{
+			{URL: "http://example.com/1.mp3", Type: "audio/mpeg", Length: "100"},
+			{URL: "http://example.com/1.ogg", Type: "audio/ogg", Length: "90"},
+		},
+		ITunesExt: &ext.ITunesItemExtension{Duration: "30:00"},
+		Extensions: ext.Extensions{
+			"media": {"content": {{Name: "content", Attrs: map[string]string{"url": "http://example.com/1.jpg"}}}},
+			"dc":    {"creator": {{Name: "creator", Value: "Rob"}}},
+		},
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{name: "top level key ignoring case", rule: "TITLE=title", want: `{"title":"Episode 1"}`},
+		{name: "camel case key", rule: "updatedParsed=updated", want: `{"updated":"2024-05-01T10:00:00Z"}`},
+		{name: "nested key", rule: "author.name=author", want: `{"author":"Gopher"}`},
+		{name: "object", rule: "author", want: `{"author":{"name":"Gopher","email":"gopher@example.com"}}`},
+		{name: "index", rule: "enclosures[0].url=audio", want: `{"audio":"http://example.com/1.mp3"}`},
+		{name: "negative index", rule: "enclosures[-1].type=type", want: `{"type":"audio/ogg"}`},
+		{name: "wildcard", rule: "enclosures[*].url=urls", want: `{"urls":["http://example.com/1.mp3","http://example.com/1.ogg"]}`},
+		{name: "list", rule: "categories[*]=tags", want: `{"tags":["go","podcast"]}`},
+		{name: "extension attribute", rule: "extensions.media.content[0].attrs.url=image", want: `{"image":"http://example.com/1.jpg"}`},
+		{name: "quoted key", rule: `extensions["dc"]['creator'][0].value=creator`, want: `{"creator":"Rob"}`},
+		{name: "itunes extension", rule: "$.itunesExt.duration=duration", want: `{"duration":"30:00"}`},
+		{name: "missing values are skipped", rule: "enclosures[5].url,author.phone,link,title.x=x", want: `{}`},
+		{name: "wildcard without matches is skipped", rule: "authors[*].name=names", want: `{}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &FeedSource{}
+			if !assert.NoError(t, ImplementRule(s, tt.rule)) {
+				return
+			}
+
+			payload, err := parseFeedItem(item, s.Rule)
+			if assert.NoError(t, err) {
+				assert.JSONEq(t, tt.want, string(payload))
+			}
+		})
+	}
+}
+
+func TestSelectValueKeepsNumbers(t *testing.T) {
+	v, err := decodeJSON([]byte(`{"a":[{"n":12345678901234567890}]}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sel, err := parseSelector("a[0].n")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	got, ok := sel.selectValue(v)
+	assert.True(t, ok)
+
+	data, _ := json.Marshal(got)
+	assert.Equal(t, "12345678901234567890", string(data))
+}
+
+func TestValidateRule(t *testing.T) {
+	assert.Empty(t, ValidateRule(`title,description|striphtml=d`))
+
+	errs := ValidateRule(`title,enclosures[first]=url,description|nope=d,link`)
+	if assert.Len(t, errs, 2, "every incorrect field should be reported") {
+		assert.Equal(t, "enclosures[first]", errs[0].Expr)
+		assert.True(t, errors.Is(errs[0], ErrRuleSyntax))
+		assert.Equal(t, "description|nope", errs[1].Expr)
+		assert.True(t, errors.Is(errs[1], ErrUnknownTransform))
+	}
+
+	errs = ValidateRule(" ")
+	if assert.Len(t, errs, 1) {
+		assert.Empty(t, errs[0].Expr)
+		assert.Equal(t, ErrEmptyRule, errs[0].Err)
+	}
+
+	errs = ValidateFilter("title ~ Go; title like Go\n exclude author.name")
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, "title like Go", errs[0].Expr)
+		assert.Equal(t, "exclude author.name", errs[1].Expr)
+	}
+	assert.Empty(t, ValidateFilter(""))
+}
@@ -0,0 +1,198 @@
+package feeder
+
+import (
+	"container/heap"
+	"reflect"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/metrics"
+)
+
+// scheduledSource is a feed source waiting for its next reading
+type scheduledSource struct {
+	source *FeedSource
+	next   time.Time
+	// hint is an update period which the feed itself advertises
+	hint time.Duration
+	// failures is a count of consecutive failed readings
+	failures int
+	disabled bool
+	// index is a position in the queue or -1 while the source is being read
+	index   int
+	removed bool
+	// pending is the source refreshed while it was being read, it's applied when reading is finished
+	pending *FeedSource
+}
+
+// interval returns the period between readings of the source.
+// Explicit source interval has priority over the feed's hint
+func (s *scheduledSource) interval(defaultPeriod time.Duration) time.Duration {
+	if s.source.Interval > 0 {
+		return s.source.Interval
+	}
+
+	if s.hint > 0 {
+		return s.hint
+	}
+
+	return defaultPeriod
+}
+
+// scheduleQueue is a priority queue of sources ordered by the next reading time
+type scheduleQueue []*scheduledSource
+
+func (q scheduleQueue) Len() int { return len(q) }
+
+func (q scheduleQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	s := x.(*scheduledSource)
+	s.index = len(*q)
+	*q = append(*q, s)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	s := old[n-1]
+	old[n-1] = nil
+	s.index = -1
+	*q = old[:n-1]
+	return s
+}
+
+// peek returns the source which should be read first or nil if queue is empty
+func (q scheduleQueue) peek() *scheduledSource {
+	if len(q) == 0 {
+		return nil
+	}
+
+	return q[0]
+}
+
+// scheduler keeps sources in the order of their next reading
+type scheduler struct {
+	queue   scheduleQueue
+	entries map[int]*scheduledSource
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{entries: make(map[int]*scheduledSource)}
+}
+
+// update replaces known sources. New sources are scheduled immediately,
+// known ones keep their schedule and missing ones are dropped.
+// Source with changed URL, rule or filter is a new feed, so it's read immediately too.
+// Sources which are being read are replaced when their reading is finished
+func (s *scheduler) update(sources []*FeedSource, now time.Time) {
+	actual := make(map[int]bool, len(sources))
+
+	for _, src := range sources {
+		actual[src.ID] = true
+
+		if e, exist := s.entries[src.ID]; exist {
+			if e.index < 0 {
+				e.pending = src
+				continue
+			}
+
+			if changedFeed(e.source, src) {
+				e.hint, e.failures = 0, src.Health.Failures
+				e.next = now
+				heap.Fix(&s.queue, e.index)
+			}
+
+			e.source = src
+			continue
+		}
+
+		e := &scheduledSource{source: src, next: now, failures: src.Health.Failures}
+		s.entries[src.ID] = e
+		heap.Push(&s.queue, e)
+	}
+
+	for id, e := range s.entries {
+		if !actual[id] {
+			s.remove(e)
+		}
+	}
+}
+
+// finish applies the source refreshed while it was being read. It returns false if the source
+// became a new feed, then outcome of the reading is outdated and the new feed should be read immediately
+func (s *scheduler) finish(e *scheduledSource) bool {
+	src := e.pending
+	if src == nil {
+		return true
+	}
+	e.pending = nil
+
+	if changedFeed(e.source, src) {
+		e.source, e.hint, e.failures = src, 0, src.Health.Failures
+		return false
+	}
+
+	// validators which the reading saved are newer than the refreshed ones. Health is refreshed
+	// as it's stored, the outcome of the reading is applied to it then
+	src.ETag, src.LastModified = e.source.ETag, e.source.LastModified
+	e.source = src
+
+	return true
+}
+
+// changedFeed checks whether the source reads another feed or saves it differently
+func changedFeed(old, src *FeedSource) bool {
+	return old.URL != src.URL || !reflect.DeepEqual(old.Rule, src.Rule) || old.Filter.String() != src.Filter.String()
+}
+
+// remove drops the source from schedule with its metrics. It isn't returned to the queue after reading
+func (s *scheduler) remove(e *scheduledSource) {
+	e.removed = true
+	delete(s.entries, e.source.ID)
+	metrics.ForgetSource(e.source.ID)
+
+	if e.index >= 0 {
+		heap.Remove(&s.queue, e.index)
+	}
+}
+
+// due pops all sources which should be read at the moment
+func (s *scheduler) due(now time.Time) []*scheduledSource {
+	var result []*scheduledSource
+
+	for e := s.queue.peek(); e != nil && !e.next.After(now); e = s.queue.peek() {
+		result = append(result, heap.Pop(&s.queue).(*scheduledSource))
+	}
+
+	return result
+}
+
+// reschedule returns the read source to the queue
+func (s *scheduler) reschedule(e *scheduledSource, next time.Time) {
+	if e.removed {
+		return
+	}
+
+	e.next = next
+	heap.Push(&s.queue, e)
+}
+
+// wait returns duration until the next source should be read but not longer than max
+func (s *scheduler) wait(now time.Time, max time.Duration) time.Duration {
+	e := s.queue.peek()
+	if e == nil {
+		return max
+	}
+
+	if d := e.next.Sub(now); d < max {
+		return d
+	}
+
+	return max
+}
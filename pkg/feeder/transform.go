@@ -0,0 +1,457 @@
+package feeder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// ErrUnknownTransform is returned for rules which use transform that isn't registered
+var ErrUnknownTransform = errors.New("Unknown transform")
+
+// TransformContext is an item which values are transformed
+type TransformContext struct {
+	Item *gofeed.Item
+	// FeedLink is a link of the feed, it's empty if the feed has no link
+	FeedLink string
+}
+
+// TransformFunc changes value selected by rule. Value is a JSON value: nil, bool, json.Number,
+// string, []interface{} or map[string]interface{}. Nil result removes the field from payload
+type TransformFunc func(v interface{}, ctx *TransformContext) (interface{}, error)
+
+// Transform checks arguments of transform in rule and returns function which applies it.
+// It's called once when rule is parsed
+type Transform func(args []string) (TransformFunc, error)
+
+var (
+	transformsMut sync.RWMutex
+	transforms    = map[string]Transform{
+		"striphtml": noArgs(stringsOf(stripHTML)),
+		"trim":      noArgs(stringsOf(strings.TrimSpace)),
+		"lower":     noArgs(stringsOf(strings.ToLower)),
+		"upper":     noArgs(stringsOf(strings.ToUpper)),
+		"truncate":  truncateTransform,
+		"date":      dateTransform,
+		"regex":     regexTransform,
+		"absurl":    noArgs(absURL),
+		"join":      joinTransform,
+	}
+
+	// exprCache keeps parsed expressions of rule fields, it's cleared when transforms are registered
+	exprCache sync.Map
+)
+
+// RegisterTransform adds transform which rules use by name. Names are compared ignoring case.
+// Transform with the same name is replaced
+func RegisterTransform(name string, t Transform) {
+	transformsMut.Lock()
+	defer transformsMut.Unlock()
+
+	transforms[strings.ToLower(name)] = t
+	exprCache.Range(func(k, _ interface{}) bool {
+		exprCache.Delete(k)
+		return true
+	})
+}
+
+func lookupTransform(name string) (Transform, bool) {
+	transformsMut.RLock()
+	defer transformsMut.RUnlock()
+
+	t, ok := transforms[strings.ToLower(name)]
+	return t, ok
+}
+
+// fieldExpr is a parsed expression of rule field: selector and transforms of its value
+type fieldExpr struct {
+	sel   selector
+	pipes []TransformFunc
+}
+
+// parseExpr parses 'selector|transform|transform(args)'
+func parseExpr(s string) (*fieldExpr, error) {
+	if e, ok := exprCache.Load(s); ok {
+		return e.(*fieldExpr), nil
+	}
+
+	parts := splitTop(s, '|')
+
+	sel, err := parseSelector(parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	e := &fieldExpr{sel: sel}
+
+	for _, p := range parts[1:] {
+		fn, err := parseTransform(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+
+		e.pipes = append(e.pipes, fn)
+	}
+
+	exprCache.Store(s, e)
+
+	return e, nil
+}
+
+// parseTransform parses 'name' or 'name(arg, "quoted arg")'
+func parseTransform(s string) (TransformFunc, error) {
+	name, args := s, []string(nil)
+
+	if open := strings.IndexByte(s, '('); open >= 0 {
+		if !strings.HasSuffix(s, ")") {
+			return nil, fmt.Errorf("%w: transform '%s' has no closing parenthesis", ErrRuleSyntax, s)
+		}
+
+		name = strings.TrimSpace(s[:open])
+		if inner := strings.TrimSpace(s[open+1 : len(s)-1]); inner != "" {
+			for _, a := range splitTop(inner, ',') {
+				arg, err := parseArg(strings.TrimSpace(a))
+				if err != nil {
+					return nil, fmt.Errorf("%w of transform '%s'", err, name)
+				}
+				args = append(args, arg)
+			}
+		}
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("%w: empty transform", ErrRuleSyntax)
+	}
+
+	t, ok := lookupTransform(name)
+	if !ok {
+		return nil, fmt.Errorf("%w '%s'", ErrUnknownTransform, name)
+	}
+
+	fn, err := t(args)
+	if err != nil {
+		return nil, fmt.Errorf("%w: transform '%s': %s", ErrRuleSyntax, name, err)
+	}
+
+	return fn, nil
+}
+
+// parseArg returns unquoted argument
+func parseArg(s string) (string, error) {
+	if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+		arg, rest, err := readQuoted(s)
+		if err == nil && strings.TrimSpace(rest) != "" {
+			err = fmt.Errorf("%w: unexpected '%s' after argument", ErrRuleSyntax, rest)
+		}
+		return arg, err
+	}
+
+	if strings.ContainsAny(s, `()[]"'`) {
+		return "", fmt.Errorf("%w: argument '%s' must be quoted", ErrRuleSyntax, s)
+	}
+
+	return s, nil
+}
+
+// apply selects value of the item and transforms it
+func (e *fieldExpr) apply(item interface{}, ctx *TransformContext) (interface{}, bool, error) {
+	v, ok := e.sel.selectValue(item)
+	if !ok {
+		return nil, false, nil
+	}
+
+	for _, fn := range e.pipes {
+		var err error
+		if v, err = fn(v, ctx); err != nil {
+			return nil, false, err
+		}
+
+		if v == nil {
+			return nil, false, nil
+		}
+	}
+
+	return v, true, nil
+}
+
+// noArgs returns transform without arguments
+func noArgs(fn TransformFunc) Transform {
+	return func(args []string) (TransformFunc, error) {
+		if len(args) > 0 {
+			return nil, errors.New("no arguments expected")
+		}
+		return fn, nil
+	}
+}
+
+// stringsOf returns function which changes text of a value or of every item of a list
+func stringsOf(fn func(string) string) TransformFunc {
+	return mapStrings(func(s string, _ *TransformContext) (interface{}, error) {
+		return fn(s), nil
+	})
+}
+
+// mapStrings applies fn to text of scalar value or to every item of a list.
+// Items for which fn returns nil are removed
+func mapStrings(fn func(s string, ctx *TransformContext) (interface{}, error)) TransformFunc {
+	var apply TransformFunc
+	apply = func(v interface{}, ctx *TransformContext) (interface{}, error) {
+		if list, ok := v.([]interface{}); ok {
+			var result []interface{}
+			for _, item := range list {
+				res, err := apply(item, ctx)
+				if err != nil {
+					return nil, err
+				}
+				if res != nil {
+					result = append(result, res)
+				}
+			}
+
+			if len(result) == 0 {
+				return nil, nil
+			}
+			return result, nil
+		}
+
+		s, err := text(v)
+		if err != nil {
+			return nil, err
+		}
+
+		return fn(s, ctx)
+	}
+
+	return apply
+}
+
+// text returns text of scalar JSON value
+func text(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("Value of type %T isn't a text", v)
+	}
+}
+
+var (
+	htmlTags   = regexp.MustCompile(`(?s)<!--.*?-->|<(script|style)[^>]*>.*?</(script|style)>|<[^>]*>`)
+	whitespace = regexp.MustCompile(`\s+`)
+)
+
+// stripHTML returns text of HTML without tags and entities, whitespace is collapsed
+func stripHTML(s string) string {
+	s = htmlTags.ReplaceAllString(s, " ")
+	s = html.UnescapeString(s)
+
+	return strings.TrimSpace(whitespace.ReplaceAllString(s, " "))
+}
+
+// truncateTransform is 'truncate(length[, suffix])'. Text longer than length runes is cut
+// and suffix is appended, so the result isn't longer than length
+func truncateTransform(args []string) (TransformFunc, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("length and optional suffix expected")
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("length must be a positive integer, got '%s'", args[0])
+	}
+
+	var suffix []rune
+	if len(args) == 2 {
+		suffix = []rune(args[1])
+	}
+
+	if len(suffix) >= n {
+		return nil, errors.New("suffix must be shorter than length")
+	}
+
+	return stringsOf(func(s string) string {
+		r := []rune(s)
+		if len(r) <= n {
+			return s
+		}
+
+		return strings.TrimSpace(string(r[:n-len(suffix)])) + string(suffix)
+	}), nil
+}
+
+// dateLayouts are tried to parse dates of feeds
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC822Z,
+	time.RFC822,
+	time.RFC850,
+	time.ANSIC,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// dateFormats are names of output formats which may be used instead of Go layouts
+var dateFormats = map[string]string{
+	"rfc3339": time.RFC3339,
+	"rfc1123": time.RFC1123Z,
+	"date":    "2006-01-02",
+	"time":    "15:04:05",
+}
+
+// dateTransform is 'date([format[, input layout]])'. Format is a Go layout, one of dateFormats
+// or 'unix' for seconds since epoch, it's RFC 3339 by default. Time is converted to UTC.
+// Dates which can't be parsed are removed
+func dateTransform(args []string) (TransformFunc, error) {
+	if len(args) > 2 {
+		return nil, errors.New("format and optional input layout expected")
+	}
+
+	format := time.RFC3339
+	if len(args) > 0 && args[0] != "" {
+		format = args[0]
+		if f, ok := dateFormats[strings.ToLower(format)]; ok {
+			format = f
+		}
+	}
+
+	layouts := dateLayouts
+	if len(args) == 2 {
+		layouts = []string{args[1]}
+	}
+
+	return mapStrings(func(s string, _ *TransformContext) (interface{}, error) {
+		t, ok := parseDate(s, layouts)
+		if !ok {
+			return nil, nil
+		}
+
+		if strings.EqualFold(format, "unix") {
+			return json.Number(strconv.FormatInt(t.Unix(), 10)), nil
+		}
+		return t.UTC().Format(format), nil
+	}), nil
+}
+
+// parseDate parses date with the first matching layout
+func parseDate(s string, layouts []string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, l := range layouts {
+		if t, err := time.Parse(l, s); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// regexTransform is 'regex(pattern[, group])'. It returns the group of the first match,
+// the first group by default or the whole match if pattern has no groups.
+// Values which don't match are removed
+func regexTransform(args []string) (TransformFunc, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return nil, errors.New("pattern and optional group expected")
+	}
+
+	re, err := regexp.Compile(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	group := 0
+	if re.NumSubexp() > 0 {
+		group = 1
+	}
+
+	if len(args) == 2 {
+		if group, err = strconv.Atoi(args[1]); err != nil {
+			if group = re.SubexpIndex(args[1]); group < 0 {
+				return nil, fmt.Errorf("pattern has no group '%s'", args[1])
+			}
+		}
+	}
+
+	if group < 0 || group > re.NumSubexp() {
+		return nil, fmt.Errorf("pattern has no group %d", group)
+	}
+
+	return mapStrings(func(s string, _ *TransformContext) (interface{}, error) {
+		m := re.FindStringSubmatch(s)
+		if m == nil {
+			return nil, nil
+		}
+
+		return m[group], nil
+	}), nil
+}
+
+// absURL resolves relative URL against the feed link or, if the feed has no link, the item link
+var absURL = mapStrings(func(s string, ctx *TransformContext) (interface{}, error) {
+	ref, err := url.Parse(strings.TrimSpace(s))
+	if err != nil {
+		return nil, nil
+	}
+
+	base := ctx.FeedLink
+	if base == "" && ctx.Item != nil {
+		base = ctx.Item.Link
+	}
+
+	if ref.IsAbs() || base == "" {
+		return ref.String(), nil
+	}
+
+	b, err := url.Parse(base)
+	if err != nil {
+		return ref.String(), nil
+	}
+
+	return b.ResolveReference(ref).String(), nil
+})
+
+// joinTransform is 'join([separator])'. It joins texts of list items, separator is ', ' by default
+func joinTransform(args []string) (TransformFunc, error) {
+	if len(args) > 1 {
+		return nil, errors.New("optional separator expected")
+	}
+
+	sep := ", "
+	if len(args) == 1 {
+		sep = args[0]
+	}
+
+	return func(v interface{}, _ *TransformContext) (interface{}, error) {
+		list, ok := v.([]interface{})
+		if !ok {
+			return text(v)
+		}
+
+		parts := make([]string, 0, len(list))
+		for _, item := range list {
+			s, err := text(item)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, s)
+		}
+
+		return strings.Join(parts, sep), nil
+	}, nil
+}
@@ -0,0 +1,120 @@
+package feeder
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransforms(t *testing.T) {
+	item := &gofeed.Item{
+		Title:       "  Episode 42: Generics  ",
+		Link:        "http://example.com/podcast/42",
+		Description: `<p>Talk about <b>generics</b> &amp; iterators.</p><script>alert(1)</script>`,
+		Published:   "Tue, 10 Jun 2003 04:00:00 GMT",
+		Image:       &gofeed.Image{URL: "/images/42.png"},
+		Categories:  []string{"Go", "Podcast"},
+	}
+
+	tests := []struct {
+		name     string
+		rule     string
+		feedLink string
+		want     string
+	}{
+		{name: "strip html", rule: "description|striphtml=d", want: `{"d":"Talk about generics & iterators."}`},
+		{name: "pipe", rule: "description|striphtml|truncate(10)=d", want: `{"d":"Talk about"}`},
+		{name: "truncate with suffix", rule: `title|trim|truncate(12, "...")=t`, want: `{"t":"Episode 4..."}`},
+		{name: "short text isn't truncated", rule: "title|trim|truncate(100)=t", want: `{"t":"Episode 42: Generics"}`},
+		{name: "lower list", rule: "categories[*]|lower=c", want: `{"c":["go","podcast"]}`},
+		{name: "upper", rule: "categories[0]|upper=c", want: `{"c":"GO"}`},
+		{name: "join", rule: "categories|join=c", want: `{"c":"Go, Podcast"}`},
+		{name: "join with separator", rule: `categories[*]|lower|join(" / ")=c`, want: `{"c":"go / podcast"}`},
+		{name: "date", rule: "published|date=p", want: `{"p":"2003-06-10T04:00:00Z"}`},
+		{name: "date format", rule: "published|date(date)=p", want: `{"p":"2003-06-10"}`},
+		{name: "date go layout", rule: `published|date("Jan 2, 2006")=p`, want: `{"p":"Jun 10, 2003"}`},
+		{name: "unix date", rule: "published|date(unix)=p", want: `{"p":1055217600}`},
+		{name: "date input layout", rule: `title|regex("\d+")|date(date, "2")=p`, want: `{}`},
+		{name: "regex group", rule: `title|regex("Episode (\d+)")=n`, want: `{"n":"42"}`},
+		{name: "regex named group", rule: `title|regex("(?P<num>\d+): (?P<topic>\w+)", topic)=n`, want: `{"n":"Generics"}`},
+		{name: "regex without groups", rule: `title|regex('\d+')=n`, want: `{"n":"42"}`},
+		{name: "regex without match", rule: `title|regex("Season (\d+)")=n`, want: `{}`},
+		{name: "relative url to item link", rule: "image.url|absurl=i", want: `{"i":"http://example.com/images/42.png"}`},
+		{name: "relative url to feed link", rule: "image.url|absurl=i", feedLink: "https://cdn.example.org/feed/",
+			want: `{"i":"https://cdn.example.org/images/42.png"}`},
+		{name: "absolute url", rule: "link|absurl=l", feedLink: "https://cdn.example.org", want: `{"l":"http://example.com/podcast/42"}`},
+		{name: "name defaults to selector", rule: "title|trim|lower", want: `{"title":"episode 42: generics"}`},
+		{name: "transform names ignore case", rule: "title|TRIM=t", want: `{"t":"Episode 42: Generics"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &FeedSource{}
+			if !assert.NoError(t, ImplementRule(s, tt.rule)) {
+				return
+			}
+
+			payload, err := parseItem(&TransformContext{Item: item, FeedLink: tt.feedLink}, s.Rule)
+			if assert.NoError(t, err) {
+				assert.JSONEq(t, tt.want, string(payload))
+			}
+		})
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		wantErr error
+	}{
+		{name: "unknown", rule: "title|shout", wantErr: ErrUnknownTransform},
+		{name: "unexpected arguments", rule: "title|lower(1)", wantErr: ErrRuleSyntax},
+		{name: "missing length", rule: "title|truncate", wantErr: ErrRuleSyntax},
+		{name: "incorrect length", rule: "title|truncate(many)", wantErr: ErrRuleSyntax},
+		{name: "suffix longer than length", rule: `title|truncate(2, "...")`, wantErr: ErrRuleSyntax},
+		{name: "incorrect pattern", rule: `title|regex("(")`, wantErr: ErrRuleSyntax},
+		{name: "missing group", rule: `title|regex("a", 1)`, wantErr: ErrRuleSyntax},
+		{name: "unquoted parenthesis", rule: `title|regex(a(b)`, wantErr: ErrRuleSyntax},
+		{name: "unclosed parenthesis", rule: "title|truncate(3", wantErr: ErrRuleSyntax},
+		{name: "empty transform", rule: "title||lower", wantErr: ErrRuleSyntax},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ImplementRule(&FeedSource{}, tt.rule)
+			assert.True(t, errors.Is(err, tt.wantErr), "unexpected error %v", err)
+		})
+	}
+
+	s := &FeedSource{}
+	if assert.NoError(t, ImplementRule(s, "author|lower=a,title=t")) {
+		payload, err := parseFeedItem(&gofeed.Item{Title: "T", Author: &gofeed.Person{Name: "A"}}, s.Rule)
+		assert.Error(t, err, "transform of object should fail")
+		assert.JSONEq(t, `{"t":"T"}`, string(payload), "other fields should be saved")
+	}
+}
+
+func TestRegisterTransform(t *testing.T) {
+	s := &FeedSource{}
+	assert.True(t, errors.Is(ImplementRule(s, "title|repeat(2)"), ErrUnknownTransform))
+
+	RegisterTransform("Repeat", func(args []string) (TransformFunc, error) {
+		if len(args) != 1 {
+			return nil, errors.New("count expected")
+		}
+
+		return func(v interface{}, _ *TransformContext) (interface{}, error) {
+			return strings.Repeat(v.(string), len(args[0])), nil
+		}, nil
+	})
+
+	if assert.NoError(t, ImplementRule(s, "title|repeat(22)=t")) {
+		payload, err := parseFeedItem(&gofeed.Item{Title: "ab"}, s.Rule)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"t":"abab"}`, string(payload))
+	}
+}
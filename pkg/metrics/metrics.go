@@ -0,0 +1,141 @@
+// Package metrics keeps Prometheus metrics of the feeder, the API server and the storage
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "feeder"
+
+// Results of feed items
+const (
+	ItemParsed     = "parsed"
+	ItemInserted   = "inserted"
+	ItemUpdated    = "updated"
+	ItemDuplicated = "duplicated"
+	ItemFailed     = "failed"
+	ItemFiltered   = "filtered"
+)
+
+var (
+	// Registry keeps every metric of the package and Go runtime metrics
+	Registry = prometheus.NewRegistry()
+
+	// Fetches counts feed readings by source ID and result: ok, not_modified or error
+	Fetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "fetches_total",
+		Help:      "Feed readings by source and result.",
+	}, []string{"source", "result"})
+
+	// FetchDuration observes time of feed readings including saving of their news
+	FetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "fetch_duration_seconds",
+		Help:      "Time of feed readings by source.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"source"})
+
+	// Items counts feed items by source ID and one of Item results
+	Items = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "items_total",
+		Help:      "Feed items by source and result: parsed, filtered, inserted, updated, duplicated or failed.",
+	}, []string{"source", "result"})
+
+	// HTTPDuration observes API requests by route template, method and status
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	// QueryDuration observes storage operations by backend and operation
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time of database operations by backend and operation.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"backend", "operation"})
+
+	lastSuccess = &sinceCollector{
+		desc: prometheus.NewDesc(namespace+"_source_seconds_since_last_success",
+			"Time since the last successful reading of source.", []string{"source"}, nil),
+		times: make(map[string]time.Time),
+	}
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Fetches, FetchDuration, Items, HTTPDuration, QueryDuration, lastSuccess,
+	)
+}
+
+// Handler serves metrics in Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Source returns label value of the source
+func Source(id int) string {
+	return strconv.Itoa(id)
+}
+
+// SetLastSuccess sets time of the last successful reading of source. Zero time is ignored
+func SetLastSuccess(sourceID int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	lastSuccess.mut.Lock()
+	defer lastSuccess.mut.Unlock()
+
+	lastSuccess.times[Source(sourceID)] = t
+}
+
+// ForgetSource drops every series of the source, so deleted or stopped sources
+// aren't reported as stale forever
+func ForgetSource(sourceID int) {
+	source := Source(sourceID)
+	labels := prometheus.Labels{"source": source}
+
+	Fetches.DeletePartialMatch(labels)
+	FetchDuration.DeletePartialMatch(labels)
+	Items.DeletePartialMatch(labels)
+
+	lastSuccess.mut.Lock()
+	defer lastSuccess.mut.Unlock()
+
+	delete(lastSuccess.times, source)
+}
+
+// sinceCollector reports time elapsed since the saved moments at the time of scraping
+type sinceCollector struct {
+	desc  *prometheus.Desc
+	mut   sync.Mutex
+	times map[string]time.Time
+}
+
+func (c *sinceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *sinceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	now := time.Now()
+	for label, t := range c.times {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(t).Seconds(), label)
+	}
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetLastSuccess(t *testing.T) {
+	SetLastSuccess(1, time.Time{})
+	assert.Equal(t, 0, testutil.CollectAndCount(lastSuccess), "zero time should be ignored")
+
+	SetLastSuccess(1, time.Now().Add(-time.Hour))
+	assert.Equal(t, 1, testutil.CollectAndCount(lastSuccess, "feeder_source_seconds_since_last_success"))
+	assert.InDelta(t, 3600, testutil.ToFloat64(lastSuccess), 5, "elapsed time should be computed when metrics are collected")
+}
+
+func TestForgetSource(t *testing.T) {
+	SetLastSuccess(2, time.Now())
+	SetLastSuccess(3, time.Now())
+	Fetches.WithLabelValues("2", "ok").Inc()
+	FetchDuration.WithLabelValues("2").Observe(1)
+	Items.WithLabelValues("2", ItemInserted).Inc()
+	Items.WithLabelValues("3", ItemInserted).Inc()
+
+	ForgetSource(2)
+
+	assert.Equal(t, 0, testutil.CollectAndCount(Fetches))
+	assert.Equal(t, 0, testutil.CollectAndCount(FetchDuration))
+	assert.Equal(t, 1, testutil.CollectAndCount(Items), "series of other sources should be kept")
+
+	lastSuccess.mut.Lock()
+	defer lastSuccess.mut.Unlock()
+
+	assert.NotContains(t, lastSuccess.times, "2")
+	assert.Contains(t, lastSuccess.times, "3")
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bsbsm/feeder/pkg/db"
+)
+
+// Codes of API errors
+const (
+	CodeBadRequest     = "bad_request"
+	CodeNotFound       = "not_found"
+	CodeIncorrectArgs  = "incorrect_arguments"
+	CodeAlreadyExists  = "already_exists"
+	CodeBadGateway     = "bad_gateway"
+	CodeInternalError  = "internal_error"
+	internalErrMessage = "Internal server error"
+)
+
+// ErrorResponse is a body of every failed API response
+type ErrorResponse struct {
+	Error APIError `json:"Error"`
+}
+
+// APIError describes why request failed. Code is one of Code constants
+type APIError struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message"`
+	// Details lists incorrect fields of feed source
+	Details []FieldError `json:"Details,omitempty"`
+}
+
+// FieldError is an incorrect field of request. Expr is the incorrect field of rule or condition of filter
+type FieldError struct {
+	Field   string `json:"Field"`
+	Expr    string `json:"Expr,omitempty"`
+	Message string `json:"Message"`
+}
+
+// fieldErrors converts errors of feed source validation
+func fieldErrors(errs []db.FieldError) []FieldError {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	result := make([]FieldError, 0, len(errs))
+	for _, e := range errs {
+		result = append(result, FieldError{Field: e.Field, Expr: e.Expr, Message: e.Message})
+	}
+
+	return result
+}
+
+// requestError is a malformed request, e.g. a parameter which isn't a number
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{msg: fmt.Sprintf(format, args...)}
+}
+
+// feedError is a failure to read or parse the feed requested by client
+type feedError struct {
+	err error
+}
+
+func (e *feedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *feedError) Unwrap() error {
+	return e.err
+}
+
+// apiHandler is a handler which returns error instead of responding with it
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+func (h apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h(w, r); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// errorStatus returns HTTP status and code of API error
+func errorStatus(err error) (int, string) {
+	var reqErr *requestError
+	var feedErr *feedError
+
+	switch {
+	case errors.As(err, &reqErr):
+		return http.StatusBadRequest, CodeBadRequest
+	case errors.As(err, &feedErr):
+		return http.StatusBadGateway, CodeBadGateway
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound, CodeNotFound
+	case errors.Is(err, db.ErrIncorrectArgs):
+		return http.StatusUnprocessableEntity, CodeIncorrectArgs
+	case errors.Is(err, db.ErrAlreadyExists):
+		return http.StatusConflict, CodeAlreadyExists
+	default:
+		return http.StatusInternalServerError, CodeInternalError
+	}
+}
+
+// writeError responds with error envelope. Messages of internal errors
+// are only logged, because they may reveal details of the storage
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+
+	msg := err.Error()
+	if status == http.StatusInternalServerError {
+		fmt.Printf("Error while serve request %s: %s\n", r.URL, err)
+		msg = internalErrMessage
+	}
+
+	apiErr := APIError{Code: code, Message: msg}
+
+	var verr *db.ValidationError
+	if errors.As(err, &verr) {
+		apiErr.Details = fieldErrors(verr.Errors)
+	}
+
+	rsp, _ := json.Marshal(ErrorResponse{Error: apiErr})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write(rsp); err != nil {
+		fmt.Printf("Error while write response to %s: %s\n", r.RemoteAddr, err)
+	}
+}
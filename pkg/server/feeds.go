@@ -0,0 +1,521 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/gorilla/mux"
+)
+
+// feedItemsDefault is a count of news in the aggregated feed if 'c' isn't set
+const feedItemsDefault = 50
+
+const feedTitle = "Feeder"
+
+// Names of payload fields which entry parts are taken from. Rules name fields as they like,
+// so names are compared ignoring case and the first present field is used
+var (
+	titleFields    = []string{"title"}
+	linkFields     = []string{"link", "url"}
+	summaryFields  = []string{"description", "summary"}
+	contentFields  = []string{"content", "body"}
+	authorFields   = []string{"author", "authors", "creator"}
+	categoryFields = []string{"categories", "category", "tags"}
+	imageFields    = []string{"image", "thumbnail"}
+)
+
+// aggregatedFeed is the stream of news in syndication formats
+type aggregatedFeed struct {
+	Title   string
+	Link    string
+	Self    string
+	Updated time.Time
+	Entries []*feedEntry
+}
+
+// feedEntry is news built from payload fields which the source rule extracted.
+// Fields which aren't known entry parts make the content if payload has no content
+type feedEntry struct {
+	ID         string
+	Title      string
+	Link       string
+	Summary    string
+	Content    string
+	Author     string
+	Image      string
+	Source     string
+	Categories []string
+	Date       time.Time
+}
+
+// feedFormat renders the feed
+type feedFormat struct {
+	contentType string
+	render      func(w io.Writer, f *aggregatedFeed) error
+}
+
+var feedFormats = map[string]feedFormat{
+	"rss":  {"application/rss+xml; charset=utf-8", renderRSS},
+	"atom": {"application/atom+xml; charset=utf-8", renderAtom},
+	"json": {"application/feed+json; charset=utf-8", renderJSONFeed},
+}
+
+// getFeed renders the aggregated stream as RSS 2.0 'rss', Atom 1.0 'atom' or JSON Feed 1.1 'json'.
+// News are filtered like news list and by full-text query 'q'. News are the newest first by default
+func (s *Server) getFeed(w http.ResponseWriter, r *http.Request) error {
+	name := mux.Vars(r)["format"]
+	format, exist := feedFormats[name]
+	if !exist {
+		return fmt.Errorf("%w: unknown feed format '%s'", db.ErrNotFound, name)
+	}
+
+	q, err := newsQueryParams(r)
+	if err != nil {
+		return err
+	}
+
+	params := r.URL.Query()
+	if params.Get("c") == "" {
+		q.Count = feedItemsDefault
+	}
+	if params.Get("sort") == "" {
+		q.Desc = true
+	}
+
+	q.Search, q.WithPayload = params.Get("q"), true
+
+	news, err := s.store.QueryNews(q)
+	if err != nil {
+		return err
+	}
+
+	base := baseURL(r)
+	f := &aggregatedFeed{Title: feedTitle, Link: base + "/", Self: base + r.URL.RequestURI()}
+
+	for _, n := range news {
+		e := newFeedEntry(base, n)
+		if e.Date.After(f.Updated) {
+			f.Updated = e.Date
+		}
+		f.Entries = append(f.Entries, e)
+	}
+
+	if f.Updated.IsZero() {
+		f.Updated = time.Now()
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+
+	return format.render(w, f)
+}
+
+// baseURL returns scheme and host which the request is sent to
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
+func newFeedEntry(base string, n *db.News) *feedEntry {
+	e := &feedEntry{
+		ID:     "urn:feeder:news:" + strconv.Itoa(n.ID),
+		Title:  n.Title,
+		Link:   base + "/api/news/" + strconv.Itoa(n.ID),
+		Source: n.Source,
+		Date:   n.AddedAt,
+	}
+	if n.PublishedAt != nil {
+		e.Date = *n.PublishedAt
+	}
+
+	var payload map[string]json.RawMessage
+	if json.Unmarshal([]byte(n.PayloadJSON), &payload) != nil {
+		e.Content = n.PayloadJSON
+		return e
+	}
+
+	fields := make(map[string]json.RawMessage, len(payload))
+	for k, v := range payload {
+		fields[strings.ToLower(k)] = v
+	}
+
+	used := make(map[string]bool)
+	take := func(names []string, keys ...string) []string {
+		for _, name := range names {
+			if v, exist := fields[name]; exist {
+				used[name] = true
+				return payloadStrings(v, keys...)
+			}
+		}
+		return nil
+	}
+
+	if v := take(titleFields); len(v) > 0 {
+		e.Title = v[0]
+	}
+	if v := take(linkFields, "href", "url"); len(v) > 0 {
+		e.Link = v[0]
+	}
+	e.Summary = strings.Join(take(summaryFields), "\n")
+	e.Content = strings.Join(take(contentFields), "\n")
+	e.Author = strings.Join(take(authorFields, "name", "email"), ", ")
+	e.Categories = take(categoryFields, "term", "name")
+	if v := take(imageFields, "url"); len(v) > 0 {
+		e.Image = v[0]
+	}
+
+	if e.Summary == "" && e.Content == "" {
+		e.Content = otherFields(payload, used)
+	}
+
+	return e
+}
+
+// payloadStrings returns text of payload field. Objects are represented by their first
+// string field of keys, arrays by all their items
+func payloadStrings(raw json.RawMessage, keys ...string) []string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
+
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) == nil {
+		var result []string
+		for _, item := range items {
+			result = append(result, payloadStrings(item, keys...)...)
+		}
+		return result
+	}
+
+	var object map[string]json.RawMessage
+	if json.Unmarshal(raw, &object) == nil {
+		for _, k := range keys {
+			if v, exist := object[k]; exist {
+				return payloadStrings(v)
+			}
+		}
+		return nil
+	}
+
+	if string(raw) == "null" {
+		return nil
+	}
+
+	return []string{string(raw)}
+}
+
+// otherFields returns HTML list of payload fields which aren't used by the entry
+func otherFields(payload map[string]json.RawMessage, used map[string]bool) string {
+	var names []string
+	for k := range payload {
+		if !used[strings.ToLower(k)] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, k := range names {
+		v := strings.Join(payloadStrings(payload[k], "name", "url"), ", ")
+		if v == "" {
+			continue
+		}
+		b.WriteString("<p><b>" + xmlEscape(k) + "</b>: " + xmlEscape(v) + "</p>")
+	}
+
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+
+	return b.String()
+}
+
+type rssFeed struct {
+	XMLName   xml.Name   `xml:"rss"`
+	Version   string     `xml:"version,attr"`
+	AtomNS    string     `xml:"xmlns:atom,attr"`
+	ContentNS string     `xml:"xmlns:content,attr"`
+	DCNS      string     `xml:"xmlns:dc,attr"`
+	Channel   rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Self          atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Link        string       `xml:"link"`
+	Description string       `xml:"description,omitempty"`
+	Content     string       `xml:"content:encoded,omitempty"`
+	Creator     string       `xml:"dc:creator,omitempty"`
+	Categories  []string     `xml:"category"`
+	Enclosure   *rssImage    `xml:"enclosure"`
+	GUID        rssGUID      `xml:"guid"`
+	PubDate     string       `xml:"pubDate"`
+	Source      *rssSourceEl `xml:"source"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssImage struct {
+	URL    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int    `xml:"length,attr"`
+}
+
+type rssSourceEl struct {
+	URL   string `xml:"url,attr"`
+	Value string `xml:",chardata"`
+}
+
+func renderRSS(w io.Writer, f *aggregatedFeed) error {
+	rss := rssFeed{
+		Version:   "2.0",
+		AtomNS:    "http://www.w3.org/2005/Atom",
+		ContentNS: "http://purl.org/rss/1.0/modules/content/",
+		DCNS:      "http://purl.org/dc/elements/1.1/",
+		Channel: rssChannel{
+			Title:         f.Title,
+			Link:          f.Link,
+			Description:   "News aggregated by " + f.Title,
+			LastBuildDate: f.Updated.UTC().Format(time.RFC1123Z),
+			Self:          atomLink{Href: f.Self, Rel: "self", Type: "application/rss+xml"},
+		},
+	}
+
+	for _, e := range f.Entries {
+		item := rssItem{
+			Title:       e.Title,
+			Link:        e.Link,
+			Description: e.Summary,
+			Content:     e.Content,
+			Creator:     e.Author,
+			Categories:  e.Categories,
+			GUID:        rssGUID{Value: e.ID},
+			PubDate:     e.Date.UTC().Format(time.RFC1123Z),
+		}
+		if item.Description == "" {
+			item.Description, item.Content = e.Content, ""
+		}
+		if e.Image != "" {
+			item.Enclosure = &rssImage{URL: e.Image, Type: imageType(e.Image)}
+		}
+		if e.Source != "" {
+			item.Source = &rssSourceEl{URL: e.Source, Value: e.Source}
+		}
+
+		rss.Channel.Items = append(rss.Channel.Items, item)
+	}
+
+	return writeXML(w, rss)
+}
+
+// imageType guesses MIME type of image by its URL
+func imageType(u string) string {
+	u = strings.ToLower(u)
+	if i := strings.IndexAny(u, "?#"); i >= 0 {
+		u = u[:i]
+	}
+
+	switch {
+	case strings.HasSuffix(u, ".png"):
+		return "image/png"
+	case strings.HasSuffix(u, ".gif"):
+		return "image/gif"
+	case strings.HasSuffix(u, ".webp"):
+		return "image/webp"
+	default:
+		return "image/jpeg"
+	}
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Author  atomAuthor  `xml:"author"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published"`
+	Links      []atomLink     `xml:"link"`
+	Author     *atomAuthor    `xml:"author"`
+	Summary    *atomText      `xml:"summary"`
+	Content    *atomText      `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+func renderAtom(w io.Writer, f *aggregatedFeed) error {
+	feed := atomFeed{
+		Title:   f.Title,
+		ID:      f.Self,
+		Updated: f.Updated.UTC().Format(time.RFC3339),
+		Links:   []atomLink{{Href: f.Self, Rel: "self"}, {Href: f.Link, Rel: "alternate"}},
+		Author:  atomAuthor{Name: f.Title},
+	}
+
+	for _, e := range f.Entries {
+		date := e.Date.UTC().Format(time.RFC3339)
+		entry := atomEntry{
+			ID:        e.ID,
+			Title:     e.Title,
+			Updated:   date,
+			Published: date,
+			Links:     []atomLink{{Href: e.Link, Rel: "alternate"}},
+		}
+		if e.Source != "" {
+			entry.Links = append(entry.Links, atomLink{Href: e.Source, Rel: "via"})
+		}
+		if e.Image != "" {
+			entry.Links = append(entry.Links, atomLink{Href: e.Image, Rel: "enclosure", Type: imageType(e.Image)})
+		}
+		if e.Author != "" {
+			entry.Author = &atomAuthor{Name: e.Author}
+		}
+		if e.Summary != "" {
+			entry.Summary = &atomText{Type: "html", Value: e.Summary}
+		}
+		if e.Content != "" {
+			entry.Content = &atomText{Type: "html", Value: e.Content}
+		}
+		for _, c := range e.Categories {
+			entry.Categories = append(entry.Categories, atomCategory{Term: c})
+		}
+
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	return writeXML(w, feed)
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	return xml.NewEncoder(w).Encode(v)
+}
+
+type jsonFeed struct {
+	Version     string          `json:"version"`
+	Title       string          `json:"title"`
+	HomePageURL string          `json:"home_page_url"`
+	FeedURL     string          `json:"feed_url"`
+	Items       []*jsonFeedItem `json:"items"`
+}
+
+type jsonFeedItem struct {
+	ID            string           `json:"id"`
+	URL           string           `json:"url,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	ContentHTML   string           `json:"content_html,omitempty"`
+	ContentText   string           `json:"content_text,omitempty"`
+	Summary       string           `json:"summary,omitempty"`
+	Image         string           `json:"image,omitempty"`
+	DatePublished string           `json:"date_published"`
+	Authors       []jsonFeedAuthor `json:"authors,omitempty"`
+	Tags          []string         `json:"tags,omitempty"`
+	// Source is the feed which news is read from. It's an extension, because external_url
+	// of JSON Feed is a page which the item is about
+	Source *jsonFeedSource `json:"_source,omitempty"`
+}
+
+type jsonFeedSource struct {
+	URL string `json:"url"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+}
+
+func renderJSONFeed(w io.Writer, f *aggregatedFeed) error {
+	feed := jsonFeed{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       f.Title,
+		HomePageURL: f.Link,
+		FeedURL:     f.Self,
+		Items:       []*jsonFeedItem{},
+	}
+
+	for _, e := range f.Entries {
+		item := &jsonFeedItem{
+			ID:            e.ID,
+			URL:           e.Link,
+			Title:         e.Title,
+			ContentHTML:   e.Content,
+			Summary:       e.Summary,
+			Image:         e.Image,
+			DatePublished: e.Date.UTC().Format(time.RFC3339),
+			Tags:          e.Categories,
+		}
+		// item must have content
+		if item.ContentHTML == "" {
+			item.ContentText = e.Summary
+			if item.ContentText == "" {
+				item.ContentText = e.Title
+			}
+		}
+		if e.Author != "" {
+			item.Authors = []jsonFeedAuthor{{Name: e.Author}}
+		}
+		if e.Source != "" {
+			item.Source = &jsonFeedSource{URL: e.Source}
+		}
+
+		feed.Items = append(feed.Items, item)
+	}
+
+	return json.NewEncoder(w).Encode(feed)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/mmcdole/gofeed"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFeedStore(t *testing.T) *db.MemoryDatabase {
+	store := &db.MemoryDatabase{}
+	assert.NoError(t, createSource(store, "http://source1", "title"))
+	assert.NoError(t, createSource(store, "http://source2", "title"))
+
+	news := []struct {
+		sourceID  int
+		title     string
+		payload   string
+		published time.Time
+	}{
+		{1, "Go release", `{"Headline":"Go 1.30 is released","Link":"http://go.dev/blog","Body":"<p>New <b>Go</b></p>",` +
+			`"Author":{"name":"Gopher"},"Categories":["go","release"],"Image":{"url":"http://go.dev/gopher.png"}}`,
+			time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)},
+		{2, "Rust release", `{"description":"Rust is released","rating":5}`, time.Time{}},
+		{1, "Weather", `{"temperature":20,"city":"Paris"}`, time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+	}
+	for i, n := range news {
+		_, _, err := store.CreateNews(n.sourceID, string(rune('a'+i)), n.title, []byte(n.payload), n.published)
+		assert.NoError(t, err)
+	}
+
+	return store
+}
+
+func TestGetFeed(t *testing.T) {
+	for _, format := range []string{"rss", "atom", "json"} {
+		t.Run(format, func(t *testing.T) {
+			rec := serve(t, newFeedStore(t), http.MethodGet, "/api/feeds/"+format)
+			if !assert.Equal(t, http.StatusOK, rec.Code) {
+				return
+			}
+			assert.Equal(t, feedFormats[format].contentType, rec.Header().Get("Content-Type"))
+
+			feed, err := gofeed.NewParser().ParseString(rec.Body.String())
+			if !assert.NoError(t, err) || !assert.Len(t, feed.Items, 3) {
+				return
+			}
+
+			assert.Equal(t, feedTitle, feed.Title)
+
+			weather, rust, golang := feed.Items[0], feed.Items[1], feed.Items[2]
+			assert.Equal(t, "Rust release", rust.Title, "the newest news should be the first")
+
+			assert.Equal(t, "Go release", golang.Title)
+			assert.Equal(t, "http://go.dev/blog", golang.Link)
+			assert.Equal(t, "urn:feeder:news:1", golang.GUID)
+			assert.Contains(t, golang.Content+golang.Description, "<b>Go</b>")
+			assert.Equal(t, []string{"go", "release"}, golang.Categories)
+			if assert.NotNil(t, golang.PublishedParsed) {
+				assert.True(t, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC).Equal(*golang.PublishedParsed))
+			}
+			if assert.NotEmpty(t, golang.Authors) {
+				assert.Equal(t, "Gopher", golang.Authors[0].Name)
+			}
+
+			assert.Equal(t, "Rust is released", rust.Description)
+			assert.Equal(t, "http://example.com/api/news/2", rust.Link, "news without link should link to API")
+			assert.Contains(t, weather.Content+weather.Description, "Paris",
+				"fields should make content if payload has no content")
+		})
+	}
+}
+
+func TestGetJSONFeedSource(t *testing.T) {
+	rec := serve(t, newFeedStore(t), http.MethodGet, "/api/feeds/json?src=2")
+	if !assert.Equal(t, http.StatusOK, rec.Code) {
+		return
+	}
+
+	var feed struct {
+		Items []map[string]json.RawMessage `json:"items"`
+	}
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &feed)) && assert.Len(t, feed.Items, 1) {
+		assert.NotContains(t, feed.Items[0], "external_url", "the item isn't about its source feed")
+		assert.JSONEq(t, `{"url":"http://source2"}`, string(feed.Items[0]["_source"]))
+	}
+}
+
+func TestGetFeedFilters(t *testing.T) {
+	titles := func(url string) []string {
+		rec := serve(t, newFeedStore(t), http.MethodGet, url)
+		if !assert.Equal(t, http.StatusOK, rec.Code) {
+			return nil
+		}
+
+		feed, err := gofeed.NewParser().ParseString(rec.Body.String())
+		if !assert.NoError(t, err) {
+			return nil
+		}
+
+		var result []string
+		for _, item := range feed.Items {
+			result = append(result, item.Title)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"Weather", "Go release"}, titles("/api/feeds/atom?src=1"))
+	assert.Equal(t, []string{"Rust release", "Go release"}, titles("/api/feeds/json?q=released"))
+	assert.Equal(t, []string{"Go release"}, titles("/api/feeds/rss?q=released&src=1"))
+	assert.Empty(t, titles("/api/feeds/rss?q=nothing"))
+	assert.Equal(t, []string{"Go release"}, titles("/api/feeds/rss?c=1&sort=added"))
+
+	rec := serve(t, newFeedStore(t), http.MethodGet, "/api/feeds/csv")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestGetFeedSearchFilters(t *testing.T) {
+	store := newFeedStore(t)
+	for i := 0; i < maxCountParamValue; i++ {
+		_, _, err := store.CreateNews(1, "released"+strconv.Itoa(i), "Released "+strconv.Itoa(i), nil, time.Time{})
+		assert.NoError(t, err)
+	}
+
+	rec := serve(t, store, http.MethodGet, "/api/feeds/json?q=released&src=2")
+	if !assert.Equal(t, http.StatusOK, rec.Code) {
+		return
+	}
+
+	feed, err := gofeed.NewParser().ParseString(rec.Body.String())
+	if assert.NoError(t, err) && assert.Len(t, feed.Items, 1, "filters must not be applied to the most relevant news only") {
+		assert.Equal(t, "Rust release", feed.Items[0].Title)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bsbsm/feeder/pkg/db"
@@ -14,99 +15,338 @@ import (
 
 const maxCountParamValue = 100
 
-var storage *db.SQLiteDatabase
+// getNewsList returns page of news. News are filtered by title substring 't',
+// source IDs 'src', time ranges 'added_from', 'added_to', 'published_from', 'published_to'
+// and payload fields 'f' which are 'name' to check existence or 'name:value' to check value.
+// Sort order 'sort' is 'added', '-added', 'published' or '-published', minus means descending.
+// If 'cursor' parameter is present, news are paged by cursors instead of offset
+// and newsPage is returned. Empty cursor means the first page
+func (s *Server) getNewsList(w http.ResponseWriter, r *http.Request) error {
+	q, err := newsQueryParams(r)
+	if err != nil {
+		return err
+	}
 
-func getNewsList(w http.ResponseWriter, r *http.Request) {
-	offsetStr := r.URL.Query().Get("off")
-	countStr := r.URL.Query().Get("c")
-	titleSearchStr := r.URL.Query().Get("t")
+	var result interface{}
 
-	var offset, count int
-	var err error
+	if _, paged := r.URL.Query()["cursor"]; paged {
+		result, err = s.newsPage(q, r.URL.Query().Get("cursor"))
+	} else {
+		result, err = s.store.QueryNews(q)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, result)
+}
 
-	if offsetStr != "" {
-		offset, err = strconv.Atoi(offsetStr)
+// newsPage is a page of news with cursors of the next and the previous pages.
+// Cursor is empty if there is no such page
+type newsPage struct {
+	Items []*db.News `json:"Items"`
+	Next  string     `json:"Next,omitempty"`
+	Prev  string     `json:"Prev,omitempty"`
+}
+
+// newsPage returns page of news following or preceding the cursor token
+func (s *Server) newsPage(q *db.NewsQuery, token string) (*newsPage, error) {
+	if token != "" {
+		c, err := db.ParseNewsCursor(token)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
+		q.Cursor = c
 	}
 
-	if countStr != "" {
-		count, err = strconv.Atoi(countStr)
-		if err != nil {
-			panic(err)
+	// one extra news shows whether there is a page after this one
+	count := q.Count
+	q.Count++
+
+	items, err := s.store.QueryNews(q)
+	if err != nil {
+		return nil, err
+	}
+
+	before := q.Cursor != nil && q.Cursor.Before
+	more := len(items) > count
+	if more && before {
+		items = items[1:]
+	} else if more {
+		items = items[:count]
+	}
+
+	page := &newsPage{Items: items}
+	if page.Items == nil {
+		page.Items = []*db.News{}
+	}
+
+	if len(items) == 0 {
+		return page, nil
+	}
+
+	first, last := items[0], items[len(items)-1]
+
+	if more || q.Cursor != nil && before {
+		page.Next = (&db.NewsCursor{AddedAt: last.AddedAt, ID: last.ID}).String()
+	}
+
+	if more && before || q.Cursor != nil && !before {
+		page.Prev = (&db.NewsCursor{AddedAt: first.AddedAt, ID: first.ID, Before: true}).String()
+	}
+
+	return page, nil
+}
+
+// newsQueryParams parses parameters of news list
+func newsQueryParams(r *http.Request) (*db.NewsQuery, error) {
+	params := r.URL.Query()
+
+	q := &db.NewsQuery{Title: params.Get("t")}
+
+	var err error
+	if q.Offset, q.Count, err = pageParams(r); err != nil {
+		return nil, err
+	}
+
+	if _, paged := params["cursor"]; paged {
+		q.Offset = 0
+	}
+
+	if q.SourceIDs, err = sourceIDsParam(r); err != nil {
+		return nil, err
+	}
+
+	times := []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"added_from", &q.AddedFrom},
+		{"added_to", &q.AddedTo},
+		{"published_from", &q.PublishedFrom},
+		{"published_to", &q.PublishedTo},
+	}
+	for _, t := range times {
+		if v := params.Get(t.name); v != "" {
+			parsed, err := parseTimeParam(v)
+			if err != nil {
+				return nil, badRequest("incorrect '%s' time '%s'", t.name, v)
+			}
+			*t.dst = parsed
+		}
+	}
+
+	for _, f := range params["f"] {
+		nameAndValue := strings.SplitN(f, ":", 2)
+
+		filter := db.FieldFilter{Name: nameAndValue[0]}
+		if len(nameAndValue) == 2 {
+			filter.Value = &nameAndValue[1]
+		}
+		q.Fields = append(q.Fields, filter)
+	}
+
+	switch sort := params.Get("sort"); sort {
+	case "", "added":
+	case "-added":
+		q.Desc = true
+	case "published":
+		q.SortBy = db.SortByPublished
+	case "-published":
+		q.SortBy, q.Desc = db.SortByPublished, true
+	default:
+		return nil, fmt.Errorf("%w: unknown sort order '%s'", db.ErrIncorrectArgs, sort)
+	}
+
+	return q, nil
+}
+
+// sourceIDsParam returns source IDs 'src' which are separated by commas or repeated
+func sourceIDsParam(r *http.Request) ([]int, error) {
+	var ids []int
+
+	for _, src := range r.URL.Query()["src"] {
+		for _, idStr := range strings.Split(src, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(idStr))
+			if err != nil {
+				return nil, badRequest("incorrect source ID '%s'", idStr)
+			}
+			ids = append(ids, id)
 		}
 	}
 
+	return ids, nil
+}
+
+// parseTimeParam parses RFC 3339 time or date which means its midnight in UTC
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+
+	return time.Parse("2006-01-02", v)
+}
+
+// pageParams returns offset 'off' and count 'c' of requested news page.
+// Count is 10 by default and is limited by maxCountParamValue
+func pageParams(r *http.Request) (int, int, error) {
+	offset, err := intParam(r, "off")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	count, err := intParam(r, "c")
+	if err != nil {
+		return 0, 0, err
+	}
+
 	if count <= 0 {
 		count = 10
 	} else if count > maxCountParamValue {
 		count = maxCountParamValue
 	}
 
-	var result []*db.News
+	return offset, count, nil
+}
 
-	if titleSearchStr == "" {
-		result, err = storage.GetNews(offset, count)
-	} else {
-		result, err = storage.GetNewsWithTitle(titleSearchStr, offset, count)
+// intParam returns integer query parameter or 0 if it's absent
+func intParam(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
 	}
 
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		panic(err)
+		return 0, badRequest("'%s' must be an integer, got '%s'", name, v)
 	}
 
-	rsp, err := json.Marshal(result)
+	return n, nil
+}
+
+// pathID returns integer 'id' of the path
+func pathID(r *http.Request) (int, error) {
+	v := mux.Vars(r)["id"]
 
+	id, err := strconv.Atoi(v)
 	if err != nil {
-		panic(err)
+		return 0, badRequest("ID must be an integer, got '%s'", v)
 	}
 
-	fmt.Printf("\tJSON response:\n%s\n", string(rsp))
+	return id, nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(rsp); err != nil {
-		panic(err)
+// searchNews finds news by full-text query 'q' in titles and payloads from the most relevant
+func (s *Server) searchNews(w http.ResponseWriter, r *http.Request) error {
+	offset, count, err := pageParams(r)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.store.SearchNews(r.URL.Query().Get("q"), offset, count)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getNewsByID(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
 	}
+
+	d, err := s.store.GetNewsDetail(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, d)
 }
 
-func getNewsByID(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
+func (s *Server) getNewsRevisions(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := s.store.GetNewsRevisions(id)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	d, err := storage.GetNewsDetail(id)
+	return writeJSON(w, http.StatusOK, revisions)
+}
 
+// getNewsDiff compares revisions 'from' and 'to' of news.
+// By default the current revision is compared with the previous one
+func (s *Server) getNewsDiff(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	rsp, err := json.Marshal(d)
+	revisions, err := s.store.GetNewsRevisions(id)
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	fmt.Printf("\tJSON response:\n%s\n", string(rsp))
+	to := len(revisions)
+	if r.URL.Query().Get("to") != "" {
+		if to, err = intParam(r, "to"); err != nil {
+			return err
+		}
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	if _, err = w.Write(rsp); err != nil {
-		panic(err)
+	from := to - 1
+	if r.URL.Query().Get("from") != "" {
+		if from, err = intParam(r, "from"); err != nil {
+			return err
+		}
+	}
+
+	if from < 1 || to < 1 || from > len(revisions) || to > len(revisions) {
+		return fmt.Errorf("%w: revisions %d and %d of news %d", db.ErrNotFound, from, to, id)
 	}
+
+	return writeJSON(w, http.StatusOK, db.DiffNewsRevisions(revisions[from-1], revisions[to-1]))
 }
 
-func createFeedSource(w http.ResponseWriter, r *http.Request) {
+func (s *Server) createFeedSource(w http.ResponseWriter, r *http.Request) error {
 	url := r.URL.Query().Get("u")
 	rule := r.URL.Query().Get("r")
 
-	if err := storage.CreateFeedSource(url, rule); err != nil {
-		panic(err)
+	interval, err := intParam(r, "i")
+	if err != nil {
+		return err
+	}
+
+	src := &db.Source{URL: url, Rule: rule, Interval: time.Duration(interval) * time.Second}
+	if _, err = s.store.CreateFeedSource(src); err != nil {
+		return err
 	}
 
 	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// writeJSON responds with JSON of v
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	rsp, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(rsp)
+
+	return err
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
@@ -118,15 +358,21 @@ func jsHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "../web/scripts.js")
 }
 
+// panicHandler responds with internal error if handler panics. http.ErrAbortHandler
+// is panicked again, because it aborts the response on purpose
 func panicHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
 				const size = 64 << 10
 				var b = make([]byte, size)
 				b = b[:runtime.Stack(b, false)]
-				fmt.Println(fmt.Sprintf("Client %s panic while serve request %s: %s", r.RemoteAddr, r.URL, err))
-				panic(err)
+				fmt.Println(fmt.Sprintf("Client %s panic while serve request %s: %s\n%s", r.RemoteAddr, r.URL, err, b))
+				writeError(w, r, fmt.Errorf("panic: %v", err))
 			}
 		}()
 		h.ServeHTTP(w, r)
@@ -0,0 +1,567 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/bsbsm/feeder/pkg/feeder"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore keeps feed sources in memory database and serves news prepared by the test
+type fakeStore struct {
+	db.MemoryDatabase
+	news      []*db.News
+	details   map[int]*db.NewsDetail
+	revisions map[int][]*db.NewsRevision
+	queries   []*db.NewsQuery
+	// err is returned by QueryNews if it's set
+	err error
+}
+
+func (s *fakeStore) QueryNews(q *db.NewsQuery) ([]*db.News, error) {
+	s.queries = append(s.queries, q)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var found []*db.News
+	for _, n := range s.news {
+		if strings.Contains(n.Title, q.Title) {
+			found = append(found, n)
+		}
+	}
+
+	if q.Desc {
+		reversed := make([]*db.News, 0, len(found))
+		for i := len(found) - 1; i >= 0; i-- {
+			reversed = append(reversed, found[i])
+		}
+		found = reversed
+	}
+
+	return page(found, q.Offset, q.Count), nil
+}
+
+func (s *fakeStore) SearchNews(query string, offset int, count int) ([]*db.SearchResult, error) {
+	if query == "" {
+		return nil, db.ErrIncorrectArgs
+	}
+
+	news, _ := s.QueryNews(&db.NewsQuery{Title: query, Offset: offset, Count: count})
+
+	var found []*db.SearchResult
+	for _, n := range news {
+		found = append(found, &db.SearchResult{ID: n.ID, Title: n.Title, Source: n.Source, Snippet: n.Title})
+	}
+
+	return found, nil
+}
+
+func (s *fakeStore) GetNewsDetail(id int) (*db.NewsDetail, error) {
+	if d, exist := s.details[id]; exist {
+		return d, nil
+	}
+
+	return nil, db.ErrNotFound
+}
+
+func (s *fakeStore) GetNewsRevisions(id int) ([]*db.NewsRevision, error) {
+	if r, exist := s.revisions[id]; exist {
+		return r, nil
+	}
+
+	return nil, db.ErrNotFound
+}
+
+func page(news []*db.News, offset, count int) []*db.News {
+	if offset >= len(news) {
+		return nil
+	}
+
+	end := offset + count
+	if end > len(news) {
+		end = len(news)
+	}
+
+	return news[offset:end]
+}
+
+func newFakeStore() *fakeStore {
+	s := &fakeStore{
+		details: map[int]*db.NewsDetail{
+			1: {Title: "News 1", PayloadJSON: "{}", Source: "http://source"},
+		},
+		revisions: map[int][]*db.NewsRevision{
+			1: {
+				{Revision: 1, Title: "Old", PayloadJSON: `{"a":1}`},
+				{Revision: 2, Title: "News 1", PayloadJSON: `{"a":2}`, Current: true},
+			},
+		},
+	}
+
+	for i := 1; i <= 150; i++ {
+		title := "News " + strconv.Itoa(i)
+		if i%2 == 0 {
+			title = "Even " + title
+		}
+		s.news = append(s.news, &db.News{ID: i, Title: title, Source: "http://source"})
+	}
+
+	return s
+}
+
+// createSource creates feed source with default settings
+func createSource(store NewsStore, u, rule string) error {
+	_, err := store.CreateFeedSource(&db.Source{URL: u, Rule: rule})
+	return err
+}
+
+func serve(t *testing.T, store NewsStore, method, url string) *httptest.ResponseRecorder {
+	return serveBody(t, store, method, url, "")
+}
+
+func serveBody(t *testing.T, store NewsStore, method, url, body string) *httptest.ResponseRecorder {
+	s, err := NewServer(store)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+
+	return rec
+}
+
+func TestNewServer(t *testing.T) {
+	var store *fakeStore
+
+	_, err := NewServer(store)
+	assert.Error(t, err, "NewServer should fail with nil store")
+}
+
+func TestGetNewsList(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantLen int
+		wantID  int
+	}{
+		{
+			name:    "default count",
+			url:     "/api/news",
+			wantLen: 10,
+			wantID:  1,
+		},
+		{
+			name:    "offset and count",
+			url:     "/api/news?off=20&c=5",
+			wantLen: 5,
+			wantID:  21,
+		},
+		{
+			name:    "count is limited",
+			url:     "/api/news?c=1000",
+			wantLen: maxCountParamValue,
+			wantID:  1,
+		},
+		{
+			name:    "title search",
+			url:     "/api/news?t=Even&c=100",
+			wantLen: 75,
+			wantID:  2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(t, newFakeStore(), http.MethodGet, tt.url)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			var res []*db.News
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) && assert.Len(t, res, tt.wantLen) {
+				assert.Equal(t, tt.wantID, res[0].ID)
+			}
+		})
+	}
+}
+
+func TestSearchNews(t *testing.T) {
+	rec := serve(t, newFakeStore(), http.MethodGet, "/api/search?q=Even&off=10&c=5")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var res []*db.SearchResult
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) && assert.Len(t, res, 5) {
+		assert.Equal(t, 22, res[0].ID)
+	}
+}
+
+func TestGetNewsListFilters(t *testing.T) {
+	store := newFakeStore()
+
+	rec := serve(t, store, http.MethodGet, "/api/news?src=1,2&src=5&added_from=2024-01-02"+
+		"&published_to=2024-01-03T10:00:00Z&f=author&f=rating:5&sort=-published")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	if assert.Len(t, store.queries, 1) {
+		q := store.queries[0]
+		rating := "5"
+
+		assert.Equal(t, []int{1, 2, 5}, q.SourceIDs)
+		assert.True(t, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC).Equal(q.AddedFrom))
+		assert.True(t, time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC).Equal(q.PublishedTo))
+		assert.True(t, q.AddedTo.IsZero())
+		assert.Equal(t, []db.FieldFilter{{Name: "author"}, {Name: "rating", Value: &rating}}, q.Fields)
+		assert.Equal(t, db.SortByPublished, q.SortBy)
+		assert.True(t, q.Desc)
+		assert.Equal(t, 10, q.Count)
+	}
+
+	rec = serve(t, newFakeStore(), http.MethodGet, "/api/news?sort=-added&c=1")
+	var res []*db.News
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) && assert.Len(t, res, 1) {
+		assert.Equal(t, 150, res[0].ID, "the newest news should be the first")
+	}
+}
+
+func TestGetNewsListCursor(t *testing.T) {
+	store := &db.MemoryDatabase{}
+	if !assert.NoError(t, createSource(store, "http://source", "title")) {
+		return
+	}
+
+	for i := 1; i <= 5; i++ {
+		_, _, err := store.CreateNews(1, strconv.Itoa(i), "News "+strconv.Itoa(i), nil, time.Time{})
+		assert.NoError(t, err)
+	}
+
+	load := func(url string) *newsPage {
+		rec := serve(t, store, http.MethodGet, url)
+		if !assert.Equal(t, http.StatusOK, rec.Code) {
+			t.FailNow()
+		}
+
+		var page newsPage
+		if !assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page)) {
+			t.FailNow()
+		}
+
+		return &page
+	}
+
+	ids := func(p *newsPage) []int {
+		var result []int
+		for _, n := range p.Items {
+			result = append(result, n.ID)
+		}
+		return result
+	}
+
+	first := load("/api/news?c=2&cursor=")
+	assert.Equal(t, []int{1, 2}, ids(first))
+	assert.Empty(t, first.Prev)
+
+	second := load("/api/news?c=2&cursor=" + first.Next)
+	assert.Equal(t, []int{3, 4}, ids(second))
+
+	last := load("/api/news?c=2&cursor=" + second.Next)
+	assert.Equal(t, []int{5}, ids(last))
+	assert.Empty(t, last.Next)
+
+	back := load("/api/news?c=2&cursor=" + last.Prev)
+	assert.Equal(t, []int{3, 4}, ids(back))
+	assert.NotEmpty(t, back.Next)
+
+	back = load("/api/news?c=2&cursor=" + back.Prev)
+	assert.Equal(t, []int{1, 2}, ids(back))
+	assert.Empty(t, back.Prev)
+	assert.NotEmpty(t, back.Next)
+
+	newest := load("/api/news?c=2&sort=-added&cursor=")
+	assert.Equal(t, []int{5, 4}, ids(newest))
+	assert.Equal(t, []int{3, 2}, ids(load("/api/news?c=2&sort=-added&cursor="+newest.Next)))
+}
+
+func TestGetNewsByID(t *testing.T) {
+	rec := serve(t, newFakeStore(), http.MethodGet, "/api/news/1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var res db.NewsDetail
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) {
+		assert.Equal(t, "News 1", res.Title)
+	}
+}
+
+func TestGetNewsDiff(t *testing.T) {
+	rec := serve(t, newFakeStore(), http.MethodGet, "/api/news/1/diff")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var res db.NewsDiff
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) {
+		assert.Equal(t, 1, res.From)
+		assert.Equal(t, 2, res.To)
+		assert.Equal(t, "Old", res.OldTitle)
+		assert.Len(t, res.Fields, 1)
+	}
+}
+
+func TestCreateFeedSource(t *testing.T) {
+	store := newFakeStore()
+
+	rec := serve(t, store, http.MethodPut, "/api/feed?u=http://feed&r=Title&i=60")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	sources, err := store.ListFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, sources, 1) {
+		assert.Equal(t, "http://feed", sources[0].URL)
+		assert.Equal(t, time.Minute, sources[0].Interval)
+	}
+}
+
+func TestSources(t *testing.T) {
+	store := newFakeStore()
+
+	decode := func(rec *httptest.ResponseRecorder, v interface{}) {
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+
+	rec := serveBody(t, store, http.MethodPost, "/api/sources", `{"URL":"http://feed1","Rule":"Title","Interval":60}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "/api/sources/1", rec.Header().Get("Location"))
+
+	var src sourceJSON
+	decode(rec, &src)
+	assert.Equal(t, sourceJSON{ID: 1, URL: "http://feed1", Rule: "Title", Interval: 60, Health: src.Health}, src)
+
+	rec = serveBody(t, store, http.MethodPost, "/api/sources", `{"URL":"http://feed2","Rule":"Title","Paused":true}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var list []*sourceJSON
+	decode(serve(t, store, http.MethodGet, "/api/sources"), &list)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, "http://feed2", list[1].URL)
+		assert.True(t, list[1].Paused)
+	}
+
+	rec = serveBody(t, store, http.MethodPatch, "/api/sources/1", `{"Rule":"Title=Name","Interval":0}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	decode(rec, &src)
+	assert.Equal(t, "Title=Name", src.Rule)
+	assert.Equal(t, int64(0), src.Interval)
+	assert.Equal(t, "http://feed1", src.URL, "absent fields must not be changed")
+
+	rec = serve(t, store, http.MethodPost, "/api/sources/1/pause")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	decode(rec, &src)
+	assert.True(t, src.Paused)
+
+	rec = serve(t, store, http.MethodPost, "/api/sources/2/resume")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	decode(serve(t, store, http.MethodGet, "/api/sources/2"), &src)
+	assert.False(t, src.Paused)
+
+	_, _, err := store.CreateNews(2, "guid", "News", nil, time.Time{})
+	assert.NoError(t, err)
+
+	rec = serve(t, store, http.MethodDelete, "/api/sources/2?news=true")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	decode(serve(t, store, http.MethodGet, "/api/sources"), &list)
+	assert.Len(t, list, 1)
+
+	_, err = store.MemoryDatabase.GetNewsDetail(1)
+	assert.Equal(t, db.ErrNotFound, err, "news of the source must be deleted")
+}
+
+func TestSourceFilter(t *testing.T) {
+	store := newFakeStore()
+
+	rec := serveBody(t, store, http.MethodPost, "/api/sources",
+		`{"URL":"http://feed1","Rule":"Title","Filter":"exclude title contains \"ad\""}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var src sourceJSON
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &src))
+	assert.Equal(t, `exclude title contains "ad"`, src.Filter)
+
+	rec = serveBody(t, store, http.MethodPost, "/api/sources", `{"URL":"http://feed2","Rule":"Title","Filter":"title ~ \"(\""}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = serveBody(t, store, http.MethodPatch, "/api/sources/1", `{"Filter":"title like x"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	sources, err := store.ListFeedSources()
+	if assert.NoError(t, err) && assert.Len(t, sources, 1, "source with incorrect filter must not be created") {
+		assert.Equal(t, `exclude title contains "ad"`, sources[0].Filter)
+	}
+
+	rec = serveBody(t, store, http.MethodPatch, "/api/sources/1", `{"Filter":""}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &src))
+	assert.Empty(t, src.Filter)
+}
+
+func TestSourceValidation(t *testing.T) {
+	store := newFakeStore()
+
+	rec := serveBody(t, store, http.MethodPost, "/api/sources",
+		`{"URL":"http://feed1","Rule":"title,author..name=a","Filter":"title like go"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	var res ErrorResponse
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) {
+		assert.Equal(t, CodeIncorrectArgs, res.Error.Code)
+		if assert.Len(t, res.Error.Details, 2) {
+			assert.Equal(t, []string{"Rule", "author..name"}, []string{res.Error.Details[0].Field, res.Error.Details[0].Expr})
+			assert.Equal(t, []string{"Filter", "title like go"}, []string{res.Error.Details[1].Field, res.Error.Details[1].Expr})
+			assert.Contains(t, res.Error.Details[0].Message, "empty key")
+		}
+	}
+
+	sources, err := store.ListFeedSources()
+	assert.NoError(t, err)
+	assert.Empty(t, sources, "source with incorrect rule must not be created")
+
+	rec = serveBody(t, store, http.MethodPost, "/api/sources", `{"URL":"http://feed1","Rule":"title"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	rec = serveBody(t, store, http.MethodPatch, "/api/sources/1", `{"Rule":"title|nope"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"Expr":"title|nope"`)
+
+	rec = serve(t, store, http.MethodGet, "/api/sources/preview?u=http://feed1&r=title[")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"Details"`, "preview must list rule errors before reading")
+
+	broken := newSourceJSON(&db.Source{ID: 2, URL: "http://feed2", Rule: "enclosures[first]"})
+	if assert.Len(t, broken.Errors, 1, "saved source with incorrect rule should list errors") {
+		assert.Equal(t, "enclosures[first]", broken.Errors[0].Expr)
+	}
+	assert.Empty(t, newSourceJSON(&db.Source{ID: 1, URL: "http://feed1", Rule: "title"}).Errors)
+}
+
+func TestPreviewRule(t *testing.T) {
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<rss version="2.0"><channel><title>test</title>` +
+			`<item><title>Go</title><guid>1</guid></item><item><title>Rust</title><guid>2</guid></item></channel></rss>`))
+	}))
+	defer feed.Close()
+
+	store := newFakeStore()
+	preview := func(rule, filter, n string) *httptest.ResponseRecorder {
+		q := url.Values{"u": {feed.URL}, "r": {rule}, "f": {filter}, "n": {n}}
+		return serve(t, store, http.MethodGet, "/api/sources/preview?"+q.Encode())
+	}
+
+	rec := preview("Title=t,Summary", `exclude title = "rust"`, "")
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		var res feeder.RulePreview
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		if assert.Len(t, res.Items, 2) {
+			assert.JSONEq(t, `{"t":"Go"}`, string(res.Items[0].Payload))
+			assert.True(t, res.Items[1].Filtered)
+		}
+		assert.Contains(t, res.Fields, "title")
+		assert.Equal(t, []string{"field 'Summary': 'Summary' matched nothing"}, res.Warnings)
+	}
+
+	rec = preview("title", "", "1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, 1, strings.Count(rec.Body.String(), `"GUID"`))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, preview("title[", "", "").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, preview("", "", "").Code)
+	assert.Equal(t, http.StatusBadRequest, preview("title", "", "x").Code)
+	assert.Equal(t, http.StatusUnprocessableEntity,
+		serve(t, store, http.MethodGet, "/api/sources/preview?u=feed&r=title").Code)
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	rec = serve(t, store, http.MethodGet, "/api/sources/preview?"+url.Values{"u": {unavailable.URL}, "r": {"title"}}.Encode())
+	if assert.Equal(t, http.StatusBadGateway, rec.Code, "feed failure isn't an error of arguments") {
+		var res ErrorResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+		assert.Equal(t, CodeBadGateway, res.Error.Code)
+	}
+
+	sources, err := store.ListFeedSources()
+	assert.NoError(t, err)
+	assert.Empty(t, sources, "preview must not save source")
+}
+
+func TestErrorResponses(t *testing.T) {
+	failing := newFakeStore()
+	failing.err = errors.New("database is locked")
+
+	tests := []struct {
+		name       string
+		store      *fakeStore
+		method     string
+		url        string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{"incorrect offset", newFakeStore(), http.MethodGet, "/api/news?off=a", "", http.StatusBadRequest, CodeBadRequest},
+		{"incorrect count", newFakeStore(), http.MethodGet, "/api/search?q=News&c=1.5", "", http.StatusBadRequest, CodeBadRequest},
+		{"incorrect ID", newFakeStore(), http.MethodGet, "/api/news/abc", "", http.StatusBadRequest, CodeBadRequest},
+		{"incorrect body", newFakeStore(), http.MethodPost, "/api/sources", "{", http.StatusBadRequest, CodeBadRequest},
+		{"news not found", newFakeStore(), http.MethodGet, "/api/news/100", "", http.StatusNotFound, CodeNotFound},
+		{"revision not found", newFakeStore(), http.MethodGet, "/api/news/1/diff?from=5", "", http.StatusNotFound, CodeNotFound},
+		{"source not found", newFakeStore(), http.MethodDelete, "/api/sources/7", "", http.StatusNotFound, CodeNotFound},
+		{"incorrect source", newFakeStore(), http.MethodPut, "/api/feed?u=feed&r=Title", "", http.StatusUnprocessableEntity, CodeIncorrectArgs},
+		{"incorrect search query", newFakeStore(), http.MethodGet, "/api/search", "", http.StatusUnprocessableEntity, CodeIncorrectArgs},
+		{"duplicate source", newFakeStore(), http.MethodPost, "/api/sources", `{"URL":"http://dup","Rule":"Title"}`, http.StatusConflict, CodeAlreadyExists},
+		{"storage failure", failing, http.MethodGet, "/api/news", "", http.StatusInternalServerError, CodeInternalError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.NoError(t, createSource(tt.store, "http://dup", "Title"))
+
+			rec := serveBody(t, tt.store, tt.method, tt.url, tt.body)
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			var res ErrorResponse
+			if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) {
+				assert.Equal(t, tt.wantCode, res.Error.Code)
+				assert.NotEmpty(t, res.Error.Message)
+				assert.NotContains(t, res.Error.Message, "database is locked", "internal errors must not be revealed")
+			}
+		})
+	}
+}
+
+func TestPanicHandler(t *testing.T) {
+	h := panicHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("unexpected")
+	}))
+
+	rec := httptest.NewRecorder()
+	assert.NotPanics(t, func() {
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/news", nil))
+	})
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	var res ErrorResponse
+	if assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res)) {
+		assert.Equal(t, CodeInternalError, res.Error.Code)
+	}
+}
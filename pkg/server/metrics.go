@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/metrics"
+	"github.com/gorilla/mux"
+)
+
+// statusWriter remembers status of the response. It supports streaming and WebSocket upgrade
+// if the wrapped writer does
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response writer doesn't support hijacking")
+	}
+
+	// hijacked connection is upgraded to WebSocket
+	w.status = http.StatusSwitchingProtocols
+
+	return h.Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// metricsMiddleware observes latency of requests by route template, so news IDs don't
+// produce separate series. Streams are observed when they end
+func metricsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		defer func() {
+			route := "unknown"
+			if current := mux.CurrentRoute(r); current != nil {
+				if tpl, err := current.GetPathTemplate(); err == nil {
+					route = tpl
+				}
+			}
+
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			metrics.HTTPDuration.WithLabelValues(route, r.Method, strconv.Itoa(status)).
+				Observe(time.Since(start).Seconds())
+		}()
+
+		h.ServeHTTP(sw, r)
+	})
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	store := newFakeStore()
+	serve(t, store, http.MethodGet, "/api/news/1")
+	serve(t, store, http.MethodGet, "/api/news/100000")
+
+	rec := serve(t, store, http.MethodGet, "/metrics")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `feeder_http_request_duration_seconds_count{method="GET",route="/api/news/{id}",status="200"}`)
+	assert.Contains(t, body, `feeder_http_request_duration_seconds_count{method="GET",route="/api/news/{id}",status="404"}`)
+	assert.Contains(t, body, "go_goroutines")
+}
@@ -1,34 +1,123 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"reflect"
 	"strconv"
+	"time"
 
 	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/bsbsm/feeder/pkg/events"
+	"github.com/bsbsm/feeder/pkg/metrics"
 	"github.com/gorilla/mux"
 )
 
-func SetSQLiteDatabase(db *db.SQLiteDatabase) {
-	storage = db
+// NewsStore is a storage of news and feed sources which API handlers use
+type NewsStore interface {
+	QueryNews(q *db.NewsQuery) ([]*db.News, error)
+	SearchNews(query string, offset int, count int) ([]*db.SearchResult, error)
+	GetNewsDetail(id int) (*db.NewsDetail, error)
+	GetNewsRevisions(id int) ([]*db.NewsRevision, error)
+	CreateFeedSource(s *db.Source) (int, error)
+	ListFeedSources() ([]*db.Source, error)
+	GetFeedSource(id int) (*db.Source, error)
+	UpdateFeedSource(id int, u *db.SourceUpdate) error
+	DeleteFeedSource(id int, withNews bool) error
+	CreateWebhook(w *db.Webhook) (int, error)
+	ListWebhooks() ([]*db.Webhook, error)
+	GetWebhook(id int) (*db.Webhook, error)
+	DeleteWebhook(id int) error
+	GetWebhookDeliveries(webhookID int, offset, count int) ([]*db.WebhookDelivery, error)
 }
 
-func BlockingListen(port int) {
-	if storage == nil {
-		panic("Set SQLite database before start listen")
+// Server serves web UI and API
+type Server struct {
+	store NewsStore
+	bus   *events.Bus
+}
+
+func NewServer(store NewsStore) (*Server, error) {
+	if store == nil || reflect.ValueOf(store).IsNil() {
+		return nil, errors.New("NewsStore is nil")
 	}
 
+	return &Server{store: store, bus: events.NewBus(events.DefaultHistory)}, nil
+}
+
+// SetEventBus sets bus which news are streamed from. It must be shared with the feeder,
+// otherwise streams get no news
+func (s *Server) SetEventBus(b *events.Bus) {
+	s.bus = b
+}
+
+// Handler returns router of web UI and API
+func (s *Server) Handler() http.Handler {
 	r := mux.NewRouter()
 	r.HandleFunc("/", homeHandler).Methods("GET")
 	r.HandleFunc("/scripts.js", jsHandler).Methods("GET")
-	r.HandleFunc("/api/news", getNewsList).Methods("GET")
-	r.HandleFunc("/api/news/{id}", getNewsByID).Methods("GET")
-	r.HandleFunc("/api/feed", createFeedSource).Methods("PUT")
+	r.Handle("/api/news", apiHandler(s.getNewsList)).Methods("GET")
+	r.Handle("/api/search", apiHandler(s.searchNews)).Methods("GET")
+	r.Handle("/api/feeds/{format}", apiHandler(s.getFeed)).Methods("GET")
+	r.Handle("/api/stream", apiHandler(s.streamNews)).Methods("GET")
+	r.Handle("/api/stream/ws", apiHandler(s.streamNewsWebSocket)).Methods("GET")
+	r.Handle("/api/news/{id}", apiHandler(s.getNewsByID)).Methods("GET")
+	r.Handle("/api/news/{id}/revisions", apiHandler(s.getNewsRevisions)).Methods("GET")
+	r.Handle("/api/news/{id}/diff", apiHandler(s.getNewsDiff)).Methods("GET")
+	r.Handle("/api/feed", apiHandler(s.createFeedSource)).Methods("PUT")
+	r.Handle("/api/sources", apiHandler(s.listSources)).Methods("GET")
+	r.Handle("/api/sources", apiHandler(s.addSource)).Methods("POST")
+	r.Handle("/api/sources/preview", apiHandler(s.previewRule)).Methods("GET")
+	r.Handle("/api/sources/{id}", apiHandler(s.getSource)).Methods("GET")
+	r.Handle("/api/sources/{id}", apiHandler(s.updateSource)).Methods("PATCH")
+	r.Handle("/api/sources/{id}", apiHandler(s.deleteSource)).Methods("DELETE")
+	r.Handle("/api/sources/{id}/pause", s.pauseSource(true)).Methods("POST")
+	r.Handle("/api/sources/{id}/resume", s.pauseSource(false)).Methods("POST")
+	r.Handle("/api/webhooks", apiHandler(s.listWebhooks)).Methods("GET")
+	r.Handle("/api/webhooks", apiHandler(s.addWebhook)).Methods("POST")
+	r.Handle("/api/webhooks/{id}", apiHandler(s.getWebhook)).Methods("GET")
+	r.Handle("/api/webhooks/{id}", apiHandler(s.deleteWebhook)).Methods("DELETE")
+	r.Handle("/api/webhooks/{id}/deliveries", apiHandler(s.getWebhookDeliveries)).Methods("GET")
+
+	r.Handle("/metrics", metrics.Handler()).Methods("GET")
 
-	r.Use(panicHandler, logMiddleware)
+	r.Use(metricsMiddleware, panicHandler, logMiddleware)
+
+	return r
+}
 
+// shutdownTimeout limits time for open requests to drain
+const shutdownTimeout = 10 * time.Second
+
+// BlockingListen serves API until ctx is done. Then it stops accepting new
+// connections and waits for open requests to complete
+func (s *Server) BlockingListen(ctx context.Context, port int) error {
 	a := ":" + strconv.Itoa(port)
 	fmt.Printf("Listening at '%s'\n", a)
 
-	http.ListenAndServe(a, r)
+	// requests are canceled when ctx is done, so open streams don't delay shutdown
+	srv := &http.Server{
+		Addr:        a,
+		Handler:     s.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		shutdownErr <- srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return <-shutdownErr
 }
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/bsbsm/feeder/pkg/feeder"
+	"github.com/bsbsm/feeder/pkg/metrics"
+)
+
+// sourceJSON is a feed source in API responses. Interval is in seconds.
+// Errors are incorrect settings which were saved before they were validated, such source isn't read
+type sourceJSON struct {
+	ID       int                     `json:"ID"`
+	URL      string                  `json:"URL"`
+	Rule     string                  `json:"Rule"`
+	Filter   string                  `json:"Filter"`
+	Interval int64                   `json:"Interval"`
+	Paused   bool                    `json:"Paused"`
+	Health   feeder.FeedSourceHealth `json:"Health"`
+	Errors   []FieldError            `json:"Errors,omitempty"`
+}
+
+func newSourceJSON(s *db.Source) *sourceJSON {
+	result := &sourceJSON{
+		ID:       s.ID,
+		URL:      s.URL,
+		Rule:     s.Rule,
+		Filter:   s.Filter,
+		Interval: int64(s.Interval / time.Second),
+		Paused:   s.Paused,
+		Health:   s.Health,
+	}
+
+	var verr *db.ValidationError
+	if errors.As(s.Validate(), &verr) {
+		result.Errors = fieldErrors(verr.Errors)
+	}
+
+	return result
+}
+
+// sourceRequest is a body of feed source creation or update. Interval is in seconds.
+// Fields which are absent aren't changed
+type sourceRequest struct {
+	URL      *string `json:"URL"`
+	Rule     *string `json:"Rule"`
+	Filter   *string `json:"Filter"`
+	Interval *int64  `json:"Interval"`
+	Paused   *bool   `json:"Paused"`
+}
+
+// decodeSourceRequest reads source update from JSON body
+func decodeSourceRequest(r *http.Request) (*db.SourceUpdate, error) {
+	var req sourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("incorrect JSON body: %s", err)
+	}
+
+	u := &db.SourceUpdate{URL: req.URL, Rule: req.Rule, Filter: req.Filter, Paused: req.Paused}
+	if req.Interval != nil {
+		interval := time.Duration(*req.Interval) * time.Second
+		u.Interval = &interval
+	}
+
+	return u, nil
+}
+
+// listSources returns all feed sources including paused and disabled ones
+func (s *Server) listSources(w http.ResponseWriter, r *http.Request) error {
+	sources, err := s.store.ListFeedSources()
+	if err != nil {
+		return err
+	}
+
+	result := make([]*sourceJSON, 0, len(sources))
+	for _, src := range sources {
+		result = append(result, newSourceJSON(src))
+	}
+
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// addSource creates feed source from JSON body with URL, Rule and optional Filter, Interval and Paused
+func (s *Server) addSource(w http.ResponseWriter, r *http.Request) error {
+	u, err := decodeSourceRequest(r)
+	if err != nil {
+		return err
+	}
+
+	if u.URL == nil || u.Rule == nil {
+		return fmt.Errorf("%w: URL and Rule are required", db.ErrIncorrectArgs)
+	}
+
+	src := &db.Source{URL: *u.URL, Rule: *u.Rule}
+	if u.Filter != nil {
+		src.Filter = *u.Filter
+	}
+	if u.Interval != nil {
+		src.Interval = *u.Interval
+	}
+	if u.Paused != nil {
+		src.Paused = *u.Paused
+	}
+
+	id, err := s.store.CreateFeedSource(src)
+	if err != nil {
+		return err
+	}
+
+	if src, err = s.store.GetFeedSource(id); err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", "/api/sources/"+strconv.Itoa(src.ID))
+
+	return writeJSON(w, http.StatusCreated, newSourceJSON(src))
+}
+
+func (s *Server) getSource(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+
+	src, err := s.store.GetFeedSource(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, newSourceJSON(src))
+}
+
+// updateSource changes fields of feed source which are present in JSON body.
+// The feeder picks changes up when it refreshes sources
+func (s *Server) updateSource(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+
+	u, err := decodeSourceRequest(r)
+	if err != nil {
+		return err
+	}
+
+	return s.changeSource(w, id, u)
+}
+
+// pauseSource returns handler which pauses or resumes feed source
+func (s *Server) pauseSource(paused bool) apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := pathID(r)
+		if err != nil {
+			return err
+		}
+
+		return s.changeSource(w, id, &db.SourceUpdate{Paused: &paused})
+	}
+}
+
+// previewRule reads feed 'u' once and responds with its fields and payloads of the first 'n' items
+// extracted by rule 'r' and checked by filter 'f'. Nothing is saved
+func (s *Server) previewRule(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+
+	count, err := intParam(r, "n")
+	if err != nil {
+		return err
+	}
+
+	if count <= 0 {
+		count = feeder.DefaultPreviewItems
+	} else if count > maxCountParamValue {
+		count = maxCountParamValue
+	}
+
+	// rule and filter errors are listed before the feed is read
+	src := &db.Source{URL: q.Get("u"), Rule: q.Get("r"), Filter: q.Get("f")}
+	if err = src.Validate(); err != nil {
+		return err
+	}
+
+	preview, err := feeder.PreviewRule(r.Context(), q.Get("u"), q.Get("r"), q.Get("f"), count)
+	if err != nil {
+		if r.Context().Err() != nil {
+			return err
+		}
+		// feed can't be read or parsed at the URL
+		return &feedError{err: err}
+	}
+
+	return writeJSON(w, http.StatusOK, preview)
+}
+
+// changeSource updates feed source and responds with its new state
+func (s *Server) changeSource(w http.ResponseWriter, id int, u *db.SourceUpdate) error {
+	if err := s.store.UpdateFeedSource(id, u); err != nil {
+		return err
+	}
+
+	src, err := s.store.GetFeedSource(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, newSourceJSON(src))
+}
+
+// deleteSource deletes feed source. Its news are deleted too if 'news' parameter is true,
+// otherwise they are kept without source
+func (s *Server) deleteSource(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+
+	var withNews bool
+	if v := r.URL.Query().Get("news"); v != "" {
+		if withNews, err = strconv.ParseBool(v); err != nil {
+			return badRequest("'news' must be a boolean, got '%s'", v)
+		}
+	}
+
+	if err = s.store.DeleteFeedSource(id, withNews); err != nil {
+		return err
+	}
+	metrics.ForgetSource(id)
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
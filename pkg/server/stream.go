@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/events"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// keepAlivePeriod is a period of comments and pings which keep idle streams open
+	keepAlivePeriod = 15 * time.Second
+	// streamWriteTimeout limits time of sending one event to WebSocket client
+	streamWriteTimeout = 10 * time.Second
+)
+
+// upgrader accepts WebSocket connections from any origin like the rest of API does
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamParams returns filter of events by source IDs 'src' and keyword 'q'
+// and ID of the last event received by client, which is 0 for new clients.
+// The last ID is sent in Last-Event-ID header or 'last_event_id' parameter
+func streamParams(r *http.Request) (events.Filter, int64, error) {
+	var f events.Filter
+	var err error
+
+	if f.SourceIDs, err = sourceIDsParam(r); err != nil {
+		return f, 0, err
+	}
+	f.Keyword = r.URL.Query().Get("q")
+
+	v := r.Header.Get("Last-Event-ID")
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+
+	if v == "" {
+		return f, 0, nil
+	}
+
+	lastID, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return f, 0, badRequest("last event ID must be an integer, got '%s'", v)
+	}
+
+	return f, lastID, nil
+}
+
+// streamNews sends inserted news as Server-Sent Events 'news' with JSON of events.News.
+// Stream ends if client doesn't keep up, then client reconnects with Last-Event-ID
+// and receives missed events
+func (s *Server) streamNews(w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("Response writer doesn't support streaming")
+	}
+
+	f, lastID, err := streamParams(r)
+	if err != nil {
+		return err
+	}
+
+	sub := s.bus.Subscribe(f, lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlivePeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				return nil
+			}
+
+			data, err := json.Marshal(e)
+			if err != nil {
+				fmt.Printf("Error while encode event %d: %s\n", e.ID, err)
+				continue
+			}
+
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: news\ndata: %s\n\n", e.ID, data); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if _, err = fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+// streamNewsWebSocket sends inserted news as WebSocket text messages with JSON of events.News.
+// Connection is closed with 'try again later' status if client doesn't keep up,
+// then client reconnects with the last received ID and receives missed events
+func (s *Server) streamNewsWebSocket(w http.ResponseWriter, r *http.Request) error {
+	f, lastID, err := streamParams(r)
+	if err != nil {
+		return err
+	}
+
+	// subscription is created before handshake, so events published after it aren't lost
+	sub := s.bus.Subscribe(f, lastID)
+	defer sub.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader has already responded with error
+		return nil
+	}
+	defer conn.Close()
+
+	// client messages are ignored, reading handles pongs and detects closed connection
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(keepAlivePeriod)
+	defer ticker.Stop()
+
+	closeWith := func(code int, text string) {
+		msg := websocket.FormatCloseMessage(code, text)
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(streamWriteTimeout))
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			closeWith(websocket.CloseGoingAway, "server is stopping")
+			return nil
+		case <-closed:
+			return nil
+		case e, ok := <-sub.Events():
+			if !ok {
+				closeWith(websocket.CloseTryAgainLater, "events weren't received in time")
+				return nil
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err = conn.WriteJSON(e); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return nil
+			}
+		}
+	}
+}
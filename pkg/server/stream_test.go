@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/events"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStreamServer(t *testing.T) (*httptest.Server, *events.Bus) {
+	s, err := NewServer(newFakeStore())
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	bus := events.NewBus(events.DefaultHistory)
+	s.SetEventBus(bus)
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	return ts, bus
+}
+
+// readSSE reads events from stream until count of them is received
+func readSSE(t *testing.T, r *bufio.Reader, count int) (ids []string, data []*events.News) {
+	for len(data) < count {
+		line, err := r.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			ids = append(ids, strings.TrimPrefix(line, "id: "))
+		case strings.HasPrefix(line, "event: "):
+			assert.Equal(t, "news", strings.TrimPrefix(line, "event: "))
+		case strings.HasPrefix(line, "data: "):
+			e := &events.News{}
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), e))
+			data = append(data, e)
+		}
+	}
+
+	return ids, data
+}
+
+func TestStreamNews(t *testing.T) {
+	ts, bus := newStreamServer(t)
+
+	bus.Publish(events.News{NewsID: 1, SourceID: 1, Title: "Before"})
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/stream?src=2", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	rsp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rsp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, "text/event-stream", rsp.Header.Get("Content-Type"))
+
+	// subscription is created after headers are sent
+	bus.Publish(events.News{NewsID: 2, SourceID: 1, Title: "Other source"})
+	bus.Publish(events.News{NewsID: 3, SourceID: 2, Title: "Wanted", Payload: json.RawMessage(`{"a":1}`)})
+
+	ids, data := readSSE(t, bufio.NewReader(rsp.Body), 1)
+	if assert.Len(t, data, 1) {
+		assert.Equal(t, []string{"3"}, ids)
+		assert.Equal(t, 3, data[0].NewsID)
+		assert.Equal(t, "Wanted", data[0].Title)
+		assert.JSONEq(t, `{"a":1}`, string(data[0].Payload))
+	}
+}
+
+func TestStreamNewsResume(t *testing.T) {
+	ts, bus := newStreamServer(t)
+
+	for _, title := range []string{"Go 1", "Rust", "Go 2"} {
+		bus.Publish(events.News{SourceID: 1, Title: title})
+	}
+
+	rsp, err := http.Get(ts.URL + "/api/stream?q=go&last_event_id=1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer rsp.Body.Close()
+
+	ids, data := readSSE(t, bufio.NewReader(rsp.Body), 1)
+	if assert.Len(t, data, 1) {
+		assert.Equal(t, []string{"3"}, ids, "missed events should be filtered too")
+		assert.Equal(t, "Go 2", data[0].Title)
+	}
+}
+
+func TestStreamNewsErrors(t *testing.T) {
+	ts, _ := newStreamServer(t)
+
+	for _, url := range []string{
+		"/api/stream?src=a",
+		"/api/stream?last_event_id=a",
+		"/api/stream/ws?last_event_id=a",
+	} {
+		t.Run(url, func(t *testing.T) {
+			rsp, err := http.Get(ts.URL + url)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer rsp.Body.Close()
+
+			var body ErrorResponse
+			assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+			assert.NoError(t, json.NewDecoder(rsp.Body).Decode(&body))
+			assert.Equal(t, CodeBadRequest, body.Error.Code)
+		})
+	}
+}
+
+func TestStreamNewsWebSocket(t *testing.T) {
+	ts, bus := newStreamServer(t)
+
+	bus.Publish(events.News{SourceID: 1, Title: "Missed"})
+	bus.Publish(events.News{SourceID: 2, Title: "Other source"})
+
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/stream/ws?src=1&last_event_id=0"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	bus.Publish(events.News{SourceID: 1, Title: "Live"})
+
+	var titles []string
+	for len(titles) < 1 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		e := &events.News{}
+		if !assert.NoError(t, conn.ReadJSON(e)) {
+			return
+		}
+		titles = append(titles, e.Title)
+	}
+
+	assert.Equal(t, []string{"Live"}, titles, "zero last ID means no missed events")
+}
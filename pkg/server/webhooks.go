@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/db"
+)
+
+// webhookJSON is a webhook in API responses. Secret is never responded
+type webhookJSON struct {
+	ID        int       `json:"ID"`
+	URL       string    `json:"URL"`
+	SourceIDs []int     `json:"SourceIDs"`
+	Keyword   string    `json:"Keyword"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+func newWebhookJSON(w *db.Webhook) *webhookJSON {
+	ids := w.SourceIDs
+	if ids == nil {
+		ids = []int{}
+	}
+
+	return &webhookJSON{ID: w.ID, URL: w.URL, SourceIDs: ids, Keyword: w.Keyword, CreatedAt: w.CreatedAt}
+}
+
+// webhookRequest is a body of webhook creation
+type webhookRequest struct {
+	URL       string `json:"URL"`
+	SourceIDs []int  `json:"SourceIDs"`
+	Keyword   string `json:"Keyword"`
+	Secret    string `json:"Secret"`
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) error {
+	webhooks, err := s.store.ListWebhooks()
+	if err != nil {
+		return err
+	}
+
+	result := make([]*webhookJSON, 0, len(webhooks))
+	for _, item := range webhooks {
+		result = append(result, newWebhookJSON(item))
+	}
+
+	return writeJSON(w, http.StatusOK, result)
+}
+
+// addWebhook creates webhook from JSON body with URL, Secret and optional SourceIDs and Keyword
+func (s *Server) addWebhook(w http.ResponseWriter, r *http.Request) error {
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return badRequest("incorrect JSON body: %s", err)
+	}
+
+	id, err := s.store.CreateWebhook(&db.Webhook{
+		URL:       req.URL,
+		SourceIDs: req.SourceIDs,
+		Keyword:   req.Keyword,
+		Secret:    req.Secret,
+	})
+	if err != nil {
+		return err
+	}
+
+	item, err := s.store.GetWebhook(id)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Location", "/api/webhooks/"+strconv.Itoa(id))
+
+	return writeJSON(w, http.StatusCreated, newWebhookJSON(item))
+}
+
+func (s *Server) getWebhook(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+
+	item, err := s.store.GetWebhook(id)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, http.StatusOK, newWebhookJSON(item))
+}
+
+// deleteWebhook deletes webhook with its delivery log
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+
+	if err = s.store.DeleteWebhook(id); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
+// getWebhookDeliveries returns page of delivery attempts, the latest ones go first
+func (s *Server) getWebhookDeliveries(w http.ResponseWriter, r *http.Request) error {
+	id, err := pathID(r)
+	if err != nil {
+		return err
+	}
+
+	offset, count, err := pageParams(r)
+	if err != nil {
+		return err
+	}
+
+	deliveries, err := s.store.GetWebhookDeliveries(id, offset, count)
+	if err != nil {
+		return err
+	}
+
+	if deliveries == nil {
+		deliveries = []*db.WebhookDelivery{}
+	}
+
+	return writeJSON(w, http.StatusOK, deliveries)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	store := &db.MemoryDatabase{}
+
+	rec := serveBody(t, store, http.MethodPost, "/api/webhooks",
+		`{"URL":"http://hook","SourceIDs":[1,2],"Keyword":"go","Secret":"secret"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, "/api/webhooks/1", rec.Header().Get("Location"))
+	assert.NotContains(t, rec.Body.String(), "secret", "secret must not be responded")
+
+	var hook webhookJSON
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &hook))
+	assert.Equal(t, webhookJSON{ID: 1, URL: "http://hook", SourceIDs: []int{1, 2}, Keyword: "go",
+		CreatedAt: hook.CreatedAt}, hook)
+
+	rec = serveBody(t, store, http.MethodPost, "/api/webhooks", `{"URL":"http://hook"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "secret is required")
+
+	rec = serveBody(t, store, http.MethodPost, "/api/webhooks", `{"URL":"http://hook2","Secret":"s"}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var list []*webhookJSON
+	assert.NoError(t, json.Unmarshal(serve(t, store, http.MethodGet, "/api/webhooks").Body.Bytes(), &list))
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, []int{}, list[1].SourceIDs)
+	}
+
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, store.AddWebhookDelivery(&db.WebhookDelivery{WebhookID: 1, NewsID: i, Attempt: 1, Status: 200, Delivered: true}))
+	}
+
+	rec = serve(t, store, http.MethodGet, "/api/webhooks/1/deliveries?c=2")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var deliveries []*db.WebhookDelivery
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &deliveries))
+	if assert.Len(t, deliveries, 2) {
+		assert.Equal(t, 3, deliveries[0].NewsID)
+		assert.True(t, deliveries[0].Delivered)
+	}
+
+	assert.Equal(t, "[]", serve(t, store, http.MethodGet, "/api/webhooks/2/deliveries").Body.String())
+
+	assert.Equal(t, http.StatusNoContent, serve(t, store, http.MethodDelete, "/api/webhooks/1").Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, store, http.MethodGet, "/api/webhooks/1").Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, store, http.MethodGet, "/api/webhooks/1/deliveries").Code)
+	assert.Equal(t, http.StatusNotFound, serve(t, store, http.MethodDelete, "/api/webhooks/1").Code)
+}
@@ -0,0 +1,257 @@
+// Package webhooks delivers news inserted by the feeder to external services
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/bsbsm/feeder/pkg/events"
+)
+
+// Headers of delivery requests
+const (
+	// SignatureHeader is 'sha256=' followed by hex HMAC-SHA256 of the body with the webhook secret
+	SignatureHeader = "X-Feeder-Signature"
+	EventHeader     = "X-Feeder-Event"
+	// DeliveryHeader is ID of the event, it's the same for every attempt
+	DeliveryHeader = "X-Feeder-Delivery"
+)
+
+const (
+	defaultWorkers     = 4
+	defaultMaxAttempts = 5
+	defaultBackoff     = 10 * time.Second
+	deliveryTimeout    = 10 * time.Second
+	queueSize          = 256
+)
+
+// Store keeps webhooks and their delivery log
+type Store interface {
+	ListWebhooks() ([]*db.Webhook, error)
+	AddWebhookDelivery(d *db.WebhookDelivery) error
+}
+
+func NewDispatcher(s Store) (*Dispatcher, error) {
+	if s == nil || reflect.ValueOf(s).IsNil() {
+		return nil, errors.New("Webhooks store is nil")
+	}
+
+	return &Dispatcher{
+		store:       s,
+		client:      &http.Client{Timeout: deliveryTimeout},
+		workers:     defaultWorkers,
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+	}, nil
+}
+
+// Dispatcher posts news events to matching webhooks. Failed deliveries are retried
+// with exponential backoff and every attempt is saved to the delivery log
+type Dispatcher struct {
+	store       Store
+	client      *http.Client
+	workers     int
+	maxAttempts int
+	// backoff is a delay before the second attempt, it's doubled for every next one
+	backoff time.Duration
+}
+
+// SetRetries sets how many times news is posted to webhook and the delay before the first retry
+func (d *Dispatcher) SetRetries(maxAttempts int, backoff time.Duration) {
+	d.maxAttempts = maxAttempts
+	d.backoff = backoff
+}
+
+// SetWorkers sets how many deliveries may be posted simultaneously
+func (d *Dispatcher) SetWorkers(n int) {
+	d.workers = n
+}
+
+// delivery is news which is posted to webhook
+type delivery struct {
+	webhook *db.Webhook
+	event   *events.News
+	body    []byte
+	attempt int
+}
+
+// Run delivers events of the bus until ctx is done. Retries which are scheduled
+// at that moment are dropped, their previous attempts remain in the log
+func (d *Dispatcher) Run(ctx context.Context, bus *events.Bus) {
+	queue := make(chan *delivery, queueSize)
+
+	var wg sync.WaitGroup
+	workers := d.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item := <-queue:
+					d.deliver(ctx, item, queue)
+				}
+			}
+		}()
+	}
+
+	var lastID int64
+
+	for ctx.Err() == nil {
+		// subscription is renewed from the last received event if dispatcher lags behind
+		sub := bus.Subscribe(events.Filter{}, lastID)
+		lastID = d.dispatch(ctx, sub, queue, lastID)
+		sub.Close()
+	}
+
+	wg.Wait()
+}
+
+// dispatch queues deliveries of subscription events and returns ID of the last one
+func (d *Dispatcher) dispatch(ctx context.Context, sub *events.Subscription, queue chan<- *delivery, lastID int64) int64 {
+	for {
+		select {
+		case <-ctx.Done():
+			return lastID
+		case e, ok := <-sub.Events():
+			if !ok {
+				fmt.Printf("Webhooks dispatcher lags behind after event %d\n", lastID)
+				return lastID
+			}
+
+			lastID = e.ID
+
+			webhooks, err := d.store.ListWebhooks()
+			if err != nil {
+				fmt.Printf("Error while read webhooks: %s\n", err)
+				continue
+			}
+
+			body, err := json.Marshal(e)
+			if err != nil {
+				fmt.Printf("Error while encode event %d: %s\n", e.ID, err)
+				continue
+			}
+
+			for _, w := range webhooks {
+				f := events.Filter{SourceIDs: w.SourceIDs, Keyword: w.Keyword}
+				if !f.Match(e) {
+					continue
+				}
+
+				select {
+				case queue <- &delivery{webhook: w, event: e, body: body, attempt: 1}:
+				case <-ctx.Done():
+					return lastID
+				}
+			}
+		}
+	}
+}
+
+// deliver posts news to webhook, saves the attempt and schedules retry if it failed
+func (d *Dispatcher) deliver(ctx context.Context, item *delivery, queue chan<- *delivery) {
+	status, err := d.post(ctx, item)
+	if ctx.Err() != nil {
+		return
+	}
+
+	log := &db.WebhookDelivery{
+		WebhookID: item.webhook.ID,
+		NewsID:    item.event.NewsID,
+		Attempt:   item.attempt,
+		Status:    status,
+		Delivered: err == nil,
+	}
+	if err != nil {
+		log.Error = err.Error()
+	}
+
+	if saveErr := d.store.AddWebhookDelivery(log); errors.Is(saveErr, db.ErrNotFound) {
+		// webhook is deleted
+		return
+	} else if saveErr != nil {
+		fmt.Printf("Error while save delivery to webhook %d: %s\n", item.webhook.ID, saveErr)
+	}
+
+	if err == nil || !retryable(status) || item.attempt >= d.maxAttempts {
+		return
+	}
+
+	delay := d.backoff << (item.attempt - 1)
+	next := *item
+	next.attempt++
+
+	time.AfterFunc(delay, func() {
+		select {
+		case queue <- &next:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// post sends news to webhook and returns HTTP status of the response.
+// Responses with status other than 2xx are errors
+func (d *Dispatcher) post(ctx context.Context, item *delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, item.webhook.URL, bytes.NewReader(item.body))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "feeder-webhooks")
+	req.Header.Set(EventHeader, "news")
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(item.event.ID, 10))
+	req.Header.Set(SignatureHeader, Sign(item.webhook.Secret, item.body))
+
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	rsp.Body.Close()
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return rsp.StatusCode, fmt.Errorf("Unexpected response status %s", rsp.Status)
+	}
+
+	return rsp.StatusCode, nil
+}
+
+// retryable checks whether delivery which failed with the status may succeed later.
+// Client errors other than timeout and rate limit won't be fixed by retry
+func retryable(status int) bool {
+	switch {
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return true
+	case status >= 400 && status < 500:
+		return false
+	default:
+		return true
+	}
+}
+
+// Sign returns value of SignatureHeader for the body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,177 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bsbsm/feeder/pkg/db"
+	"github.com/bsbsm/feeder/pkg/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is a webhook endpoint which responds with the next status of its list,
+// the last status is repeated
+type receiver struct {
+	mut      sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+
+	status := r.statuses[0]
+	if len(r.statuses) > 1 {
+		r.statuses = r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *receiver) count() int {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	return len(r.requests)
+}
+
+// runDispatcher starts dispatcher of the bus, which is stopped when test ends
+func runDispatcher(t *testing.T, store *db.MemoryDatabase, bus *events.Bus) {
+	d, err := NewDispatcher(store)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	d.SetRetries(3, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(ctx, bus)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	assert.Eventually(t, func() bool { return bus.Subscribers() > 0 }, 5*time.Second, time.Millisecond)
+}
+
+// waitDeliveries waits until webhook log has count attempts and returns them
+func waitDeliveries(t *testing.T, store *db.MemoryDatabase, webhookID, count int) []*db.WebhookDelivery {
+	var deliveries []*db.WebhookDelivery
+	assert.Eventually(t, func() bool {
+		deliveries, _ = store.GetWebhookDeliveries(webhookID, 0, 10)
+		return len(deliveries) >= count
+	}, 5*time.Second, 5*time.Millisecond)
+
+	return deliveries
+}
+
+func TestNewDispatcher(t *testing.T) {
+	var store *db.MemoryDatabase
+	_, err := NewDispatcher(store)
+	assert.Error(t, err)
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	rcv := &receiver{statuses: []int{http.StatusOK}}
+	ts := httptest.NewServer(rcv)
+	defer ts.Close()
+
+	store := &db.MemoryDatabase{}
+	matching, _ := store.CreateWebhook(&db.Webhook{URL: ts.URL, SourceIDs: []int{1}, Keyword: "go", Secret: "secret"})
+	other, _ := store.CreateWebhook(&db.Webhook{URL: ts.URL + "/other", SourceIDs: []int{2}, Secret: "secret"})
+
+	bus := events.NewBus(events.DefaultHistory)
+	runDispatcher(t, store, bus)
+
+	bus.Publish(events.News{NewsID: 8, SourceID: 1, Title: "Rust release"})
+	bus.Publish(events.News{NewsID: 7, SourceID: 1, Title: "Go release", Payload: json.RawMessage(`{"a":1}`)})
+
+	deliveries := waitDeliveries(t, store, matching, 1)
+	if assert.NotEmpty(t, deliveries) {
+		assert.True(t, deliveries[0].Delivered)
+		assert.Equal(t, http.StatusOK, deliveries[0].Status)
+		assert.Equal(t, 7, deliveries[0].NewsID)
+		assert.Equal(t, 1, deliveries[0].Attempt)
+	}
+
+	rcv.mut.Lock()
+	req, body := rcv.requests[0], rcv.bodies[0]
+	rcv.mut.Unlock()
+
+	assert.Equal(t, "/", req.URL.Path)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "news", req.Header.Get(EventHeader))
+	assert.NotEmpty(t, req.Header.Get(DeliveryHeader))
+	assert.Equal(t, Sign("secret", body), req.Header.Get(SignatureHeader))
+
+	var e events.News
+	if assert.NoError(t, json.Unmarshal(body, &e)) {
+		assert.Equal(t, 7, e.NewsID)
+		assert.Equal(t, "Go release", e.Title)
+		assert.JSONEq(t, `{"a":1}`, string(e.Payload))
+	}
+
+	deliveries, err := store.GetWebhookDeliveries(other, 0, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, deliveries, "news of other source must not be delivered")
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		want     []int
+	}{
+		{name: "succeeds after failures", statuses: []int{500, 503, 204}, want: []int{500, 503, 204}},
+		{name: "gives up after max attempts", statuses: []int{500}, want: []int{500, 500, 500}},
+		{name: "rate limit is retried", statuses: []int{429, 200}, want: []int{429, 200}},
+		{name: "client error isn't retried", statuses: []int{400, 200}, want: []int{400}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv := &receiver{statuses: tt.statuses}
+			ts := httptest.NewServer(rcv)
+			defer ts.Close()
+
+			store := &db.MemoryDatabase{}
+			id, _ := store.CreateWebhook(&db.Webhook{URL: ts.URL, Secret: "secret"})
+
+			bus := events.NewBus(events.DefaultHistory)
+			runDispatcher(t, store, bus)
+
+			bus.Publish(events.News{NewsID: 1, SourceID: 1, Title: "News"})
+			waitDeliveries(t, store, id, len(tt.want))
+
+			// unexpected retries would be logged meanwhile
+			time.Sleep(50 * time.Millisecond)
+			deliveries, _ := store.GetWebhookDeliveries(id, 0, 10)
+
+			var statuses []int
+			for i := len(deliveries) - 1; i >= 0; i-- {
+				d := deliveries[i]
+				statuses = append(statuses, d.Status)
+				assert.Equal(t, len(deliveries)-i, d.Attempt)
+				assert.Equal(t, d.Status < 300, d.Delivered)
+				assert.Equal(t, d.Delivered, d.Error == "")
+			}
+			assert.Equal(t, tt.want, statuses)
+		})
+	}
+}
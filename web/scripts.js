@@ -1,17 +1,20 @@
 var apiUrl = "http://127.0.0.1:8080/api/";
 
-var offset = 0;
 var pageSize = 20;
+// title filter and cursors of the neighbour pages of the shown news
+var title = "";
+var nextCursor = "";
+var prevCursor = "";
 
 var newsList = document.getElementById('NewsList');
 var searchBox = document.getElementById('SearchBox');
 
-function showNews(newsCollection) {
-    offset += newsCollection.length
-    console.log("show news. New offset = ${offset}");
+function showNews(page) {
+    nextCursor = page.Next || "";
+    prevCursor = page.Prev || "";
     removeNews()
  
-    newsCollection.forEach(function(element) {
+    page.Items.forEach(function(element) {
         var child = document.createElement('div');
         console.log(element);
         child.setAttribute("newsID", element.ID);
@@ -89,10 +92,9 @@ window.onload = function () {
                 showNews(JSON.parse(responseText))
             };
             
-            var title = searchBox.value; 
-            // reset news offset
-            offset = 0;
-            var d = { t: title, off: offset, c: pageSize }
+            title = searchBox.value; 
+            // empty cursor loads the first page
+            var d = { t: title, c: pageSize, cursor: "" }
             
             ajax.get(apiUrl + 'news', d, cb, true);
         }
@@ -110,7 +112,11 @@ window.onload = function () {
                 showNews(JSON.parse(responseText))
             };
 
-            var d = { off: offset, c: pageSize }
+            if (nextCursor == "") {
+                return
+            }
+
+            var d = { t: title, c: pageSize, cursor: nextCursor }
             
             ajax.get(apiUrl + 'news', d, cb, true);
         }
@@ -128,13 +134,11 @@ window.onload = function () {
                 showNews(JSON.parse(responseText))
             };
 
-            offset -= pageSize
-            
-            if (offset < 0) {
-                offset = 0
+            if (prevCursor == "") {
+                return
             }
 
-            var d = {off: offset, c: pageSize }
+            var d = { t: title, c: pageSize, cursor: prevCursor }
             
             ajax.get(apiUrl + 'news', d, cb, true);
         }
@@ -159,6 +163,31 @@ window.onload = function () {
             ajax.put(apiUrl + 'feed', d, cb, true);
         }
 
+        document.getElementById("PreviewFeedSourceBtn").onclick = function() {
+            console.log("'preview rule' request sending");
+
+            var cb = function (responseText) {
+                if (responseText == '' || responseText == null) {
+                    console.log("'preview rule' response is null");
+                    return
+                }
+
+                console.log("'preview rule' response: \n" + responseText);
+
+                document.getElementById("NewsListRow").style.display = "none";
+                document.getElementById("NewsDetailRow").style.display='inline';
+                document.getElementById("NewsDetailSpan").innerHTML = "Rule preview, nothing is saved";
+                document.getElementById("NewsDetailTArea").value = JSON.stringify(JSON.parse(responseText), null, 2);
+            };
+
+            var sourceBox = document.getElementById("FeedSourceBox");
+            var ruleBox = document.getElementById("RuleBox");
+
+            var d = {u: sourceBox.value, r: ruleBox.value}
+
+            ajax.get(apiUrl + 'sources/preview', d, cb, true);
+        }
+
         document.getElementById("FirstExample").onclick = function () {
             var cb = function(){}
             var d = {u: 'https://www.netroby.com/rss', r: 'Title=NewTitle'}
@@ -211,6 +240,11 @@ window.onload = function () {
         x.open(method, url, async);
         x.onreadystatechange = function () {
             if (x.readyState == XMLHttpRequest.DONE) { // XMLHttpRequest.DONE == 4
+                if (x.status >= 400) {
+                    // failed API responses are {"Error": {"Code": ..., "Message": ...}}
+                    console.log('request "' + method + '" ' + url + ' failed: ' + x.status + ' ' + x.responseText);
+                    return
+                }
                 callback(x.responseText);
             }
         };